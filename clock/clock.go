@@ -0,0 +1,179 @@
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// テスト用。Advanceするまで時間が進まない
+type Fake struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{
+		clock:    f,
+		deadline: f.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+
+	f.timers = append(f.timers, t)
+	f.cond.Broadcast()
+
+	return t
+}
+
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	f.timers = slices.DeleteFunc(f.timers, func(t *fakeTimer) bool {
+		if t.deadline.After(f.now) {
+			return false
+		}
+
+		t.c <- f.now
+		return true
+	})
+	f.cond.Broadcast()
+}
+
+// 発火待ちのタイマーの数
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.timers)
+}
+
+// 発火待ちのタイマーがn個以上になるまで待つ。待っているgoroutineとの同期に使う
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+// fnを別のgoroutineで実行し、fnがタイマーを作って待ちに入ったらdだけ時計を進めてfnの結果を返す。
+// 待たずに終わったときは時計を進めない
+func (f *Fake) AdvanceWhenBlocked(d time.Duration, fn func() error) error {
+	timers := f.Timers()
+	done := make(chan error, 1)
+	finished := false
+	go func() {
+		err := fn()
+
+		f.mu.Lock()
+		finished = true
+		f.cond.Broadcast()
+		f.mu.Unlock()
+
+		done <- err
+	}()
+
+	f.mu.Lock()
+	for len(f.timers) <= timers && !finished {
+		f.cond.Wait()
+	}
+	blocked := !finished
+	f.mu.Unlock()
+
+	if blocked {
+		f.Advance(d)
+	}
+
+	return <-done
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i := slices.Index(f.timers, t)
+	if i < 0 {
+		return false
+	}
+
+	f.timers = slices.Delete(f.timers, i, i+1)
+	f.cond.Broadcast()
+
+	return true
+}
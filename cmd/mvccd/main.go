@@ -0,0 +1,52 @@
+// エンジンをHTTP/JSONのAPIで公開する
+//
+//	go run ./cmd/mvccd -engine appendonly -addr localhost:8080
+//	curl -X POST -d '{"level":"repeatable_read"}' localhost:8080/tx
+//	curl -X PUT -d '{"value":"v"}' localhost:8080/tx/<id>/keys/k
+//	curl -X POST localhost:8080/tx/<id>/commit
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/httpapi"
+	"mvcc-go/lock"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	addr := flag.String("addr", "localhost:8080", "listen address")
+	name := flag.String("engine", "appendonly", "engine ("+strings.Join(registry.Names(), ", ")+")")
+	lockTimeout := flag.Duration("lock-timeout", lock.Timeout, "default lock wait timeout (0 waits forever)")
+	idleTimeout := flag.Duration("idle-timeout", httpapi.DefaultIdleTimeout, "end transactions idle for this long (0 keeps them open)")
+	flag.Parse()
+
+	newEngine, err := registry.Lookup(*name)
+	if err != nil {
+		return err
+	}
+
+	timeout := *lockTimeout
+	if timeout == 0 {
+		timeout = lock.NoTimeout
+	}
+
+	s := httpapi.NewServer(newEngine(engine.WithLockTimeout(timeout)), httpapi.WithIdleTimeout(*idleTimeout))
+	defer s.Close()
+
+	fmt.Printf("%s engine listening on http://%s\n", *name, *addr)
+
+	return http.ListenAndServe(*addr, s)
+}
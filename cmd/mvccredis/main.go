@@ -0,0 +1,56 @@
+// Redisのクライアントからエンジンを使う
+//
+//	go run ./cmd/mvccredis -engine appendonly -addr localhost:6380
+//	redis-cli -p 6380
+//	> WATCH k
+//	> MULTI
+//	> SET k v
+//	> EXEC
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/lock"
+	"mvcc-go/resp"
+	"os"
+	"strings"
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	addr := flag.String("addr", "localhost:6380", "listen address")
+	name := flag.String("engine", "appendonly", "engine ("+strings.Join(registry.Names(), ", ")+")")
+	level := flag.String("level", string(engine.RepeatableRead), "default isolation level of connections")
+	lockTimeout := flag.Duration("lock-timeout", lock.Timeout, "lock wait timeout (0 waits forever)")
+	flag.Parse()
+
+	newEngine, err := registry.Lookup(*name)
+	if err != nil {
+		return err
+	}
+	isolationLevel, err := registry.ParseLevel(*level)
+	if err != nil {
+		return err
+	}
+
+	timeout := *lockTimeout
+	if timeout == 0 {
+		timeout = lock.NoTimeout
+	}
+
+	s := resp.NewServer(newEngine(engine.WithLockTimeout(timeout)), resp.WithLevel(isolationLevel))
+
+	fmt.Printf("%s engine listening on %s\n", *name, *addr)
+
+	return s.ListenAndServe(*addr)
+}
@@ -0,0 +1,53 @@
+// 名前付きのセッションでトランザクションを動かしてMVCCを観察する
+//
+//	go run ./cmd/mvccsh -engine appendonly
+//	> begin tx1 repeatable_read
+//	> begin tx2
+//	> tx1 set k v
+//	> tx2 get k
+//	> commit tx1
+//	> gc
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/lock"
+	"mvcc-go/shell"
+	"os"
+	"strings"
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	name := flag.String("engine", "appendonly", "engine ("+strings.Join(registry.Names(), ", ")+")")
+	lockTimeout := flag.Duration("lock-timeout", 0, "lock wait timeout (0 waits forever)")
+	versions := flag.Bool("versions", true, "print version chains after each step")
+	flag.Parse()
+
+	newEngine, err := registry.Lookup(*name)
+	if err != nil {
+		return err
+	}
+
+	timeout := *lockTimeout
+	if timeout == 0 {
+		timeout = lock.NoTimeout
+	}
+
+	s := shell.New(newEngine, os.Stdout, []engine.Option{engine.WithLockTimeout(timeout)},
+		shell.WithVersions(*versions))
+
+	fmt.Printf("%s engine. type help for commands\n", *name)
+
+	return s.Run(os.Stdin, *name+"> ")
+}
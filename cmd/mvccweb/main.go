@@ -0,0 +1,55 @@
+// ブラウザでトランザクションのタイムラインとバージョンチェーンを見ながらMVCCを動かす
+//
+//	go run ./cmd/mvccweb -engine appendonly scenario/testdata/*.scenario
+//	open http://localhost:8080
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mvcc-go/engine/registry"
+	"mvcc-go/lock"
+	"mvcc-go/scenario"
+	"mvcc-go/web"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	addr := flag.String("addr", "localhost:8080", "listen address")
+	name := flag.String("engine", "appendonly", "engine ("+strings.Join(registry.Names(), ", ")+")")
+	lockTimeout := flag.Duration("lock-timeout", web.DefaultLockTimeout, "lock wait timeout (0 waits forever)")
+	flag.Parse()
+
+	scenarios := make([]scenario.Scenario, 0, flag.NArg())
+	for _, path := range flag.Args() {
+		s, err := scenario.ParseFile(path)
+		if err != nil {
+			return err
+		}
+		scenarios = append(scenarios, s)
+	}
+
+	timeout := *lockTimeout
+	if timeout == 0 {
+		timeout = lock.NoTimeout
+	}
+
+	srv, err := web.New(*name, web.WithScenarios(scenarios...), web.WithLockTimeout(timeout))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("listening on http://%s\n", *addr)
+
+	return http.ListenAndServe(*addr, srv)
+}
@@ -0,0 +1,128 @@
+// .scenarioファイルをエンジンと分離レベルの組み合わせごとに実行し、期待と異なった操作を報告する
+//
+//	go run ./cmd/scenario scenario/testdata/*.scenario
+//	go run ./cmd/scenario -engine delta -level read_committed -v my.scenario
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/scenario"
+	"os"
+	"strings"
+)
+
+func main() {
+	failed, err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func run() (failed bool, err error) {
+	engines := flag.String("engine", "", "comma separated engines ("+strings.Join(registry.Names(), ", ")+") or all (default: the file's engines)")
+	levels := flag.String("level", "", "comma separated isolation levels or all (default: the file's levels)")
+	verbose := flag.Bool("v", false, "print the trace of passed runs too")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		return false, fmt.Errorf("usage: scenario [flags] file.scenario...")
+	}
+
+	for _, path := range flag.Args() {
+		s, err := scenario.ParseFile(path)
+		if err != nil {
+			return false, err
+		}
+
+		names, err := engineNames(*engines, s.Engines)
+		if err != nil {
+			return false, err
+		}
+		isolationLevels, err := isolationLevels(*levels, s.Levels)
+		if err != nil {
+			return false, err
+		}
+
+		for _, name := range names {
+			newEngine, err := registry.Lookup(name)
+			if err != nil {
+				return false, err
+			}
+
+			for _, level := range isolationLevels {
+				report, err := s.Run(newEngine, level)
+				if err != nil {
+					return false, fmt.Errorf("%s %s %s: %w", path, name, level, err)
+				}
+
+				status := "PASS"
+				if !report.Passed() {
+					status = "FAIL"
+					failed = true
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\n", status, path, name, level)
+
+				for _, m := range report.Mismatches {
+					fmt.Printf("\t%s\n", m)
+				}
+				if !report.Passed() || *verbose {
+					fmt.Printf("\t%s\n", strings.ReplaceAll(report.Trace, "\n", "\n\t"))
+				}
+			}
+		}
+	}
+
+	return failed, nil
+}
+
+func engineNames(flag string, fromFile []string) ([]string, error) {
+	switch flag {
+	case "":
+		if len(fromFile) > 0 {
+			return fromFile, nil
+		}
+		return registry.Names(), nil
+	case "all":
+		return registry.Names(), nil
+	}
+
+	names := strings.Split(flag, ",")
+	for _, name := range names {
+		if _, err := registry.Lookup(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
+
+func isolationLevels(flag string, fromFile []engine.IsolationLevel) ([]engine.IsolationLevel, error) {
+	all := []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead}
+	switch flag {
+	case "":
+		if len(fromFile) > 0 {
+			return fromFile, nil
+		}
+		return all, nil
+	case "all":
+		return all, nil
+	}
+
+	levels := make([]engine.IsolationLevel, 0)
+	for _, s := range strings.Split(flag, ",") {
+		level, err := registry.ParseLevel(s)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+
+	return levels, nil
+}
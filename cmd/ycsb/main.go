@@ -0,0 +1,101 @@
+// エンジンと分離レベルの組み合わせごとにYCSBのワークロードを実行し、結果を表にする
+//
+//	go run ./cmd/ycsb -engine all -workload A,F -concurrency 8
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/ycsb"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		engines      = flag.String("engine", "all", "comma separated engines ("+strings.Join(registry.Names(), ", ")+") or all")
+		levels       = flag.String("level", "all", "comma separated isolation levels or all")
+		workloads    = flag.String("workload", "all", "comma separated workloads (A-F) or all")
+		distribution = flag.String("distribution", "", "uniform, zipfian or latest (default: workload's)")
+		config       ycsb.Config
+	)
+	flag.IntVar(&config.Records, "records", 1000, "number of keys to load")
+	flag.IntVar(&config.Operations, "ops", 10000, "number of operations")
+	flag.IntVar(&config.ValueSize, "value-size", 100, "value size in bytes")
+	flag.IntVar(&config.Concurrency, "concurrency", 1, "number of concurrent clients")
+	flag.IntVar(&config.ScanLength, "scan-length", 10, "maximum number of keys per scan")
+	flag.DurationVar(&config.GCInterval, "gc-interval", 10*time.Millisecond, "interval of GC during the run (0 disables)")
+	flag.DurationVar(&config.LockTimeout, "lock-timeout", 10*time.Millisecond, "lock wait timeout (0 uses engine default)")
+	flag.Uint64Var(&config.Seed, "seed", 0, "random seed")
+	flag.Parse()
+
+	switch d := ycsb.Distribution(*distribution); d {
+	case "", ycsb.Uniform, ycsb.Zipfian, ycsb.Latest:
+		config.Distribution = d
+	default:
+		return fmt.Errorf("unknown distribution %q", *distribution)
+	}
+
+	names := registry.Names()
+	if *engines != "all" {
+		names = strings.Split(*engines, ",")
+	}
+
+	isolationLevels := []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead}
+	if *levels != "all" {
+		isolationLevels = isolationLevels[:0]
+		for _, s := range strings.Split(*levels, ",") {
+			level, err := registry.ParseLevel(s)
+			if err != nil {
+				return err
+			}
+			isolationLevels = append(isolationLevels, level)
+		}
+	}
+
+	selected := ycsb.Workloads
+	if *workloads != "all" {
+		selected = nil
+		for _, s := range strings.Split(*workloads, ",") {
+			w, err := ycsb.Lookup(s)
+			if err != nil {
+				return err
+			}
+			selected = append(selected, w)
+		}
+	}
+
+	results := make([]ycsb.Result, 0)
+	for _, name := range names {
+		newEngine, err := registry.Lookup(name)
+		if err != nil {
+			return err
+		}
+
+		for _, level := range isolationLevels {
+			for _, w := range selected {
+				c := config
+				c.Workload, c.Level = w, level
+
+				result, err := ycsb.Run(name, newEngine, c)
+				if err != nil {
+					return fmt.Errorf("%s %s %s: %w", name, level, w.Name, err)
+				}
+				results = append(results, result)
+			}
+		}
+	}
+
+	return ycsb.WriteTable(os.Stdout, results)
+}
@@ -1,57 +1,145 @@
 package appendonly
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"mvcc-go/engine"
 	"mvcc-go/engine/appendonly/storage"
+	"mvcc-go/engine/readview"
 	"mvcc-go/lock"
+	"sync"
+	"time"
 )
 
 type Tx struct {
-	ID         int
-	level      engine.IsolationLevel
-	engine     *AppendOnlyEngine
-	lockedKeys map[string]struct{}
-	txInfo     storage.TxInfo
+	ID          int
+	level       engine.IsolationLevel
+	engine      *AppendOnlyEngine
+	lockedKeys  map[string]struct{}
+	view        readview.ReadView
+	readOnly    bool
+	done        bool // CommitかAbortが済んだ
+	lockTimeout time.Duration
 }
 
-func newTx(e *AppendOnlyEngine, txID int, level engine.IsolationLevel) *Tx {
+func newTx(e *AppendOnlyEngine, txID int, level engine.IsolationLevel, options engine.TxOptions) *Tx {
 	return &Tx{
-		ID:         txID,
-		level:      level,
-		engine:     e,
-		lockedKeys: make(map[string]struct{}),
-		txInfo:     e.txInfo.Clone(),
+		ID:          txID,
+		level:       level,
+		engine:      e,
+		lockedKeys:  make(map[string]struct{}),
+		view:        e.readView(txID),
+		lockTimeout: options.LockTimeout,
 	}
 }
 
 func (tx *Tx) Get(key string) (string, error) {
-	if tx.level == engine.ReadCommitted {
-		tx.txInfo = tx.engine.txInfo.Clone()
+	var value string
+	err := tx.Statement(func(s engine.Stmt) error {
+		var err error
+		value, err = s.Get(key)
+		return err
+	})
+
+	return value, err
+}
+
+// 見つからなかったキーは結果に含めない
+func (tx *Tx) MultiGet(keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	err := tx.Statement(func(s engine.Stmt) error {
+		for _, key := range keys {
+			value, err := s.Get(key)
+			if errors.Is(err, engine.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			values[key] = value
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	value, ok := tx.engine.storage.Get(key, tx.ID, tx.txInfo)
-	if !ok {
-		return "", engine.ErrNotFound
+	return values, nil
+}
+
+// ReadCommittedでも文の中では同じスナップショットを使う
+func (tx *Tx) Statement(f func(s engine.Stmt) error) error {
+	if tx.level == engine.ReadCommitted {
+		tx.engine.mu.Lock()
+		tx.view = tx.engine.readView(tx.ID)
+		tx.engine.mu.Unlock()
 	}
 
-	return value, nil
+	return f(&stmt{tx: tx, view: tx.view})
 }
 
 func (tx *Tx) Set(key, value string) error {
-	err := tx.engine.lockManager.XLock(tx.ID, key)
+	if tx.readOnly {
+		return engine.ErrReadOnly
+	}
+
+	_, locked := tx.lockedKeys[key]
+
+	err := tx.engine.lockManager.XLockTimeout(tx.ID, key, tx.lockTimeout)
 	if err != nil {
 		return fmt.Errorf("xlock: %w", err)
 	}
 
-	tx.lockedKeys[key] = struct{}{}
+	tx.engine.mu.Lock()
+	if tx.level == engine.RepeatableRead && tx.engine.storage.UpdatedSince(key, tx.view) {
+		tx.engine.mu.Unlock()
+
+		// スナップショットより後にコミットされた更新を上書きしない（first-updater-wins）。
+		// 書かなかったキーのロックはすぐに返す
+		if !locked {
+			err := tx.engine.lockManager.Unlock(tx.ID, key)
+			if err != nil {
+				return fmt.Errorf("unlock: %w", err)
+			}
+		}
 
+		return engine.ErrSerialization
+	}
+
+	tx.lockedKeys[key] = struct{}{}
 	tx.engine.storage.Set(key, value, tx.ID)
+	tx.engine.options.Observer.OnVersionCreated(tx.ID, key)
+	tx.engine.mu.Unlock()
 
 	return nil
 }
 
 func (tx *Tx) Commit() error {
+	return tx.end(tx.engine.commit)
+}
+
+func (tx *Tx) Abort() error {
+	return tx.end(tx.engine.abort)
+}
+
+// 結果を確定してからロックを解放する。待っていたトランザクションには確定した結果が見える
+func (tx *Tx) end(finish func(tx *Tx)) error {
+	tx.engine.mu.Lock()
+	if tx.done {
+		tx.engine.mu.Unlock()
+		return engine.ErrTxDone
+	}
+	tx.done = true
+	if tx.readOnly {
+		tx.engine.release(tx)
+	} else {
+		finish(tx)
+	}
+	tx.engine.mu.Unlock()
+
 	for key := range tx.lockedKeys {
 		err := tx.engine.lockManager.Unlock(tx.ID, key)
 		if err != nil {
@@ -59,43 +147,219 @@ func (tx *Tx) Commit() error {
 		}
 	}
 
-	tx.engine.commit(tx)
-
 	return nil
 }
 
-var _ engine.Engine = &AppendOnlyEngine{}
+type stmt struct {
+	tx   *Tx
+	view readview.ReadView
+}
+
+func (s *stmt) Get(key string) (string, error) {
+	s.tx.engine.mu.Lock()
+	defer s.tx.engine.mu.Unlock()
 
+	value, ok := s.tx.engine.storage.Get(key, s.view)
+	if !ok {
+		return "", engine.ErrNotFound
+	}
+
+	return value, nil
+}
+
+func (s *stmt) Set(key, value string) error {
+	return s.tx.Set(key, value)
+}
+
+var _ engine.TimeTravelEngine = &AppendOnlyEngine{}
+var _ engine.HistoryEngine = &AppendOnlyEngine{}
+var _ engine.ExplainEngine = &AppendOnlyEngine{}
+var _ engine.StatsEngine = &AppendOnlyEngine{}
+var _ engine.LockEngine = &AppendOnlyEngine{}
+var _ engine.DotEngine = &AppendOnlyEngine{}
+
+// ロック待ちの間はmuを持たないので、複数のgoroutineから同時に使える
 type AppendOnlyEngine struct {
+	mu          sync.Mutex // storage・トランザクション一覧・pinsを守る
 	storage     *storage.AppendOnlyStorage
 	lockManager *lock.Manager
 	maxTxID     int
-	txInfo      *storage.TxInfo
+	active      *readview.Tracker
+	options     engine.Options
+	pins        map[int]int // 過去のスナップショットのコミット番号 -> 参照数
+	gcHorizon   int         // これより前のコミット時点はGC済みで読めない
 }
 
-func NewAppendOnlyEngine() *AppendOnlyEngine {
+func NewAppendOnlyEngine(opts ...engine.Option) *AppendOnlyEngine {
+	options := engine.NewOptions(opts...)
+
 	return &AppendOnlyEngine{
-		storage:     storage.NewAppendOnlyStorage(),
-		lockManager: lock.NewManager(),
+		storage:     storage.NewAppendOnlyStorage(options.Logger),
+		lockManager: lock.NewManager(lock.WithTimeout(options.LockTimeout), lock.WithClock(options.Clock), lock.WithObserver(options.Observer)),
 		maxTxID:     0,
-		txInfo: &storage.TxInfo{
-			ActiveTxIDs: make(map[int]struct{}),
-			MinTxID:     1, // first txID
-		},
+		active:      readview.NewTracker(),
+		options:     options,
+		pins:        make(map[int]int),
 	}
 }
 
-func (e *AppendOnlyEngine) Begin(level engine.IsolationLevel) engine.Tx {
+func (e *AppendOnlyEngine) Begin(level engine.IsolationLevel, opts ...engine.TxOption) engine.Tx {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	e.maxTxID++
-	e.txInfo.ActiveTxIDs[e.maxTxID] = struct{}{}
+	e.active.Begin(e.maxTxID, e.storage.CLog.LastCommitNo())
+	e.storage.CLog.Begin(e.maxTxID)
+	e.options.Observer.OnBegin(e.maxTxID, level)
+
+	return newTx(e, e.maxTxID, level, engine.NewTxOptions(e.options, opts...))
+}
+
+func (e *AppendOnlyEngine) BeginAt(commitNo int) (engine.Tx, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if commitNo > e.storage.CLog.LastCommitNo() {
+		return nil, fmt.Errorf("commit %d not found", commitNo)
+	}
+
+	if commitNo < e.gcHorizon {
+		return nil, fmt.Errorf("commit %d: %w", commitNo, engine.ErrSnapshotTooOld)
+	}
+
+	e.pins[commitNo]++
 
-	return newTx(e, e.maxTxID, level)
+	return &Tx{
+		level:    engine.RepeatableRead,
+		engine:   e,
+		view:     readview.AsOf(commitNo),
+		readOnly: true,
+	}, nil
+}
+
+func (e *AppendOnlyEngine) BeginAtTime(t time.Time) (engine.Tx, error) {
+	e.mu.Lock()
+	commitNo := e.storage.CLog.CommitNoAt(t)
+	e.mu.Unlock()
+
+	return e.BeginAt(commitNo)
 }
 
 func (e *AppendOnlyEngine) commit(tx *Tx) {
-	e.txInfo.Delete(tx.ID)
+	e.storage.CLog.Commit(tx.ID, e.options.Clock.Now())
+	e.active.End(tx.ID)
+	e.options.Observer.OnCommit(tx.ID, tx.level)
+}
+
+func (e *AppendOnlyEngine) abort(tx *Tx) {
+	e.storage.CLog.Abort(tx.ID)
+	e.active.End(tx.ID)
+	e.options.Observer.OnAbort(tx.ID, tx.level)
+}
+
+func (e *AppendOnlyEngine) History(key string) []engine.Version {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.storage.History(key, e.readView(0))
+}
+
+func (e *AppendOnlyEngine) Explain(tx engine.Tx, key string) (engine.Explanation, error) {
+	t, ok := tx.(*Tx)
+	if !ok || t.engine != e {
+		return engine.Explanation{}, engine.ErrForeignTx
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	view := e.snapshot(t)
+
+	return engine.NewExplanation(key, view, e.storage.Explain(key, view)), nil
+}
+
+// ReadCommittedなら次の文で使われるスナップショット。must be called with e.mu locked.
+func (e *AppendOnlyEngine) snapshot(t *Tx) readview.ReadView {
+	if t.level == engine.ReadCommitted {
+		return e.readView(t.ID)
+	}
+
+	return t.view
+}
+
+// txsのスナップショットから見えるバージョンに印をつける
+func (e *AppendOnlyEngine) WriteDot(w io.Writer, txs ...engine.Tx) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	views := make([]readview.ReadView, len(txs))
+	for i, tx := range txs {
+		t, ok := tx.(*Tx)
+		if !ok || t.engine != e {
+			return engine.ErrForeignTx
+		}
+		views[i] = e.snapshot(t)
+	}
+
+	return e.storage.WriteDot(w, views)
+}
+
+func (e *AppendOnlyEngine) Stats() engine.Stats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return engine.Stats{
+		ChainLengths: e.storage.ChainLengths(),
+	}
+}
+
+func (e *AppendOnlyEngine) release(tx *Tx) {
+	commitNo := tx.view.CommitNo
+
+	e.pins[commitNo]--
+	if e.pins[commitNo] == 0 {
+		delete(e.pins, commitNo)
+	}
+}
+
+// 実行中のトランザクション・過去のスナップショット・保持期間のために残す必要がある最古のコミット番号
+func (e *AppendOnlyEngine) horizon() int {
+	horizon := e.storage.CLog.LastCommitNo()
+
+	for commitNo := range e.pins {
+		horizon = min(horizon, commitNo)
+	}
+
+	// 実行中のトランザクションが開始時点で見えていた版も残す
+	if commitNo, ok := e.active.MinCommitNo(); ok {
+		horizon = min(horizon, commitNo)
+	}
+
+	if e.options.Retention > 0 {
+		horizon = min(horizon, e.storage.CLog.CommitNoAt(e.options.Clock.Now().Add(-e.options.Retention)))
+	}
+
+	return horizon
+}
+
+func (e *AppendOnlyEngine) Locks() []lock.KeyLocks {
+	return e.lockManager.Snapshot()
 }
 
 func (e *AppendOnlyEngine) GC() (active, removed int) {
-	return e.storage.Vacuum(e.txInfo)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	horizon := e.horizon()
+	e.gcHorizon = max(e.gcHorizon, horizon)
+
+	active, removed = e.storage.Vacuum(e.active, horizon)
+	e.options.Logger.Debug("vacuum", "horizon", horizon, "active", active, "removed", removed)
+	e.options.Observer.OnVacuum(active, removed)
+
+	return active, removed
+}
+
+func (e *AppendOnlyEngine) readView(txID int) readview.ReadView {
+	return e.active.ReadView(txID, e.storage.CLog.LastCommitNo())
 }
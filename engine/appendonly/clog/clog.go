@@ -0,0 +1,88 @@
+package clog
+
+import (
+	"sort"
+	"time"
+)
+
+type Status int
+
+const (
+	InProgress Status = iota // 未確定（ヒントビット未設定も兼ねる）
+	Committed
+	Aborted
+)
+
+func (s Status) String() string {
+	switch s {
+	case Committed:
+		return "committed"
+	case Aborted:
+		return "aborted"
+	default:
+		return "in_progress"
+	}
+}
+
+type entry struct {
+	status   Status
+	commitNo int
+}
+
+type CommitLog struct {
+	entries      map[int]entry
+	lastCommitNo int
+	commitTimes  []time.Time // commitNo-1 -> コミット時刻
+}
+
+func NewCommitLog() *CommitLog {
+	return &CommitLog{
+		entries: make(map[int]entry),
+	}
+}
+
+func (c *CommitLog) Begin(txID int) {
+	c.entries[txID] = entry{status: InProgress}
+}
+
+func (c *CommitLog) Commit(txID int, at time.Time) int {
+	c.lastCommitNo++
+	c.entries[txID] = entry{status: Committed, commitNo: c.lastCommitNo}
+	c.commitTimes = append(c.commitTimes, at)
+
+	return c.lastCommitNo
+}
+
+func (c *CommitLog) Abort(txID int) {
+	c.entries[txID] = entry{status: Aborted}
+}
+
+// horizonまでにコミットしたかアボートしたトランザクションを消す。
+// 参照するバージョンにはヒントビットが書き込まれていること。消したトランザクションのコミット番号は0になる
+func (c *CommitLog) Truncate(horizon int) {
+	for txID, e := range c.entries {
+		if e.status == Aborted || (e.status == Committed && e.commitNo <= horizon) {
+			delete(c.entries, txID)
+		}
+	}
+}
+
+func (c *CommitLog) Status(txID int) Status {
+	return c.entries[txID].status
+}
+
+// commitNo of committed tx, 0 otherwise
+func (c *CommitLog) CommitNo(txID int) int {
+	return c.entries[txID].commitNo
+}
+
+func (c *CommitLog) LastCommitNo() int {
+	return c.lastCommitNo
+}
+
+// t時点での最終コミット番号
+func (c *CommitLog) CommitNoAt(t time.Time) int {
+	return sort.Search(len(c.commitTimes), func(i int) bool {
+		return c.commitTimes[i].After(t)
+	})
+}
@@ -0,0 +1,108 @@
+package clog_test
+
+import (
+	"mvcc-go/engine/appendonly/clog"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	c := clog.NewCommitLog()
+	at := time.Now()
+
+	c.Begin(1)
+	c.Begin(2)
+	c.Begin(3)
+	if got := c.Commit(2, at); got != 1 {
+		t.Errorf("expected commit #1, but got %d", got)
+	}
+	c.Abort(3)
+
+	for _, tt := range []struct {
+		txID     int
+		status   clog.Status
+		commitNo int
+	}{
+		{1, clog.InProgress, 0},
+		{2, clog.Committed, 1},
+		{3, clog.Aborted, 0},
+		{4, clog.InProgress, 0}, // 始まっていない
+	} {
+		if got := c.Status(tt.txID); got != tt.status {
+			t.Errorf("tx%d: expected %s, but got %s", tt.txID, tt.status, got)
+		}
+		if got := c.CommitNo(tt.txID); got != tt.commitNo {
+			t.Errorf("tx%d: expected commit #%d, but got %d", tt.txID, tt.commitNo, got)
+		}
+	}
+	if c.LastCommitNo() != 1 {
+		t.Errorf("expected last commit #1, but got %d", c.LastCommitNo())
+	}
+}
+
+// horizonまでに確定したものだけを消す。消したものは実行中と区別できないので、参照する側はヒントを使う
+func TestTruncate(t *testing.T) {
+	c := clog.NewCommitLog()
+	at := time.Now()
+
+	for txID := 1; txID <= 5; txID++ {
+		c.Begin(txID)
+	}
+	c.Commit(1, at) // #1
+	c.Abort(2)
+	c.Commit(3, at) // #2
+	c.Commit(4, at) // #3
+
+	c.Truncate(2)
+
+	for _, tt := range []struct {
+		txID     int
+		status   clog.Status
+		commitNo int
+	}{
+		{1, clog.InProgress, 0},
+		{2, clog.InProgress, 0},
+		{3, clog.InProgress, 0},
+		{4, clog.Committed, 3},
+		{5, clog.InProgress, 0},
+	} {
+		if got := c.Status(tt.txID); got != tt.status {
+			t.Errorf("tx%d: expected %s, but got %s", tt.txID, tt.status, got)
+		}
+		if got := c.CommitNo(tt.txID); got != tt.commitNo {
+			t.Errorf("tx%d: expected commit #%d, but got %d", tt.txID, tt.commitNo, got)
+		}
+	}
+
+	// 実行中のものは残り、後でコミットできる。コミット番号は切り詰めても戻らない
+	if got := c.Commit(5, at); got != 4 || c.Status(5) != clog.Committed {
+		t.Errorf("expected tx5 to commit as #4, but got %d (%s)", got, c.Status(5))
+	}
+}
+
+func TestCommitNoAt(t *testing.T) {
+	c := clog.NewCommitLog()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for txID := 1; txID <= 3; txID++ {
+		c.Begin(txID)
+		c.Commit(txID, start.Add(time.Duration(txID)*time.Second))
+	}
+	c.Truncate(3)
+
+	for _, tt := range []struct {
+		at   time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Second - 1, 0},
+		{time.Second, 1}, // ちょうどの時刻のコミットは含む
+		{2500 * time.Millisecond, 2},
+		{time.Hour, 3},
+	} {
+		// 切り詰めた後もコミット時刻は残る
+		if got := c.CommitNoAt(start.Add(tt.at)); got != tt.want {
+			t.Errorf("at +%v: expected #%d, but got %d", tt.at, tt.want, got)
+		}
+	}
+}
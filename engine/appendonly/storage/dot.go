@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"mvcc-go/engine/appendonly/clog"
+	"mvcc-go/engine/dot"
+	"mvcc-go/engine/readview"
+	"slices"
+	"strings"
+)
+
+// clogでの状態とヒントビット
+func (s *AppendOnlyStorage) describe(label string, txID int, hint Hint) string {
+	st, commitNo := s.peek(txID, hint)
+	desc := fmt.Sprintf("%s tx%d %s", label, txID, st)
+	if commitNo != 0 {
+		desc += fmt.Sprintf(" #%d", commitNo)
+	}
+	if hint.Status != clog.InProgress {
+		desc += " (hint)"
+	}
+
+	return desc
+}
+
+// キーごとにバージョンを物理的な並びで書き、削除したトランザクションが作ったバージョンへ辺を引く。
+// viewsのスナップショットからは見えるバージョンへ点線を引く。ヒントビットは書き換えない
+func (s *AppendOnlyStorage) WriteDot(w io.Writer, views []readview.ReadView) error {
+	var b strings.Builder
+	b.WriteString("digraph appendonly {\n  rankdir=LR;\n  node [shape=record, fontname=monospace];\n")
+
+	keys := make([]string, 0)
+	for _, r := range s.records {
+		if !slices.Contains(keys, r.Key) {
+			keys = append(keys, r.Key)
+		}
+	}
+	slices.Sort(keys)
+
+	for k, key := range keys {
+		fmt.Fprintf(&b, "  subgraph cluster_%d {\n    label=%s;\n", k, dot.Quote(key))
+
+		ids := make(map[int]string) // BeginTxID -> ノードID
+		for i, r := range s.records {
+			if r.Key != key {
+				continue
+			}
+			ids[r.BeginTxID] = fmt.Sprintf("v%d", i)
+
+			fields := []string{fmt.Sprintf("%q", r.Value), s.describe("xmin", r.BeginTxID, r.BeginHint)}
+			if r.EndTxID != 0 {
+				fields = append(fields, s.describe("xmax", r.EndTxID, r.EndHint))
+			}
+			fmt.Fprintf(&b, "    v%d [label=%s%s];\n", i, dot.Record(fields...), s.style(r))
+		}
+
+		// 削除したトランザクションが書いたバージョンが次の版
+		for i, r := range s.records {
+			if r.Key != key || r.EndTxID == 0 {
+				continue
+			}
+			if next, ok := ids[r.EndTxID]; ok {
+				fmt.Fprintf(&b, "    v%d -> %s [label=%s];\n", i, next, dot.Quote(fmt.Sprintf("tx%d", r.EndTxID)))
+			}
+		}
+
+		b.WriteString("  }\n")
+	}
+
+	for _, view := range views {
+		b.WriteString(dot.Snapshot(view))
+		for i := range s.records {
+			r := s.records[i] // ヒントビットを書き換えないようにコピーで判定する
+			if isVisiable(&r, view, s.CLog) && (r.EndTxID == 0 || !visibility(r.EndTxID, &r.EndHint, view, s.CLog).Visible()) {
+				fmt.Fprintf(&b, "  %s -> v%d [style=dashed, color=darkgoldenrod];\n", dot.SnapshotID(view), i)
+			}
+		}
+	}
+
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// clogから消えたトランザクションはヒントビットで判断する。ヒントビットは書き換えない
+func (s *AppendOnlyStorage) peek(txID int, hint Hint) (clog.Status, int) {
+	if hint.Status != clog.InProgress {
+		return hint.Status, hint.CommitNo
+	}
+
+	return s.CLog.Status(txID), s.CLog.CommitNo(txID)
+}
+
+// 実行中は青、アボートは灰色の点線、削除がコミット済みなら灰色で塗る
+func (s *AppendOnlyStorage) style(r Record) string {
+	begin, _ := s.peek(r.BeginTxID, r.BeginHint)
+	end, _ := s.peek(r.EndTxID, r.EndHint)
+
+	switch {
+	case begin == clog.Aborted:
+		return ", style=dashed, color=gray"
+	case begin == clog.InProgress:
+		return ", color=blue"
+	case r.EndTxID != 0 && end == clog.Committed:
+		return ", style=filled, fillcolor=lightgray"
+	}
+
+	return ""
+}
@@ -1,9 +1,10 @@
 package storage
 
 import (
-	"log"
-	"maps"
-	"slices"
+	"log/slog"
+	"mvcc-go/engine"
+	"mvcc-go/engine/appendonly/clog"
+	"mvcc-go/engine/readview"
 )
 
 type Record struct {
@@ -11,71 +12,118 @@ type Record struct {
 	Value     string
 	BeginTxID int
 	EndTxID   int
+
+	// hint bits: clogの確定結果をキャッシュする
+	BeginHint Hint
+	EndHint   Hint
 }
 
-type TxInfo struct {
-	ActiveTxIDs map[int]struct{}
-	MinTxID     int
+// clogはvacuumで切り詰めるので、コミット番号も一緒に残す
+type Hint struct {
+	Status   clog.Status // InProgressは未設定
+	CommitNo int
 }
 
-func (info *TxInfo) Clone() TxInfo {
-	return TxInfo{
-		ActiveTxIDs: maps.Clone(info.ActiveTxIDs),
-		MinTxID:     info.MinTxID,
+// clogを引いて確定していればヒントビットに記録する
+func status(hint *Hint, txID int, commitLog *clog.CommitLog) clog.Status {
+	if hint.Status != clog.InProgress {
+		return hint.Status
 	}
-}
 
-func (info *TxInfo) Delete(txID int) {
-	delete(info.ActiveTxIDs, txID)
+	st := commitLog.Status(txID)
+	if st != clog.InProgress {
+		*hint = Hint{Status: st, CommitNo: commitLog.CommitNo(txID)}
+	}
+
+	return st
+}
 
-	if len(info.ActiveTxIDs) == 0 {
-		info.MinTxID = 0
-		return
+// commitNo of committed tx, 0 otherwise
+func commitNo(hint *Hint, txID int, commitLog *clog.CommitLog) int {
+	if status(hint, txID, commitLog) != clog.Committed {
+		return 0
 	}
 
-	info.MinTxID = slices.Min(slices.Collect(maps.Keys(info.ActiveTxIDs)))
+	return hint.CommitNo
 }
 
-func isVisiable(recordTxID, myTxID int, txInfo TxInfo) bool {
-	if recordTxID == myTxID {
+func visibility(txID int, hint *Hint, view readview.ReadView, commitLog *clog.CommitLog) engine.Reason {
+	if view.Historical {
+		// 指定したコミット時点までにコミットされたものだけ見る
+		switch status(hint, txID, commitLog) {
+		case clog.Aborted:
+			return engine.ReasonAborted
+		case clog.InProgress:
+			return engine.ReasonActive
+		}
+
+		if hint.CommitNo > view.CommitNo {
+			return engine.ReasonFuture
+		}
+
+		return engine.ReasonCommitted
+	}
+
+	if txID == view.CreatorTxID {
 		// 自分自身が書いたものは見える
-		return true
+		return engine.ReasonOwnWrite
 	}
 
-	if recordTxID > myTxID {
-		// 自分より後のトランザクションが書いたものは見ない
-		log.Printf("not visible because not committed")
-		return false
+	if txID >= view.HighTxID {
+		// ビュー作成より後に開始したトランザクションが書いたものは見ない
+		return engine.ReasonFuture
 	}
 
-	if _, ok := txInfo.ActiveTxIDs[recordTxID]; ok {
+	if view.IsActive(txID) {
 		// アクティブなトランザクションが書いたものは見ない
-		log.Printf("not visible because active")
+		return engine.ReasonActive
+	}
+
+	if status(hint, txID, commitLog) == clog.Aborted {
+		// アボートしたトランザクションが書いたものは見ない
+		return engine.ReasonAborted
+	}
+
+	return engine.ReasonCommitted
+}
+
+func isVisiable(r *Record, view readview.ReadView, commitLog *clog.CommitLog) bool {
+	return visibility(r.BeginTxID, &r.BeginHint, view, commitLog).Visible()
+}
+
+// 削除したトランザクションがアボートしていればまだ最新版として扱う
+func isLive(r *Record, commitLog *clog.CommitLog) bool {
+	if status(&r.BeginHint, r.BeginTxID, commitLog) == clog.Aborted {
 		return false
 	}
 
-	return true
+	return r.EndTxID == 0 || status(&r.EndHint, r.EndTxID, commitLog) == clog.Aborted
 }
 
 type AppendOnlyStorage struct {
 	records []Record
+	CLog    *clog.CommitLog
+	logger  *slog.Logger
 }
 
-func NewAppendOnlyStorage() *AppendOnlyStorage {
+func NewAppendOnlyStorage(logger *slog.Logger) *AppendOnlyStorage {
 	return &AppendOnlyStorage{
 		records: make([]Record, 0),
+		CLog:    clog.NewCommitLog(),
+		logger:  logger,
 	}
 }
 
-func (s *AppendOnlyStorage) Get(key string, txID int, txInfo TxInfo) (string, bool) {
+func (s *AppendOnlyStorage) Get(key string, view readview.ReadView) (string, bool) {
 	var value string
 	found := false
-	for _, r := range s.records {
+	for i := range s.records {
+		r := &s.records[i]
 		if r.Key != key {
 			continue
 		}
 
-		if !isVisiable(r.BeginTxID, txID, txInfo) {
+		if !isVisiable(r, view, s.CLog) {
 			continue
 		}
 
@@ -86,20 +134,83 @@ func (s *AppendOnlyStorage) Get(key string, txID int, txInfo TxInfo) (string, bo
 	return value, found
 }
 
+func (s *AppendOnlyStorage) History(key string, view readview.ReadView) []engine.Version {
+	versions := make([]engine.Version, 0)
+	visible := -1
+	for i := range s.records {
+		r := &s.records[i]
+		if r.Key != key {
+			continue
+		}
+
+		if isVisiable(r, view, s.CLog) {
+			visible = len(versions)
+		}
+
+		versions = append(versions, engine.Version{
+			Value:     r.Value,
+			BeginTxID: r.BeginTxID,
+			EndTxID:   r.EndTxID,
+			CommitNo:  commitNo(&r.BeginHint, r.BeginTxID, s.CLog),
+		})
+	}
+
+	if visible >= 0 {
+		versions[visible].Visible = true
+	}
+
+	return versions
+}
+
+func (s *AppendOnlyStorage) Explain(key string, view readview.ReadView) []engine.Step {
+	steps := make([]engine.Step, 0)
+	for i := range s.records {
+		r := &s.records[i]
+		if r.Key != key {
+			continue
+		}
+
+		reason := visibility(r.BeginTxID, &r.BeginHint, view, s.CLog)
+		if reason.Visible() && r.EndTxID != 0 && visibility(r.EndTxID, &r.EndHint, view, s.CLog).Visible() {
+			reason = engine.ReasonDeleted
+		}
+
+		steps = append(steps, engine.Step{
+			Value:   r.Value,
+			TxID:    r.BeginTxID,
+			Visible: reason.Visible(),
+			Reason:  reason,
+		})
+	}
+
+	return steps
+}
+
+func (s *AppendOnlyStorage) ChainLengths() map[string]int {
+	lengths := make(map[string]int)
+	for _, r := range s.records {
+		lengths[r.Key]++
+	}
+
+	return lengths
+}
+
 func (s *AppendOnlyStorage) Set(key, value string, txID int) {
-	for i, r := range s.records {
+	for i := range s.records {
+		r := &s.records[i]
 		if r.Key != key {
 			continue
 		}
 
 		if r.BeginTxID == txID {
 			// update latest myself
-			s.records[i].Value = value
+			r.Value = value
 			return
 		}
 
-		if r.EndTxID == 0 {
-			s.records[i].EndTxID = txID
+		if isLive(r, s.CLog) {
+			r.EndTxID = txID
+			r.EndHint = Hint{}
 			break
 		}
 	}
@@ -111,21 +222,59 @@ func (s *AppendOnlyStorage) Set(key, value string, txID int) {
 	})
 }
 
-func (s *AppendOnlyStorage) Vacuum(txInfo *TxInfo) (active, removed int) {
-	s.records = slices.DeleteFunc(s.records, func(r Record) bool {
-		if r.EndTxID == 0 {
-			return false
+// 最新版がviewから見えなければ、スナップショットの後に他のトランザクションが更新している
+func (s *AppendOnlyStorage) UpdatedSince(key string, view readview.ReadView) bool {
+	for i := range s.records {
+		r := &s.records[i]
+		if r.Key != key || !isLive(r, s.CLog) {
+			continue
+		}
+
+		return !isVisiable(r, view, s.CLog)
+	}
+
+	return false
+}
+
+// horizonより後のコミットで削除されたバージョンは過去のスナップショット用に残す。
+// 残したバージョンにはヒントビットを書き込み、horizonまでに確定したトランザクションはclogから消す
+func (s *AppendOnlyStorage) Vacuum(tracker *readview.Tracker, horizon int) (active, removed int) {
+	kept := s.records[:0]
+	for i := range s.records {
+		r := &s.records[i]
+		if s.dead(r, tracker, horizon) {
+			removed++
+			continue
 		}
 
-		if _, ok := txInfo.ActiveTxIDs[r.EndTxID]; ok {
+		if !isLive(r, s.CLog) {
 			active++
-			return false
 		}
+		kept = append(kept, *r)
+	}
+	clear(s.records[len(kept):])
+	s.records = kept
 
-		log.Printf("remove %+v", r)
-		removed++
-		return true
-	})
+	s.CLog.Truncate(horizon)
 
 	return active, removed
 }
+
+func (s *AppendOnlyStorage) dead(r *Record, tracker *readview.Tracker, horizon int) bool {
+	if status(&r.BeginHint, r.BeginTxID, s.CLog) == clog.Aborted {
+		// アボートしたバージョンは誰からも見えないので即削除
+		s.logger.Debug("remove aborted", "record", *r)
+		return true
+	}
+
+	if isLive(r, s.CLog) {
+		return false
+	}
+
+	if tracker.IsActive(r.EndTxID) || commitNo(&r.EndHint, r.EndTxID, s.CLog) > horizon {
+		return false
+	}
+
+	s.logger.Debug("remove", "record", *r)
+	return true
+}
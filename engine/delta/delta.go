@@ -1,60 +1,149 @@
 package delta
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"mvcc-go/engine"
 	"mvcc-go/engine/delta/storage"
+	"mvcc-go/engine/readview"
 	"mvcc-go/lock"
 	"slices"
+	"sort"
+	"sync"
+	"time"
 )
 
 type Tx struct {
-	ID         int
-	level      engine.IsolationLevel
-	engine     *DeltaEngine
-	lockedKeys map[string]struct{}
-	txInfo     storage.TxInfo
+	ID          int
+	level       engine.IsolationLevel
+	engine      *DeltaEngine
+	lockedKeys  map[string]struct{}
+	view        readview.ReadView
+	readOnly    bool
+	done        bool // CommitかAbortが済んだ
+	lockTimeout time.Duration
 }
 
-func newTx(e *DeltaEngine, level engine.IsolationLevel) *Tx {
+func newTx(e *DeltaEngine, level engine.IsolationLevel, options engine.TxOptions) *Tx {
 	return &Tx{
-		ID:         e.lastTxID,
-		level:      level,
-		engine:     e,
-		lockedKeys: make(map[string]struct{}),
-		txInfo:     e.txInfo.Clone(),
+		ID:          e.lastTxID,
+		level:       level,
+		engine:      e,
+		lockedKeys:  make(map[string]struct{}),
+		view:        e.readView(e.lastTxID),
+		lockTimeout: options.LockTimeout,
 	}
 }
 
 func (tx *Tx) Get(key string) (string, error) {
-	log.Printf("Get %+v\n", tx)
-	if tx.level == engine.ReadCommitted {
-		tx.txInfo = tx.engine.txInfo.Clone()
+	tx.engine.options.Logger.Debug("Get", "txID", tx.ID, "key", key)
+	var value string
+	err := tx.Statement(func(s engine.Stmt) error {
+		var err error
+		value, err = s.Get(key)
+		return err
+	})
+
+	return value, err
+}
+
+// 見つからなかったキーは結果に含めない
+func (tx *Tx) MultiGet(keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	err := tx.Statement(func(s engine.Stmt) error {
+		for _, key := range keys {
+			value, err := s.Get(key)
+			if errors.Is(err, engine.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			values[key] = value
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	value, ok := tx.engine.storage.Get(key, tx.ID, tx.txInfo)
-	if !ok {
-		return "", engine.ErrNotFound
+	return values, nil
+}
+
+// ReadCommittedでも文の中では同じスナップショットを使う
+func (tx *Tx) Statement(f func(s engine.Stmt) error) error {
+	if tx.level == engine.ReadCommitted {
+		tx.engine.mu.Lock()
+		tx.view = tx.engine.readView(tx.ID)
+		tx.engine.mu.Unlock()
 	}
 
-	return value, nil
+	return f(&stmt{tx: tx, view: tx.view})
 }
 
 func (tx *Tx) Set(key, value string) error {
-	err := tx.engine.lockManager.XLock(tx.ID, key)
+	if tx.readOnly {
+		return engine.ErrReadOnly
+	}
+
+	_, locked := tx.lockedKeys[key]
+
+	err := tx.engine.lockManager.XLockTimeout(tx.ID, key, tx.lockTimeout)
 	if err != nil {
 		return fmt.Errorf("xlock: %w", err)
 	}
 
-	tx.lockedKeys[key] = struct{}{}
+	tx.engine.mu.Lock()
+	if tx.level == engine.RepeatableRead && tx.engine.storage.UpdatedSince(key, tx.view) {
+		tx.engine.mu.Unlock()
 
+		// スナップショットより後にコミットされた更新を上書きしない（first-updater-wins）。
+		// 書かなかったキーのロックはすぐに返す
+		if !locked {
+			err := tx.engine.lockManager.Unlock(tx.ID, key)
+			if err != nil {
+				return fmt.Errorf("unlock: %w", err)
+			}
+		}
+
+		return engine.ErrSerialization
+	}
+
+	tx.lockedKeys[key] = struct{}{}
 	tx.engine.storage.Set(key, value, tx.ID)
+	tx.engine.options.Observer.OnVersionCreated(tx.ID, key)
+	tx.engine.mu.Unlock()
 
 	return nil
 }
 
 func (tx *Tx) Commit() error {
+	return tx.end(tx.engine.commit)
+}
+
+// undo logを使って書き込みを元に戻す
+func (tx *Tx) Abort() error {
+	return tx.end(tx.engine.abort)
+}
+
+// 結果を確定してからロックを解放する。待っていたトランザクションには確定した結果が見える
+func (tx *Tx) end(finish func(tx *Tx)) error {
+	tx.engine.mu.Lock()
+	if tx.done {
+		tx.engine.mu.Unlock()
+		return engine.ErrTxDone
+	}
+	tx.done = true
+	if tx.readOnly {
+		tx.engine.release(tx)
+	} else {
+		finish(tx)
+	}
+	tx.engine.mu.Unlock()
+
 	for key := range tx.lockedKeys {
 		err := tx.engine.lockManager.Unlock(tx.ID, key)
 		if err != nil {
@@ -62,81 +151,269 @@ func (tx *Tx) Commit() error {
 		}
 	}
 
-	tx.engine.commit(tx)
-
 	return nil
 }
 
-var _ engine.Engine = &DeltaEngine{}
+type stmt struct {
+	tx   *Tx
+	view readview.ReadView
+}
+
+func (s *stmt) Get(key string) (string, error) {
+	s.tx.engine.mu.Lock()
+	defer s.tx.engine.mu.Unlock()
+
+	value, ok := s.tx.engine.storage.Get(key, s.view)
+	if !ok {
+		return "", engine.ErrNotFound
+	}
 
+	return value, nil
+}
+
+func (s *stmt) Set(key, value string) error {
+	return s.tx.Set(key, value)
+}
+
+var _ engine.TimeTravelEngine = &DeltaEngine{}
+var _ engine.HistoryEngine = &DeltaEngine{}
+var _ engine.ExplainEngine = &DeltaEngine{}
+var _ engine.StatsEngine = &DeltaEngine{}
+var _ engine.LockEngine = &DeltaEngine{}
+var _ engine.DotEngine = &DeltaEngine{}
+
+// ロック待ちの間はmuを持たないので、複数のgoroutineから同時に使える
 type DeltaEngine struct {
+	mu           sync.Mutex // storage・トランザクション一覧・pinsを守る
 	storage      *storage.DeltaStorage
 	lockManager  *lock.Manager
 	lastTxID     int
 	lastCommitNo int
-	txInfo       *storage.TxInfo
+	minCommitNo  int
+	active       *readview.Tracker
 	purgeList    []int
+	options      engine.Options
+	commitTimes  []time.Time // commitNo-1 -> コミット時刻
+	pins         map[int]int // 過去のスナップショットのコミット番号 -> 参照数
+	purgeHorizon int         // これより前のコミット時点はpurge済みで読めない
 }
 
-func NewDeltaEngine() *DeltaEngine {
+func NewDeltaEngine(opts ...engine.Option) *DeltaEngine {
+	options := engine.NewOptions(opts...)
+
 	return &DeltaEngine{
-		storage:     storage.NewDeltaStorage(),
-		lockManager: lock.NewManager(),
-		txInfo: &storage.TxInfo{
-			ActiveTxIDs:   make(map[int]struct{}),
-			MinTxID:       1, // first txID
-			LastCommitNos: make(map[int]int),
-			MinCommitNo:   0,
-		},
-		purgeList: make([]int, 0),
+		storage:     storage.NewDeltaStorage(options.Logger),
+		lockManager: lock.NewManager(lock.WithTimeout(options.LockTimeout), lock.WithClock(options.Clock), lock.WithObserver(options.Observer)),
+		active:      readview.NewTracker(),
+		purgeList:   make([]int, 0),
+		options:     options,
+		commitTimes: make([]time.Time, 0),
+		pins:        make(map[int]int),
 	}
 }
 
-func (e *DeltaEngine) Begin(level engine.IsolationLevel) engine.Tx {
+func (e *DeltaEngine) Begin(level engine.IsolationLevel, opts ...engine.TxOption) engine.Tx {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	e.lastTxID++
-	e.txInfo.ActiveTxIDs[e.lastTxID] = struct{}{}
-	e.txInfo.LastCommitNos[e.lastTxID] = e.lastCommitNo
+	e.active.Begin(e.lastTxID, e.lastCommitNo)
+
+	e.options.Logger.Debug("Begin", "txID", e.lastTxID, "minCommitNo", e.minCommitNo)
+	e.options.Observer.OnBegin(e.lastTxID, level)
+	return newTx(e, level, engine.NewTxOptions(e.options, opts...))
+}
+
+func (e *DeltaEngine) BeginAt(commitNo int) (engine.Tx, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if commitNo > e.lastCommitNo {
+		return nil, fmt.Errorf("commit %d not found", commitNo)
+	}
+
+	if commitNo < e.purgeHorizon {
+		return nil, fmt.Errorf("commit %d: %w", commitNo, engine.ErrSnapshotTooOld)
+	}
+
+	e.pins[commitNo]++
+
+	return &Tx{
+		level:    engine.RepeatableRead,
+		engine:   e,
+		view:     readview.AsOf(commitNo),
+		readOnly: true,
+	}, nil
+}
 
-	log.Printf("Begin tx%d, MinCommitNo=%d", e.lastTxID, e.txInfo.MinCommitNo)
-	return newTx(e, level)
+func (e *DeltaEngine) BeginAtTime(t time.Time) (engine.Tx, error) {
+	e.mu.Lock()
+	commitNo := e.commitNoAt(t)
+	e.mu.Unlock()
+
+	return e.BeginAt(commitNo)
+}
+
+// t時点での最終コミット番号
+func (e *DeltaEngine) commitNoAt(t time.Time) int {
+	return sort.Search(len(e.commitTimes), func(i int) bool {
+		return e.commitTimes[i].After(t)
+	})
 }
 
 func (e *DeltaEngine) commit(tx *Tx) {
 	e.lastCommitNo++
+	e.commitTimes = append(e.commitTimes, e.options.Clock.Now())
+
+	e.storage.Commit(tx.ID, e.lastCommitNo)
+
+	e.active.End(tx.ID)
+	e.minCommitNo = e.lastCommitNo
+	if commitNo, ok := e.active.MinCommitNo(); ok {
+		e.minCommitNo = commitNo
+	}
+
+	e.options.Observer.OnCommit(tx.ID, tx.level)
 
-	e.storage.UndoLogs.SetCommitNo(tx.ID, e.lastCommitNo)
+	e.purge(tx)
+}
+
+func (e *DeltaEngine) abort(tx *Tx) {
+	e.storage.Rollback(tx.ID)
+
+	e.active.End(tx.ID)
+	e.minCommitNo = e.lastCommitNo
+	if commitNo, ok := e.active.MinCommitNo(); ok {
+		e.minCommitNo = commitNo
+	}
 
-	e.txInfo.Delete(tx.ID, e.lastCommitNo)
+	e.options.Observer.OnAbort(tx.ID, tx.level)
 
+	// 最古のトランザクションが終わったので、待っていたundo logを消せるかもしれない
 	e.purge(tx)
 }
 
 func (e *DeltaEngine) purge(tx *Tx) {
-	log.Printf("purge MinCommitNo=%d", tx.engine.txInfo.MinCommitNo)
+	e.options.Logger.Debug("purge", "minCommitNo", e.minCommitNo)
 
 	if tx.engine.storage.UndoLogs.HasLogs(tx.ID) {
 		e.purgeList = append(e.purgeList, tx.ID)
 	}
 
-	log.Printf("purgeQueue=%+v", e.purgeList)
+	horizon := e.horizon()
+	e.purgeHorizon = max(e.purgeHorizon, horizon)
+
+	e.options.Logger.Debug("purge", "purgeQueue", e.purgeList, "horizon", horizon)
 	for i := 0; i < len(e.purgeList); {
 		txID := e.purgeList[i]
-		log.Printf("purging txID=%d", txID)
 
-		if tx.engine.storage.UndoLogs.GetCommitNo(txID) > tx.engine.txInfo.MinCommitNo {
-			log.Printf("tx%d has no undoLogs to purge", txID)
+		if tx.engine.storage.UndoLogs.GetCommitNo(txID) > horizon {
+			e.options.Logger.Debug("undoLogs still needed", "txID", txID)
 			i++
 			continue
 		}
 
-		log.Printf("tx%d has undoLogs to purge", txID)
+		e.options.Logger.Debug("purge undoLogs", "txID", txID)
 		e.storage.UndoLogs.Delete(txID)
+		e.options.Observer.OnPurge(txID)
 
 		// remove from purgeQueue
 		e.purgeList = slices.Delete(e.purgeList, i, i+1)
 	}
 }
 
+func (e *DeltaEngine) History(key string) []engine.Version {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.storage.History(key, e.readView(0))
+}
+
+func (e *DeltaEngine) Explain(tx engine.Tx, key string) (engine.Explanation, error) {
+	t, ok := tx.(*Tx)
+	if !ok || t.engine != e {
+		return engine.Explanation{}, engine.ErrForeignTx
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	view := e.snapshot(t)
+
+	return engine.NewExplanation(key, view, e.storage.Explain(key, view)), nil
+}
+
+// ReadCommittedなら次の文で使われるスナップショット。must be called with e.mu locked.
+func (e *DeltaEngine) snapshot(t *Tx) readview.ReadView {
+	if t.level == engine.ReadCommitted {
+		return e.readView(t.ID)
+	}
+
+	return t.view
+}
+
+// txsのスナップショットから見えるバージョンに印をつける
+func (e *DeltaEngine) WriteDot(w io.Writer, txs ...engine.Tx) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	views := make([]readview.ReadView, len(txs))
+	for i, tx := range txs {
+		t, ok := tx.(*Tx)
+		if !ok || t.engine != e {
+			return engine.ErrForeignTx
+		}
+		views[i] = e.snapshot(t)
+	}
+
+	return e.storage.WriteDot(w, views)
+}
+
+func (e *DeltaEngine) Stats() engine.Stats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return engine.Stats{
+		ChainLengths:   e.storage.ChainLengths(),
+		UndoLogRecords: e.storage.UndoLogs.Len(),
+	}
+}
+
+func (e *DeltaEngine) release(tx *Tx) {
+	commitNo := tx.view.CommitNo
+
+	e.pins[commitNo]--
+	if e.pins[commitNo] == 0 {
+		delete(e.pins, commitNo)
+	}
+}
+
+// 実行中・過去のスナップショットと保持期間のために残す必要がある最古のコミット番号
+func (e *DeltaEngine) horizon() int {
+	horizon := e.minCommitNo
+
+	for commitNo := range e.pins {
+		horizon = min(horizon, commitNo)
+	}
+
+	if e.options.Retention > 0 {
+		horizon = min(horizon, e.commitNoAt(e.options.Clock.Now().Add(-e.options.Retention)))
+	}
+
+	return horizon
+}
+
+func (e *DeltaEngine) Locks() []lock.KeyLocks {
+	return e.lockManager.Snapshot()
+}
+
 func (e *DeltaEngine) GC() (active, removed int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	return e.storage.UndoLogs.Len(), 0
 }
+
+func (e *DeltaEngine) readView(txID int) readview.ReadView {
+	return e.active.ReadView(txID, e.lastCommitNo)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"mvcc-go/engine/delta/undo"
+	"mvcc-go/engine/dot"
+	"mvcc-go/engine/readview"
+	"strings"
+)
+
+// コミット番号と、undo logがpurge済みならその旨
+func (s *DeltaStorage) describe(txID, commitNo int) string {
+	purged := !s.UndoLogs.HasLogs(txID)
+	switch {
+	case commitNo == 0 && purged:
+		return fmt.Sprintf("tx%d purged", txID)
+	case commitNo == 0:
+		return fmt.Sprintf("tx%d active", txID)
+	case purged:
+		return fmt.Sprintf("tx%d #%d purged", txID, commitNo)
+	}
+
+	return fmt.Sprintf("tx%d #%d", txID, commitNo)
+}
+
+func undoID(txID, index int) string {
+	return fmt.Sprintf("u%d_%d", txID, index)
+}
+
+// テーブルのレコードとトランザクションごとのundo logを書き、Prevを辺で結ぶ。
+// viewsのスナップショットからは、undo logを辿って最初に見えるバージョンへ点線を引く
+func (s *DeltaStorage) WriteDot(w io.Writer, views []readview.ReadView) error {
+	var b strings.Builder
+	b.WriteString("digraph delta {\n  rankdir=LR;\n  node [shape=record, fontname=monospace];\n")
+
+	b.WriteString("  subgraph cluster_table {\n    label=\"table\";\n")
+	for i, r := range s.records {
+		fmt.Fprintf(&b, "    t%d [label=%s];\n", i, dot.Record(r.Key, fmt.Sprintf("%q", r.Value), s.describe(r.TxID, r.CommitNo)))
+	}
+	b.WriteString("  }\n")
+
+	for _, txID := range s.UndoLogs.TxIDs() {
+		label := fmt.Sprintf("undo log of %s", s.describe(txID, s.UndoLogs.GetCommitNo(txID)))
+		fmt.Fprintf(&b, "  subgraph cluster_undo_%d {\n    label=%s;\n", txID, dot.Quote(label))
+		for i, r := range s.UndoLogs.Records(txID) {
+			id := undoID(txID, i)
+			if r == nil {
+				fmt.Fprintf(&b, "    %s [label=\"insert\", shape=plaintext];\n", id)
+				continue
+			}
+			fmt.Fprintf(&b, "    %s [label=%s];\n", id, dot.Record(r.Key, fmt.Sprintf("%q", r.Value), s.describe(r.TxID, r.CommitNo)))
+		}
+		b.WriteString("  }\n")
+	}
+
+	// Prevの辺。purge済みのundo logを指していれば行き止まりのノードを置く
+	purged := make(map[int]bool)
+	prev := func(from string, r *undo.Record) {
+		if r.Prev == nil {
+			return
+		}
+		if !s.UndoLogs.HasLogs(r.Prev.TxID()) {
+			if !purged[r.Prev.TxID()] {
+				purged[r.Prev.TxID()] = true
+				fmt.Fprintf(&b, "  purged%d [label=%s, shape=plaintext, fontcolor=gray];\n", r.Prev.TxID(), dot.Quote(fmt.Sprintf("purged undo log of tx%d", r.Prev.TxID())))
+			}
+			fmt.Fprintf(&b, "  %s -> purged%d [style=dotted, color=gray];\n", from, r.Prev.TxID())
+			return
+		}
+		fmt.Fprintf(&b, "  %s -> %s [label=\"prev\"];\n", from, undoID(r.Prev.TxID(), r.Prev.Index()))
+	}
+	for i, r := range s.records {
+		prev(fmt.Sprintf("t%d", i), r)
+	}
+	for _, txID := range s.UndoLogs.TxIDs() {
+		for i, r := range s.UndoLogs.Records(txID) {
+			if r != nil {
+				prev(undoID(txID, i), r)
+			}
+		}
+	}
+
+	for _, view := range views {
+		b.WriteString(dot.Snapshot(view))
+		for i, r := range s.records {
+			id := fmt.Sprintf("t%d", i)
+			for record := r; record != nil; {
+				if isVisiable(record.TxID, view, s.UndoLogs) {
+					fmt.Fprintf(&b, "  %s -> %s [style=dashed, color=darkgoldenrod];\n", dot.SnapshotID(view), id)
+					break
+				}
+				id = undoID(record.Prev.TxID(), record.Prev.Index())
+				record = s.UndoLogs.Get(*record.Prev)
+			}
+		}
+	}
+
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
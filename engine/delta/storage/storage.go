@@ -1,73 +1,65 @@
 package storage
 
 import (
-	"log"
-	"maps"
+	"log/slog"
+	"mvcc-go/engine"
 	"mvcc-go/engine/delta/undo"
+	"mvcc-go/engine/readview"
 	"slices"
 )
 
-type TxInfo struct {
-	ActiveTxIDs map[int]struct{}
-	MinTxID     int
-
-	LastCommitNos map[int]int
-	MinCommitNo   int
-}
-
-func (info *TxInfo) Clone() TxInfo {
-	return TxInfo{
-		ActiveTxIDs:   maps.Clone(info.ActiveTxIDs),
-		MinTxID:       info.MinTxID,
-		LastCommitNos: maps.Clone(info.LastCommitNos),
-		MinCommitNo:   info.MinCommitNo,
-	}
-}
+func visibility(recordTxID int, view readview.ReadView, undoLogs *undo.UndoLogs) engine.Reason {
+	if view.Historical {
+		if !undoLogs.HasLogs(recordTxID) {
+			// purge済みならスナップショットより前にコミットされている
+			return engine.ReasonCommitted
+		}
 
-func (info *TxInfo) Delete(txID, lastCommitNo int) {
-	delete(info.ActiveTxIDs, txID)
-	delete(info.LastCommitNos, txID)
+		// 指定したコミット時点までにコミットされたものだけ見る
+		commitNo := undoLogs.GetCommitNo(recordTxID)
+		if commitNo == 0 {
+			return engine.ReasonActive
+		}
+		if commitNo > view.CommitNo {
+			return engine.ReasonFuture
+		}
 
-	if len(info.ActiveTxIDs) == 0 {
-		info.MinTxID = 0
-		info.MinCommitNo = lastCommitNo
-		return
+		return engine.ReasonCommitted
 	}
 
-	info.MinTxID = slices.Min(slices.Collect(maps.Keys(info.ActiveTxIDs)))
-	info.MinCommitNo = slices.Min(slices.Collect(maps.Values(info.LastCommitNos)))
-}
-
-func isVisiable(recordTxID, myTxID int, txInfo TxInfo) bool {
-	if recordTxID == myTxID {
+	if recordTxID == view.CreatorTxID {
 		// 自分自身が書いたものは見える
-		return true
+		return engine.ReasonOwnWrite
 	}
 
-	if recordTxID > myTxID {
-		// 自分より後のトランザクションが書いたものは見ない
-		log.Printf("not visible because not committed")
-		return false
+	if recordTxID >= view.HighTxID {
+		// ビュー作成より後に開始したトランザクションが書いたものは見ない
+		return engine.ReasonFuture
 	}
 
-	if _, ok := txInfo.ActiveTxIDs[recordTxID]; ok {
+	if view.IsActive(recordTxID) {
 		// アクティブなトランザクションが書いたものは見ない
-		log.Printf("not visible because active")
-		return false
+		return engine.ReasonActive
 	}
 
-	return true
+	return engine.ReasonCommitted
+}
+
+func isVisiable(recordTxID int, view readview.ReadView, undoLogs *undo.UndoLogs) bool {
+	return visibility(recordTxID, view, undoLogs).Visible()
 }
 
 type DeltaStorage struct {
 	records  []*undo.Record
 	UndoLogs *undo.UndoLogs
+	logger   *slog.Logger
 }
 
-func NewDeltaStorage() *DeltaStorage {
+func NewDeltaStorage(logger *slog.Logger) *DeltaStorage {
 	return &DeltaStorage{
 		records:  make([]*undo.Record, 0),
 		UndoLogs: undo.NewUndoLogs(),
+		logger:   logger,
 	}
 }
 
@@ -85,19 +77,19 @@ func (s *DeltaStorage) Set(key, value string, txID int) {
 
 		if r.TxID == txID {
 			// 自分が書いたレコードは直接更新して終了
-			log.Printf("update latest myself")
+			s.logger.Debug("update latest myself", "key", key, "txID", txID)
 			r.Value = value
 			return
 		}
 
 		// 更新
 		prevPtr := s.UndoLogs.Append(txID, s.records[i]) // 直前の値をundo logに追加
-		log.Printf("update latest, new new undoPtr %d with %+v", prevPtr, *s.records[i])
+		s.logger.Debug("update latest, new undoPtr", "undoPtr", prevPtr, "prev", *s.records[i])
 
 		record.Prev = &prevPtr // undo logへのポインタを設定
 		s.records[i] = &record // テーブルの値を更新
 
-		log.Printf("update %v", record)
+		s.logger.Debug("update", "record", record)
 		return
 	}
 
@@ -106,10 +98,10 @@ func (s *DeltaStorage) Set(key, value string, txID int) {
 	record.Prev = &ptr
 	s.records = append(s.records, &record)
 
-	log.Printf("insert %v", record)
+	s.logger.Debug("insert", "record", record)
 }
 
-func (s *DeltaStorage) Get(key string, txID int, txInfo TxInfo) (string, bool) {
+func (s *DeltaStorage) Get(key string, view readview.ReadView) (string, bool) {
 	var record *undo.Record
 	for _, r := range s.records {
 		if r.Key == key {
@@ -122,15 +114,131 @@ func (s *DeltaStorage) Get(key string, txID int, txInfo TxInfo) (string, bool) {
 	// 見えてよいバージョンまでundo logを辿る
 	for {
 		if record == nil {
-			log.Println("not found")
+			s.logger.Debug("not found", "key", key)
 			return "", false
 		}
 
-		if isVisiable(record.TxID, txID, txInfo) {
+		if isVisiable(record.TxID, view, s.UndoLogs) {
 			return record.Value, true
 		}
 
+		s.logger.Debug("next", "prevPtr", *record.Prev)
+		record = s.UndoLogs.Get(*record.Prev)
+	}
+}
+
+// txIDが書いたレコードにコミット番号を書く。書いたキーにはXロックがあるので、どれもまだテーブルにある
+func (s *DeltaStorage) Commit(txID, commitNo int) {
+	for _, r := range s.records {
+		if r.TxID == txID {
+			r.CommitNo = commitNo
+		}
+	}
+
+	s.UndoLogs.SetCommitNo(txID, commitNo)
+}
+
+// txIDが書いたレコードをundo logにある直前の版に戻し、undo logを捨てる。
+// 書いたキーにはXロックがあるので、戻すレコードを他のトランザクションが上書きしていることはない
+func (s *DeltaStorage) Rollback(txID int) {
+	s.records = slices.DeleteFunc(s.records, func(r *undo.Record) bool {
+		return r.TxID == txID && s.UndoLogs.Get(*r.Prev) == nil // 新規追加
+	})
+
+	for i, r := range s.records {
+		if r.TxID == txID {
+			s.logger.Debug("rollback", "record", *r)
+			s.records[i] = s.UndoLogs.Get(*r.Prev)
+		}
+	}
+
+	s.UndoLogs.Delete(txID)
+}
+
+// 最新版がviewから見えなければ、スナップショットの後に他のトランザクションが更新している
+func (s *DeltaStorage) UpdatedSince(key string, view readview.ReadView) bool {
+	for _, r := range s.records {
+		if r.Key == key {
+			return !isVisiable(r.TxID, view, s.UndoLogs)
+		}
+	}
+
+	return false
+}
+
+func (s *DeltaStorage) ChainLengths() map[string]int {
+	lengths := make(map[string]int, len(s.records))
+	for _, r := range s.records {
+		for record := r; record != nil; record = s.UndoLogs.Get(*record.Prev) {
+			lengths[r.Key]++
+		}
+	}
+
+	return lengths
+}
+
+func (s *DeltaStorage) History(key string, view readview.ReadView) []engine.Version {
+	var record *undo.Record
+	for _, r := range s.records {
+		if r.Key == key {
+			record = r
+
+			break // keyは一意なので見つかったら終了
+		}
+	}
+
+	// 新しい順にundo logを辿ってから古い順に並べ替える
+	versions := make([]engine.Version, 0)
+	endTxID := 0
+	found := false
+	for record != nil {
+		visible := !found && isVisiable(record.TxID, view, s.UndoLogs)
+		found = found || visible
+
+		versions = append(versions, engine.Version{
+			Value:     record.Value,
+			BeginTxID: record.TxID,
+			EndTxID:   endTxID,
+			CommitNo:  record.CommitNo,
+			Visible:   visible,
+		})
+
+		endTxID = record.TxID
 		record = s.UndoLogs.Get(*record.Prev)
-		log.Printf("next prevPtr=%+v, prevRecord=%v", record.Prev, record)
 	}
+
+	slices.Reverse(versions)
+
+	return versions
+}
+
+// Getと同じ順にundo logを辿り、見えるバージョンで止まる
+func (s *DeltaStorage) Explain(key string, view readview.ReadView) []engine.Step {
+	var record *undo.Record
+	for _, r := range s.records {
+		if r.Key == key {
+			record = r
+
+			break // keyは一意なので見つかったら終了
+		}
+	}
+
+	steps := make([]engine.Step, 0)
+	for record != nil {
+		reason := visibility(record.TxID, view, s.UndoLogs)
+		steps = append(steps, engine.Step{
+			Value:   record.Value,
+			TxID:    record.TxID,
+			Visible: reason.Visible(),
+			Reason:  reason,
+		})
+
+		if reason.Visible() {
+			break
+		}
+
+		record = s.UndoLogs.Get(*record.Prev)
+	}
+
+	return steps
 }
@@ -1,12 +1,18 @@
 package undo
 
-import "log"
+import (
+	"maps"
+	"slices"
+)
 
 type Record struct {
 	Key   string
 	Value string
 	TxID  int
 	Prev  *UndoLogPtr
+
+	// コミットしたときに書く。undo logをpurgeした後もHistoryやDOTで使う
+	CommitNo int
 }
 
 type UndoLogPtr struct {
@@ -14,6 +20,14 @@ type UndoLogPtr struct {
 	logIndex int
 }
 
+func (p UndoLogPtr) TxID() int {
+	return p.txID
+}
+
+func (p UndoLogPtr) Index() int {
+	return p.logIndex
+}
+
 type undoLog struct {
 	commitNo int
 	records  []*Record
@@ -30,11 +44,6 @@ func NewUndoLogs() *UndoLogs {
 }
 
 func (u *UndoLogs) Get(ptr UndoLogPtr) *Record {
-	// debug
-	for txID, undoLog := range u.logs {
-		log.Printf("tx%d: %+v", txID, undoLog)
-	}
-
 	log, ok := u.logs[ptr.txID]
 	if !ok {
 		return nil
@@ -59,6 +68,21 @@ func (u *UndoLogs) Append(txID int, record *Record) UndoLogPtr {
 	}
 }
 
+// undo logを持つトランザクションをtxID順に返す
+func (u *UndoLogs) TxIDs() []int {
+	return slices.Sorted(maps.Keys(u.logs))
+}
+
+// 書いた順。新規追加のレコードはnil
+func (u *UndoLogs) Records(txID int) []*Record {
+	log, ok := u.logs[txID]
+	if !ok {
+		return nil
+	}
+
+	return log.records
+}
+
 func (u *UndoLogs) HasLogs(txID int) bool {
 	_, ok := u.logs[txID]
 	return ok
@@ -0,0 +1,58 @@
+// エンジン内部のバージョンをGraphviz (https://graphviz.org) のDOTで書くための補助
+package dot
+
+import (
+	"fmt"
+	"mvcc-go/engine/readview"
+	"strings"
+)
+
+// DOTの文字列。recordノードのラベルで特別な意味を持つ文字もエスケープする
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\', '{', '}', '|', '<', '>':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// recordノードの欄。"|"で区切る前の各欄はエスケープする
+func Record(fields ...string) string {
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		q := Quote(f)
+		quoted[i] = q[1 : len(q)-1]
+	}
+
+	return `"{` + strings.Join(quoted, "|") + `}"`
+}
+
+// スナップショットのノードID
+func SnapshotID(v readview.ReadView) string {
+	if v.Historical {
+		return fmt.Sprintf("snapshot_at_%d", v.CommitNo)
+	}
+
+	return fmt.Sprintf("snapshot_tx%d", v.CreatorTxID)
+}
+
+// スナップショットのノード。見えるバージョンへの辺は呼び出し側で書く
+func Snapshot(v readview.ReadView) string {
+	label := fmt.Sprintf("tx%d\nactive=%v\ncommit #%d", v.CreatorTxID, v.Active(), v.CommitNo)
+	if v.Historical {
+		label = fmt.Sprintf("as of commit #%d", v.CommitNo)
+	}
+
+	return fmt.Sprintf("  %s [shape=ellipse, style=filled, fillcolor=lightyellow, label=%s];\n", SnapshotID(v), Quote(label))
+}
@@ -0,0 +1,38 @@
+package dot_test
+
+import (
+	"mvcc-go/engine/dot"
+	"mvcc-go/engine/readview"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"value", `"value"`},
+		{`a"b\c`, `"a\"b\\c"`},
+		{"{a|b}<c>", `"\{a\|b\}\<c\>"`},
+		{"a\nb", `"a\nb"`},
+	}
+
+	for _, c := range cases {
+		if got := dot.Quote(c.in); got != c.want {
+			t.Errorf("Quote(%q): expected %s, but got %s", c.in, c.want, got)
+		}
+	}
+
+	if got, want := dot.Record(`"v"`, "tx1 #1"), `"{\"v\"|tx1 #1}"`; got != want {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestSnapshotID(t *testing.T) {
+	if got := dot.SnapshotID(readview.ReadView{CreatorTxID: 3}); got != "snapshot_tx3" {
+		t.Errorf("expected snapshot_tx3, but got %s", got)
+	}
+	if got := dot.SnapshotID(readview.AsOf(2)); got != "snapshot_at_2" {
+		t.Errorf("expected snapshot_at_2, but got %s", got)
+	}
+}
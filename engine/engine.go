@@ -1,14 +1,32 @@
 package engine
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"mvcc-go/lock"
+	"time"
+)
 
 var ErrNotFound = fmt.Errorf("not found")
+var ErrReadOnly = fmt.Errorf("read only transaction")
+var ErrSnapshotTooOld = fmt.Errorf("snapshot too old")
+var ErrForeignTx = fmt.Errorf("transaction of another engine")
+var ErrSerialization = fmt.Errorf("could not serialize access due to concurrent update")
+var ErrTxDone = fmt.Errorf("transaction has already been committed or aborted")
 
 type Tx interface {
 	Get(key string) (string, error)
 	Set(key, value string) error
 	Commit() error
+	Abort() error // 書き込みをなかったことにしてロックを解放する
+}
+
+// 1つのスナップショットで読む文のスコープ
+type Stmt interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
 }
+
 type IsolationLevel string
 
 const (
@@ -17,6 +35,49 @@ const (
 )
 
 type Engine interface {
-	Begin(level IsolationLevel) Tx
+	Begin(level IsolationLevel, opts ...TxOption) Tx
 	GC() (active, removed int)
 }
+
+// 過去のコミット時点のスナップショットを読み取り専用で開く
+type TimeTravelEngine interface {
+	Engine
+	BeginAt(commitNo int) (Tx, error)
+	BeginAtTime(t time.Time) (Tx, error)
+}
+
+type Version struct {
+	Value     string
+	BeginTxID int
+	EndTxID   int  // 0なら最新
+	CommitNo  int  // 未コミット・アボート・不明なら0
+	Visible   bool // 今開始したトランザクションから見えるバージョンか
+}
+
+// キーごとに保持しているバージョンを古い順に返す
+type HistoryEngine interface {
+	Engine
+	History(key string) []Version
+}
+
+type Stats struct {
+	ChainLengths   map[string]int // キーごとに保持しているバージョン数
+	UndoLogRecords int
+}
+
+type StatsEngine interface {
+	Engine
+	Stats() Stats
+}
+
+// ロックの保持と待ちを見せる。pg_locks相当
+type LockEngine interface {
+	Engine
+	Locks() []lock.KeyLocks
+}
+
+// 内部のバージョンの並びをGraphvizのDOTで書く。txsのスナップショットから見えるバージョンに印をつける
+type DotEngine interface {
+	Engine
+	WriteDot(w io.Writer, txs ...Tx) error
+}
@@ -1,11 +1,19 @@
 package engine_test
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"mvcc-go/clock"
 	"mvcc-go/engine"
 	"mvcc-go/engine/appendonly"
 	"mvcc-go/engine/delta"
 	"mvcc-go/engine/locking"
 	"mvcc-go/engine/naive"
+	"mvcc-go/lock"
+	"mvcc-go/schedule"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -13,62 +21,62 @@ import (
 
 func TestEngine(t *testing.T) {
 	cases := []struct {
-		name   string
-		engine engine.Engine
-		level  engine.IsolationLevel
-		want1  string
-		want2  string
-		wantGC int
+		name      string
+		newEngine func(opts ...engine.Option) engine.Engine
+		level     engine.IsolationLevel
+		want1     string
+		want2     string
+		wantGC    int
 	}{
 		{
-			name:   "Naive",
-			engine: naive.NewNaiveEngine(),
-			level:  engine.ReadCommitted, // ignored
-			want1:  "value1",             // dirty read
-			want2:  "value2",             // dirty read
-			wantGC: 0,
+			name:      "Naive",
+			newEngine: func(opts ...engine.Option) engine.Engine { return naive.NewNaiveEngine(opts...) },
+			level:     engine.ReadCommitted, // ignored
+			want1:     "value1",             // dirty read
+			want2:     "value2",             // dirty read
+			wantGC:    0,
 		},
 		{
-			name:   "Locking",
-			engine: locking.NewLockingEngine(),
-			level:  engine.ReadCommitted, // ignored
-			want1:  "value2",             // read committed
-			want2:  "value2",             // read committed
-			wantGC: 0,
+			name:      "Locking",
+			newEngine: func(opts ...engine.Option) engine.Engine { return locking.NewLockingEngine(opts...) },
+			level:     engine.ReadCommitted, // ignored
+			want1:     "value2",             // read committed
+			want2:     "value2",             // read committed
+			wantGC:    0,
 		},
 
 		{
-			name:   "AppendOnly_RepeatableRead",
-			engine: appendonly.NewAppendOnlyEngine(),
-			level:  engine.RepeatableRead,
-			want1:  "value0", // repeatable read
-			want2:  "value0", // repeatable read
-			wantGC: 1,        // value0
+			name:      "AppendOnly_RepeatableRead",
+			newEngine: func(opts ...engine.Option) engine.Engine { return appendonly.NewAppendOnlyEngine(opts...) },
+			level:     engine.RepeatableRead,
+			want1:     "value0", // repeatable read
+			want2:     "value0", // repeatable read
+			wantGC:    1,        // value0
 		},
 		{
-			name:   "Delta_RepeatableRead",
-			engine: delta.NewDeltaEngine(),
-			level:  engine.RepeatableRead,
-			want1:  "value0", // repeatable read
-			want2:  "value0", // repeatable read
-			wantGC: 0,
+			name:      "Delta_RepeatableRead",
+			newEngine: func(opts ...engine.Option) engine.Engine { return delta.NewDeltaEngine(opts...) },
+			level:     engine.RepeatableRead,
+			want1:     "value0", // repeatable read
+			want2:     "value0", // repeatable read
+			wantGC:    0,
 		},
 
 		{
-			name:   "AppendOnly_ReadCommitted",
-			engine: appendonly.NewAppendOnlyEngine(),
-			level:  engine.ReadCommitted,
-			want1:  "value0", // read committed without lock
-			want2:  "value2", // read committed without lock
-			wantGC: 1,        // valueX, value0, value1
+			name:      "AppendOnly_ReadCommitted",
+			newEngine: func(opts ...engine.Option) engine.Engine { return appendonly.NewAppendOnlyEngine(opts...) },
+			level:     engine.ReadCommitted,
+			want1:     "value0", // read committed without lock
+			want2:     "value2", // read committed without lock
+			wantGC:    1,        // valueX, value0, value1
 		},
 		{
-			name:   "Delta_ReadCommitted",
-			engine: delta.NewDeltaEngine(),
-			level:  engine.ReadCommitted,
-			want1:  "value0", // read committed without lock
-			want2:  "value2", // read committed without lock
-			wantGC: 0,
+			name:      "Delta_ReadCommitted",
+			newEngine: func(opts ...engine.Option) engine.Engine { return delta.NewDeltaEngine(opts...) },
+			level:     engine.ReadCommitted,
+			want1:     "value0", // read committed without lock
+			want2:     "value2", // read committed without lock
+			wantGC:    0,
 		},
 	}
 
@@ -84,119 +92,1183 @@ func TestEngine(t *testing.T) {
 		// tx3: get key
 
 		t.Run(c.name, func(t *testing.T) {
-			tx1 := c.engine.Begin(c.level)
-			t.Log(`tx1.Set("key", "valueX")`)
-			err := tx1.Set("key", "valueX")
-			if err != nil {
-				t.Error(err)
-				return
+			scenario := schedule.Scenario{
+				NewEngine: c.newEngine,
+				Setup: func(e engine.Engine) error {
+					for _, value := range []string{"valueX", "value0"} {
+						tx := e.Begin(c.level)
+						err := tx.Set("key", value)
+						if err != nil {
+							return err
+						}
+						err = tx.Commit()
+						if err != nil {
+							return err
+						}
+					}
+
+					active, _ := e.GC()
+					if active != 0 {
+						return fmt.Errorf("expected 0 active, but got %d", active)
+					}
+
+					return nil
+				},
+				Scripts: []schedule.Script{
+					{Level: c.level, Ops: []schedule.Op{schedule.Set("key", "value1"), schedule.Set("key", "value2"), schedule.Commit()}},
+					{Level: c.level, Ops: []schedule.Op{schedule.Get("key"), schedule.Get("key"), schedule.Commit()}},
+				},
 			}
-			t.Log("tx1.Commit()")
-			err = tx1.Commit()
+
+			// tx0: begin, set key=value1
+			// tx1: begin, get key
+			// tx0: set key=value2, commit
+			// tx1: get key, commit
+			result, err := scenario.Run(schedule.Schedule{0, 0, 1, 1, 0, 0, 1, 1})
 			if err != nil {
 				t.Fatal(err)
 			}
+			t.Log("\n" + result.Trace())
 
-			tx2 := c.engine.Begin(c.level)
-			t.Log(`tx2.Set("key", "value0")`)
-			err = tx2.Set("key", "value0")
-			if err != nil {
-				t.Fatal(err)
-				return
+			for _, ops := range result.Ops {
+				for _, event := range ops {
+					if event.Err != nil {
+						t.Errorf("unexpected error: %v", event)
+					}
+				}
 			}
-			t.Log("tx2.Commit()")
-			err = tx2.Commit()
-			if err != nil {
-				t.Fatal(err)
+
+			if got := result.Ops[1][0].Value; got != c.want1 {
+				t.Errorf("expected %q, but got %q", c.want1, got)
+			}
+			if got := result.Ops[1][1].Value; got != c.want2 {
+				t.Errorf("expected %q, but got %q", c.want2, got)
 			}
 
-			active, _ := c.engine.GC()
+			active, removed := result.Engine.GC()
 			if active != 0 {
-				t.Fatalf("expected 0 active, but got %d", active)
+				t.Errorf("expected 0 active, but got %d", active)
+			}
+			if removed != c.wantGC {
+				t.Errorf("expected %d removed, but got %d", c.wantGC, removed)
 			}
+		})
+	}
+}
+
+func TestAppendOnlyAbort(t *testing.T) {
+	e := appendonly.NewAppendOnlyEngine()
+
+	tx1 := e.Begin(engine.RepeatableRead)
+	err := tx1.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx2 := e.Begin(engine.RepeatableRead).(*appendonly.Tx)
+	err = tx2.Set("key", "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx3 := e.Begin(engine.RepeatableRead)
+	got, err := tx3.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "value0" {
+		t.Errorf("expected %q, but got %q", "value0", got)
+	}
+
+	err = tx3.Set("key", "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx3.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx4 := e.Begin(engine.RepeatableRead)
+	got, err = tx4.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "value2" {
+		t.Errorf("expected %q, but got %q", "value2", got)
+	}
+	err = tx4.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, removed := e.GC()
+	if active != 0 {
+		t.Errorf("expected 0 active, but got %d", active)
+	}
+	if removed != 2 { // value1 (aborted), value0
+		t.Errorf("expected 2 removed, but got %d", removed)
+	}
+}
+
+// 実行中のトランザクションが開始時点で見ていた版は、上書きされてもGCで消さない
+func TestAppendOnlyGCKeepsRunningSnapshot(t *testing.T) {
+	e := appendonly.NewAppendOnlyEngine()
+
+	tx1 := e.Begin(engine.RepeatableRead)
+	err := tx1.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx2 := e.Begin(engine.RepeatableRead)
+
+	tx3 := e.Begin(engine.RepeatableRead)
+	err = tx3.Set("key", "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx3.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, removed := e.GC()
+	if active != 1 { // value0
+		t.Errorf("expected 1 active, but got %d", active)
+	}
+	if removed != 0 {
+		t.Errorf("expected 0 removed, but got %d", removed)
+	}
+
+	got, err := tx2.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "value0" {
+		t.Errorf("expected %q, but got %q", "value0", got)
+	}
+	err = tx2.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, removed = e.GC()
+	if active != 0 {
+		t.Errorf("expected 0 active, but got %d", active)
+	}
+	if removed != 1 { // value0
+		t.Errorf("expected 1 removed, but got %d", removed)
+	}
+}
+
+// undo logで書き込みを戻し、アボートしたバージョンはどこにも残らない
+func TestDeltaAbort(t *testing.T) {
+	e := delta.NewDeltaEngine()
+
+	tx1 := e.Begin(engine.RepeatableRead)
+	err := tx1.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := e.Begin(engine.RepeatableRead)
+
+	tx2 := e.Begin(engine.RepeatableRead).(*delta.Tx)
+	for _, value := range []string{"value1", "value2"} {
+		err = tx2.Set("key", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx2.Set("new", "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tx := range []engine.Tx{reader, e.Begin(engine.RepeatableRead)} {
+		got, err := tx.Get("key")
+		if err != nil || got != "value0" {
+			t.Errorf("expected value0, but got %q, %v", got, err)
+		}
+		_, err = tx.Get("new")
+		if !errors.Is(err, engine.ErrNotFound) {
+			t.Errorf("expected %v, but got %v", engine.ErrNotFound, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := e.History("key"); len(got) != 1 || got[0].Value != "value0" {
+		t.Errorf("expected only value0, but got %+v", got)
+	}
+	if got := e.Stats(); got.UndoLogRecords != 0 || len(got.ChainLengths) != 1 {
+		t.Errorf("expected no undo log records, but got %+v", got)
+	}
+}
+
+// VACUUMはヒントビットを書き込み、horizonまでに確定したトランザクションをclogから消す
+func TestAppendOnlyVacuumHintBits(t *testing.T) {
+	e := appendonly.NewAppendOnlyEngine()
 
-			wg := sync.WaitGroup{}
-			wg.Add(2)
+	for _, value := range []string{"value0", "value1"} {
+		tx := e.Begin(engine.RepeatableRead)
+		err := tx.Set("key", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := e.Begin(engine.RepeatableRead)
 
-			go func() {
-				defer wg.Done()
+	tx4 := e.Begin(engine.RepeatableRead)
+	err := tx4.Set("key", "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx4.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-				tx3 := c.engine.Begin(c.level)
+	tx5 := e.Begin(engine.RepeatableRead).(*appendonly.Tx)
+	err = tx5.Set("other", "aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx5.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// value0とアボートしたバージョンを消す。value1はoldから見えるので残す
+	active, removed := e.GC()
+	if active != 1 || removed != 2 {
+		t.Errorf("expected 1 active and 2 removed, but got %d, %d", active, removed)
+	}
+
+	var b strings.Builder
+	err = e.WriteDot(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		// tx2のコミットはhorizon以前なのでclogから消え、ヒントビットにコミット番号と一緒に残る
+		`v0 [label="{\"value1\"|xmin tx2 committed #2 (hint)|xmax tx4 committed #3 (hint)}", style=filled, fillcolor=lightgray];`,
+		`v1 [label="{\"value2\"|xmin tx4 committed #3 (hint)}"];`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("expected %s in\n%s", line, b.String())
+		}
+	}
 
-				t.Log(`tx3.Set("key", "value1")`)
-				err := tx3.Set("key", "value1")
+	if got, err := old.Get("key"); err != nil || got != "value1" {
+		t.Errorf("expected value1, but got %q, %v", got, err)
+	}
+	if got, err := e.Begin(engine.RepeatableRead).Get("key"); err != nil || got != "value2" {
+		t.Errorf("expected value2, but got %q, %v", got, err)
+	}
+}
+
+func BenchmarkReadCommittedGet(b *testing.B) {
+	cases := []struct {
+		name   string
+		engine engine.Engine
+	}{
+		{name: "AppendOnly", engine: appendonly.NewAppendOnlyEngine()},
+		{name: "Delta", engine: delta.NewDeltaEngine()},
+	}
+
+	for _, c := range cases {
+		for _, concurrency := range []int{10, 1000} {
+			b.Run(fmt.Sprintf("%s_%d", c.name, concurrency), func(b *testing.B) {
+				tx := c.engine.Begin(engine.ReadCommitted)
+				err := tx.Set("key", "value")
 				if err != nil {
-					t.Error(err)
-					return
+					b.Fatal(err)
+				}
+				err = tx.Commit()
+				if err != nil {
+					b.Fatal(err)
 				}
 
-				time.Sleep(20 * time.Millisecond)
+				txs := make([]engine.Tx, concurrency)
+				for i := range txs {
+					txs[i] = c.engine.Begin(engine.ReadCommitted)
+				}
 
-				t.Log(`tx3.Set("key", "value2")`)
-				err = tx3.Set("key", "value2")
-				if err != nil {
-					t.Error(err)
-					return
+				reader := c.engine.Begin(engine.ReadCommitted)
+
+				b.ResetTimer()
+				for range b.N {
+					_, err := reader.Get("key")
+					if err != nil {
+						b.Fatal(err)
+					}
 				}
+				b.StopTimer()
 
-				t.Log("tx3.Commit()")
-				err = tx3.Commit()
-				if err != nil {
-					t.Error(err)
-					return
+				for _, tx := range append(txs, reader) {
+					err := tx.Commit()
+					if err != nil {
+						b.Fatal(err)
+					}
 				}
-			}()
+			})
+		}
+	}
+}
 
-			time.Sleep(10 * time.Millisecond)
+// 実行中のトランザクションが多くてもコミットで一覧をコピーしない
+func BenchmarkCommit(b *testing.B) {
+	cases := []struct {
+		name   string
+		engine engine.Engine
+	}{
+		{name: "AppendOnly", engine: appendonly.NewAppendOnlyEngine()},
+		{name: "Delta", engine: delta.NewDeltaEngine()},
+	}
 
-			go func() {
-				defer wg.Done()
+	for _, c := range cases {
+		for _, concurrency := range []int{10, 1000} {
+			b.Run(fmt.Sprintf("%s_%d", c.name, concurrency), func(b *testing.B) {
+				txs := make([]engine.Tx, concurrency)
+				for i := range txs {
+					txs[i] = c.engine.Begin(engine.RepeatableRead)
+				}
 
-				tx4 := c.engine.Begin(c.level)
+				b.ResetTimer()
+				for range b.N {
+					err := c.engine.Begin(engine.RepeatableRead).Commit()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
 
-				t.Log(`tx4.Get("key") start`)
-				got, err := tx4.Get("key")
-				t.Logf(`tx4.Get("key") got %q, err %v`, got, err)
+				for _, tx := range txs {
+					err := tx.Commit()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// 終了したトランザクションを詰め直しても、作成済みのビューの判定は変わらない
+type statementTx interface {
+	engine.Tx
+	MultiGet(keys ...string) (map[string]string, error)
+	Statement(f func(s engine.Stmt) error) error
+}
+
+func TestStatementSnapshot(t *testing.T) {
+	cases := []struct {
+		name   string
+		engine engine.Engine
+	}{
+		{name: "AppendOnly", engine: appendonly.NewAppendOnlyEngine()},
+		{name: "Delta", engine: delta.NewDeltaEngine()},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			write := func(value string) {
+				tx := c.engine.Begin(engine.ReadCommitted)
+				for _, key := range []string{"a", "b"} {
+					err := tx.Set(key, value)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := tx.Commit()
 				if err != nil {
-					t.Error(err)
-					return
+					t.Fatal(err)
 				}
+			}
+
+			write("value0")
 
-				if got != c.want1 {
-					t.Errorf("expected %q, but got %q", c.want1, got)
+			reader := c.engine.Begin(engine.ReadCommitted).(statementTx)
+			err := reader.Statement(func(s engine.Stmt) error {
+				a, err := s.Get("a")
+				if err != nil {
+					return err
 				}
 
-				time.Sleep(20 * time.Millisecond)
+				write("value1") // committed in the middle of the statement
 
-				t.Log(`tx4.Get("key") start`)
-				got, err = tx4.Get("key")
-				t.Logf(`tx4.Get("key") got %q, err %v`, got, err)
+				b, err := s.Get("b")
 				if err != nil {
-					t.Error(err)
-					return
+					return err
+				}
+
+				if a != "value0" || b != "value0" {
+					t.Errorf("expected value0 for both, but got a=%q b=%q", a, b)
 				}
 
-				if got != c.want2 {
-					t.Errorf("expected %q, but got %q", c.want2, got)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := reader.MultiGet("a", "b", "missing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"a": "value1", "b": "value1"}
+			if !maps.Equal(got, want) {
+				t.Errorf("expected %v, but got %v", want, got)
+			}
+
+			err = reader.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTimeTravel(t *testing.T) {
+	cases := []struct {
+		name      string
+		newEngine func(opts ...engine.Option) engine.TimeTravelEngine
+	}{
+		{
+			name: "AppendOnly",
+			newEngine: func(opts ...engine.Option) engine.TimeTravelEngine {
+				return appendonly.NewAppendOnlyEngine(opts...)
+			},
+		},
+		{
+			name: "Delta",
+			newEngine: func(opts ...engine.Option) engine.TimeTravelEngine {
+				return delta.NewDeltaEngine(opts...)
+			},
+		},
+	}
+
+	write := func(t *testing.T, e engine.Engine, value string) {
+		tx := e.Begin(engine.RepeatableRead)
+		err := tx.Set("key", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readAt := func(t *testing.T, e engine.TimeTravelEngine, commitNo int) string {
+		tx, err := e.BeginAt(commitNo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+
+		got, err := tx.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return got
+	}
+
+	for _, c := range cases {
+		t.Run(c.name+"_Retention", func(t *testing.T) {
+			clk := clock.NewFake(time.Now())
+			e := c.newEngine(engine.WithRetention(time.Hour), engine.WithClock(clk))
+			for _, value := range []string{"value0", "value1", "value2"} {
+				write(t, e, value)
+			}
+			e.GC()
+
+			for commitNo, want := range []string{"value0", "value1", "value2"} {
+				got := readAt(t, e, commitNo+1)
+				if got != want {
+					t.Errorf("commit %d: expected %q, but got %q", commitNo+1, want, got)
+				}
+			}
+
+			tx, err := e.BeginAtTime(clk.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Set("key", "value3")
+			if !errors.Is(err, engine.ErrReadOnly) {
+				t.Errorf("expected %v, but got %v", engine.ErrReadOnly, err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clk.Advance(2 * time.Hour)
+			write(t, e, "value3")
+			e.GC()
+
+			_, err = e.BeginAt(1)
+			if !errors.Is(err, engine.ErrSnapshotTooOld) {
+				t.Errorf("expected %v, but got %v", engine.ErrSnapshotTooOld, err)
+			}
+		})
+
+		t.Run(c.name+"_Pin", func(t *testing.T) {
+			e := c.newEngine()
+			write(t, e, "value0")
+
+			tx, err := e.BeginAt(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			write(t, e, "value1")
+			e.GC()
+
+			got, err := tx.Get("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "value0" {
+				t.Errorf("expected %q, but got %q", "value0", got)
+			}
+
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			write(t, e, "value2")
+			e.GC()
+
+			_, err = e.BeginAt(1)
+			if !errors.Is(err, engine.ErrSnapshotTooOld) {
+				t.Errorf("expected %v, but got %v", engine.ErrSnapshotTooOld, err)
+			}
+		})
+
+		// 2回目のCommitで参照数が負になると、GCがその時点で止まったままになる
+		t.Run(c.name+"_DoubleCommit", func(t *testing.T) {
+			e := c.newEngine()
+			write(t, e, "value0")
+
+			tx, err := e.BeginAt(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if !errors.Is(err, engine.ErrTxDone) {
+				t.Errorf("expected %v, but got %v", engine.ErrTxDone, err)
+			}
+
+			writer := e.Begin(engine.RepeatableRead)
+			err = writer.Set("key", "value1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = writer.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = writer.Commit()
+			if !errors.Is(err, engine.ErrTxDone) {
+				t.Errorf("expected %v, but got %v", engine.ErrTxDone, err)
+			}
+
+			write(t, e, "value2")
+			e.GC()
+
+			_, err = e.BeginAt(1)
+			if !errors.Is(err, engine.ErrSnapshotTooOld) {
+				t.Errorf("expected %v, but got %v", engine.ErrSnapshotTooOld, err)
+			}
+			if got := readAt(t, e, 3); got != "value2" {
+				t.Errorf("expected %q, but got %q", "value2", got)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	cases := []struct {
+		name   string
+		engine engine.HistoryEngine
+	}{
+		{name: "AppendOnly", engine: appendonly.NewAppendOnlyEngine(engine.WithRetention(time.Hour))},
+		{name: "Delta", engine: delta.NewDeltaEngine(engine.WithRetention(time.Hour))},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, value := range []string{"value0", "value1"} {
+				tx := c.engine.Begin(engine.RepeatableRead)
+				err := tx.Set("key", value)
+				if err != nil {
+					t.Fatal(err)
 				}
+				err = tx.Commit()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tx := c.engine.Begin(engine.RepeatableRead)
+			err := tx.Set("key", "value2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []engine.Version{
+				{Value: "value0", BeginTxID: 1, EndTxID: 2, CommitNo: 1},
+				{Value: "value1", BeginTxID: 2, EndTxID: 3, CommitNo: 2, Visible: true},
+				{Value: "value2", BeginTxID: 3},
+			}
+			got := c.engine.History("key")
+			if !slices.Equal(got, want) {
+				t.Errorf("expected %+v, but got %+v", want, got)
+			}
+
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// 保持期間がなければclogの切り詰めやundo logのpurgeで消えるが、コミット番号は残す
+func TestHistoryAfterGC(t *testing.T) {
+	cases := []struct {
+		name   string
+		engine engine.HistoryEngine
+	}{
+		{name: "AppendOnly", engine: appendonly.NewAppendOnlyEngine()},
+		{name: "Delta", engine: delta.NewDeltaEngine()},
+	}
 
-				t.Log("tx4.Commit()")
-				err = tx4.Commit()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, value := range []string{"value0", "value1"} {
+				tx := c.engine.Begin(engine.RepeatableRead)
+				err := tx.Set("key", value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = tx.Commit()
 				if err != nil {
-					t.Error(err)
-					return
+					t.Fatal(err)
+				}
+			}
+
+			c.engine.GC()
+
+			want := []engine.Version{
+				{Value: "value1", BeginTxID: 2, CommitNo: 2, Visible: true},
+			}
+			got := c.engine.History("key")
+			if !slices.Equal(got, want) {
+				t.Errorf("expected %+v, but got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	e := appendonly.NewAppendOnlyEngine()
+
+	tx1 := e.Begin(engine.RepeatableRead)
+	err := tx1.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx2 := e.Begin(engine.RepeatableRead).(*appendonly.Tx)
+	err = tx2.Set("key", "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx3 := e.Begin(engine.RepeatableRead)
+	err = tx3.Set("key", "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx4 := e.Begin(engine.RepeatableRead)
+	ex, err := e.Explain(tx4, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(ex)
+
+	want := []engine.Step{
+		{Value: "value0", TxID: 1, Visible: true, Reason: engine.ReasonCommitted},
+		{Value: "value1", TxID: 2, Reason: engine.ReasonAborted},
+		{Value: "value2", TxID: 3, Reason: engine.ReasonActive},
+	}
+	if !slices.Equal(ex.Steps, want) {
+		t.Errorf("expected %+v, but got %+v", want, ex.Steps)
+	}
+	if !ex.Found || ex.Value != "value0" {
+		t.Errorf("expected %q, but got %q (found=%v)", "value0", ex.Value, ex.Found)
+	}
+
+	_, err = e.Explain(delta.NewDeltaEngine().Begin(engine.RepeatableRead), "key")
+	if !errors.Is(err, engine.ErrForeignTx) {
+		t.Errorf("expected %v, but got %v", engine.ErrForeignTx, err)
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	cases := []struct {
+		name      string
+		newEngine func() engine.DotEngine
+		want      []string
+	}{
+		{
+			name:      "AppendOnly",
+			newEngine: func() engine.DotEngine { return appendonly.NewAppendOnlyEngine() },
+			want: []string{
+				`v0 [label="{\"value0\"|xmin tx1 committed #1 (hint)|xmax tx3 in_progress}"];`,
+				`v1 [label="{\"value1\"|xmin tx3 in_progress}", color=blue];`,
+				`v0 -> v1 [label="tx3"];`,
+				`snapshot_tx2 -> v0 [style=dashed, color=darkgoldenrod];`,
+				`snapshot_tx3 -> v1 [style=dashed, color=darkgoldenrod];`,
+			},
+		},
+		{
+			name:      "Delta",
+			newEngine: func() engine.DotEngine { return delta.NewDeltaEngine() },
+			want: []string{
+				`t0 [label="{key|\"value1\"|tx3 active}"];`,
+				`label="undo log of tx3 active";`,
+				`u3_0 [label="{key|\"value0\"|tx1 #1 purged}"];`,
+				`t0 -> u3_0 [label="prev"];`,
+				`u3_0 -> purged1 [style=dotted, color=gray];`,
+				`snapshot_tx2 -> u3_0 [style=dashed, color=darkgoldenrod];`,
+				`snapshot_tx3 -> t0 [style=dashed, color=darkgoldenrod];`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := c.newEngine()
+
+			tx1 := e.Begin(engine.RepeatableRead)
+			err := tx1.Set("key", "value0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx1.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tx2 := e.Begin(engine.RepeatableRead)
+			tx3 := e.Begin(engine.ReadCommitted)
+			err = tx3.Set("key", "value1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b strings.Builder
+			err = e.WriteDot(&b, tx2, tx3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Log("\n" + b.String())
+
+			for _, line := range c.want {
+				if !strings.Contains(b.String(), line) {
+					t.Errorf("expected %s", line)
 				}
-			}()
+			}
 
+			err = e.WriteDot(&b, naive.NewNaiveEngine().Begin(engine.RepeatableRead))
+			if !errors.Is(err, engine.ErrForeignTx) {
+				t.Errorf("expected %v, but got %v", engine.ErrForeignTx, err)
+			}
+		})
+	}
+}
+
+// RepeatableReadでは、スナップショットの後にコミットされた版を上書きできない
+func TestFirstUpdaterWins(t *testing.T) {
+	cases := []struct {
+		name   string
+		engine engine.LockEngine
+	}{
+		{name: "AppendOnly", engine: appendonly.NewAppendOnlyEngine()},
+		{name: "Delta", engine: delta.NewDeltaEngine()},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := c.engine
+
+			tx1 := e.Begin(engine.RepeatableRead)
+			err := tx1.Set("key", "value0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx1.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tx2 := e.Begin(engine.RepeatableRead)
+			tx3 := e.Begin(engine.ReadCommitted)
+			err = tx2.Set("other", "value1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tx4 := e.Begin(engine.RepeatableRead)
+			err = tx4.Set("key", "value1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx4.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = tx2.Set("key", "value2")
+			if !errors.Is(err, engine.ErrSerialization) {
+				t.Errorf("expected %v, but got %v", engine.ErrSerialization, err)
+			}
+
+			// 書けなかったキーのロックは持ち続けない
+			for _, locks := range e.Locks() {
+				if locks.Key == "key" {
+					t.Errorf("expected no lock on key, but got %+v", locks)
+				}
+			}
+
+			// アボートすれば先に書いたキーも元に戻る
+			err = tx2.Abort()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = e.Begin(engine.RepeatableRead).Get("other")
+			if !errors.Is(err, engine.ErrNotFound) {
+				t.Errorf("expected %v, but got %v", engine.ErrNotFound, err)
+			}
+
+			// ReadCommittedなら最新の版を上書きできる
+			err = tx3.Set("key", "value3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx3.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := e.Begin(engine.RepeatableRead).Get("key")
+			if err != nil || got != "value3" {
+				t.Errorf("expected value3, but got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+type recordingObserver struct {
+	engine.NopObserver
+	events []string
+}
+
+func (o *recordingObserver) OnLockWait(txID int, key string, mode lock.LockType) {
+	o.events = append(o.events, fmt.Sprintf("lock wait tx%d %s %s", txID, key, mode))
+}
+
+func (o *recordingObserver) OnBegin(txID int, level engine.IsolationLevel) {
+	o.events = append(o.events, fmt.Sprintf("begin tx%d", txID))
+}
+
+func (o *recordingObserver) OnCommit(txID int, level engine.IsolationLevel) {
+	o.events = append(o.events, fmt.Sprintf("commit tx%d", txID))
+}
+
+func (o *recordingObserver) OnAbort(txID int, level engine.IsolationLevel) {
+	o.events = append(o.events, fmt.Sprintf("abort tx%d", txID))
+}
+
+func (o *recordingObserver) OnVersionCreated(txID int, key string) {
+	o.events = append(o.events, fmt.Sprintf("version tx%d %s", txID, key))
+}
+
+func (o *recordingObserver) OnVacuum(active, removed int) {
+	o.events = append(o.events, fmt.Sprintf("vacuum active=%d removed=%d", active, removed))
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	clk := clock.NewFake(time.Now())
+	e := appendonly.NewAppendOnlyEngine(engine.WithObserver(observer), engine.WithClock(clk))
+
+	tx1 := e.Begin(engine.RepeatableRead)
+	err := tx1.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx2 := e.Begin(engine.RepeatableRead).(*appendonly.Tx)
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return tx2.Set("key", "value1") })
+	if !errors.Is(err, lock.ErrTimeout) {
+		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
+	}
+	err = tx2.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.GC()
+
+	want := []string{
+		"begin tx1",
+		"version tx1 key",
+		"begin tx2",
+		"lock wait tx2 key x",
+		"abort tx2",
+		"commit tx1",
+		"vacuum active=0 removed=0",
+	}
+	if !slices.Equal(observer.events, want) {
+		t.Errorf("expected %q, but got %q", want, observer.events)
+	}
+}
+
+// どのエンジンもトランザクションと書き込みのイベントを送る
+func TestObserverEvents(t *testing.T) {
+	cases := []struct {
+		name      string
+		newEngine func(opts ...engine.Option) engine.Engine
+	}{
+		{name: "Naive", newEngine: func(opts ...engine.Option) engine.Engine { return naive.NewNaiveEngine(opts...) }},
+		{name: "Locking", newEngine: func(opts ...engine.Option) engine.Engine { return locking.NewLockingEngine(opts...) }},
+		{name: "AppendOnly", newEngine: func(opts ...engine.Option) engine.Engine { return appendonly.NewAppendOnlyEngine(opts...) }},
+		{name: "Delta", newEngine: func(opts ...engine.Option) engine.Engine { return delta.NewDeltaEngine(opts...) }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			observer := &recordingObserver{}
+			e := c.newEngine(engine.WithObserver(observer))
+
+			tx1 := e.Begin(engine.RepeatableRead)
+			err := tx1.Set("key", "value0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx1.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"begin tx1", "version tx1 key", "commit tx1"}
+
+			tx2 := e.Begin(engine.RepeatableRead)
+			err = tx2.Set("key", "value1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx2.Abort()
+			want = append(want, "begin tx2", "version tx2 key", "abort tx2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(observer.events, want) {
+				t.Errorf("expected %q, but got %q", want, observer.events)
+			}
+		})
+	}
+}
+
+type lockWaitObserver struct {
+	engine.NopObserver
+	waits chan int
+}
+
+func (o *lockWaitObserver) OnLockWait(txID int, key string, mode lock.LockType) {
+	o.waits <- txID
+}
+
+// ycsbのように複数のgoroutineから同じエンジンを使う。go test -raceで競合がないことを確かめる
+func TestConcurrentUse(t *testing.T) {
+	cases := []struct {
+		name      string
+		newEngine func(opts ...engine.Option) engine.Engine
+	}{
+		{name: "Naive", newEngine: func(opts ...engine.Option) engine.Engine { return naive.NewNaiveEngine(opts...) }},
+		{name: "Locking", newEngine: func(opts ...engine.Option) engine.Engine { return locking.NewLockingEngine(opts...) }},
+		{name: "AppendOnly", newEngine: func(opts ...engine.Option) engine.Engine { return appendonly.NewAppendOnlyEngine(opts...) }},
+		{name: "Delta", newEngine: func(opts ...engine.Option) engine.Engine { return delta.NewDeltaEngine(opts...) }},
+	}
+
+	const workers = 8
+	const rounds = 50
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := c.newEngine()
+
+			tx := e.Begin(engine.ReadCommitted)
+			err := tx.Set("shared", "value0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errs := make(chan error, workers)
+			var wg sync.WaitGroup
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					// ロック待ちにならないよう、書くのは自分のキーだけ
+					key := fmt.Sprintf("key%d", w)
+					for i := range rounds {
+						tx := e.Begin(engine.ReadCommitted)
+						_, err := tx.Get("shared")
+						if err != nil {
+							errs <- err
+							return
+						}
+						err = tx.Set(key, fmt.Sprintf("value%d", i))
+						if err != nil {
+							errs <- err
+							return
+						}
+						err = tx.Commit()
+						if err != nil {
+							errs <- err
+							return
+						}
+
+						if i%10 == 0 {
+							e.GC()
+							if le, ok := e.(engine.LockEngine); ok {
+								le.Locks()
+							}
+							if se, ok := e.(engine.StatsEngine); ok {
+								se.Stats()
+							}
+						}
+					}
+				}()
+			}
 			wg.Wait()
+			close(errs)
 
-			active, removed := c.engine.GC()
-			if active != 0 {
-				t.Errorf("expected 0 active, but got %d", active)
+			for err := range errs {
+				t.Error(err)
 			}
-			if removed != c.wantGC {
-				t.Errorf("expected %d removed, but got %d", c.wantGC, removed)
+
+			tx = e.Begin(engine.ReadCommitted)
+			for w := range workers {
+				got, err := tx.Get(fmt.Sprintf("key%d", w))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := fmt.Sprintf("value%d", rounds-1); got != want {
+					t.Errorf("expected %q, but got %q", want, got)
+				}
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
 			}
 		})
 	}
 }
+
+func TestTxLockTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	observer := &lockWaitObserver{waits: make(chan int, 2)}
+	e := delta.NewDeltaEngine(engine.WithLockTimeout(10*time.Millisecond), engine.WithClock(clk), engine.WithObserver(observer))
+
+	tx1 := e.Begin(engine.RepeatableRead)
+	err := tx1.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx2 := e.Begin(engine.RepeatableRead)
+	err = clk.AdvanceWhenBlocked(10*time.Millisecond, func() error { return tx2.Set("key", "value1") })
+	if !errors.Is(err, lock.ErrTimeout) {
+		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
+	}
+	<-observer.waits
+
+	done := make(chan error)
+	go func() {
+		tx3 := e.Begin(engine.RepeatableRead, engine.WithTxLockTimeout(lock.NoTimeout))
+		done <- tx3.Set("key", "value2")
+	}()
+
+	<-observer.waits
+	clk.Advance(time.Hour)
+
+	// コミットするとtx3の上書きはfirst-updater-winsで失敗するのでアボートする
+	err = tx1.(*delta.Tx).Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
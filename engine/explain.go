@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"fmt"
+	"mvcc-go/engine/readview"
+	"strings"
+)
+
+type Reason string
+
+const (
+	ReasonOwnWrite  Reason = "own_write" // 自分自身が書いた
+	ReasonCommitted Reason = "committed" // スナップショット作成前にコミット済み
+	ReasonFuture    Reason = "future"    // スナップショット作成後に開始・コミットした
+	ReasonActive    Reason = "active"    // スナップショット作成時点で実行中
+	ReasonAborted   Reason = "aborted"   // アボートした
+	ReasonDeleted   Reason = "deleted"   // 見えるトランザクションが上書き済み
+)
+
+func (r Reason) Visible() bool {
+	return r == ReasonOwnWrite || r == ReasonCommitted
+}
+
+// 調べたバージョンごとの判定
+type Step struct {
+	Value   string
+	TxID    int // バージョンを書いたトランザクション
+	Visible bool
+	Reason  Reason
+}
+
+type Explanation struct {
+	Key      string
+	Snapshot readview.ReadView
+	Steps    []Step // 調べた順
+	Value    string
+	Found    bool
+}
+
+func NewExplanation(key string, snapshot readview.ReadView, steps []Step) Explanation {
+	ex := Explanation{
+		Key:      key,
+		Snapshot: snapshot,
+		Steps:    steps,
+	}
+
+	for _, step := range steps {
+		if step.Visible {
+			ex.Value = step.Value
+			ex.Found = true
+		}
+	}
+
+	return ex
+}
+
+func (ex Explanation) String() string {
+	var b strings.Builder
+
+	v := ex.Snapshot
+	if v.Historical {
+		fmt.Fprintf(&b, "key=%q snapshot: as of commit %d\n", ex.Key, v.CommitNo)
+	} else {
+		fmt.Fprintf(&b, "key=%q snapshot: tx%d low=%d high=%d active=%v commit=%d\n",
+			ex.Key, v.CreatorTxID, v.LowTxID, v.HighTxID, v.Active(), v.CommitNo)
+	}
+
+	for _, step := range ex.Steps {
+		mark := "-"
+		if step.Visible {
+			mark = "+"
+		}
+		fmt.Fprintf(&b, "  %s tx%d %q: %s\n", mark, step.TxID, step.Value, step.Reason)
+	}
+
+	if ex.Found {
+		fmt.Fprintf(&b, "  => %q\n", ex.Value)
+	} else {
+		fmt.Fprintf(&b, "  => not found\n")
+	}
+
+	return b.String()
+}
+
+// トランザクションからkeyがどう見えるかを説明する
+type ExplainEngine interface {
+	Engine
+	Explain(tx Tx, key string) (Explanation, error)
+}
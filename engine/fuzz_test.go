@@ -0,0 +1,170 @@
+package engine_test
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"mvcc-go/engine"
+	"mvcc-go/engine/appendonly"
+	"mvcc-go/engine/delta"
+	"mvcc-go/engine/locking"
+	"mvcc-go/lock"
+	"mvcc-go/schedule"
+	"testing"
+)
+
+// バイト列を先頭から読む。尽きたら0を返す
+type byteReader []byte
+
+func (r *byteReader) next() int {
+	if len(*r) == 0 {
+		return 0
+	}
+
+	b := (*r)[0]
+	*r = (*r)[1:]
+
+	return int(b)
+}
+
+var fuzzKeys = []string{"a", "b", "c"}
+
+// 先頭でトランザクションのスクリプトを、残りで各ステップで進めるスクリプトを決める
+func decodeWorkload(data []byte) ([]schedule.Script, schedule.Schedule) {
+	r := byteReader(data)
+
+	scripts := make([]schedule.Script, 2+r.next()%3)
+	for i := range scripts {
+		level := engine.ReadCommitted
+		if r.next()%2 == 1 {
+			level = engine.RepeatableRead
+		}
+
+		ops := make([]schedule.Op, 0)
+		for j := range 1 + r.next()%4 {
+			b := r.next()
+			key := fuzzKeys[(b>>3)%len(fuzzKeys)]
+
+			switch b % 8 {
+			case 0, 1, 2:
+				ops = append(ops, schedule.Get(key))
+			case 3, 4, 5:
+				ops = append(ops, schedule.Set(key, fmt.Sprintf("%d.%d", i, j)))
+			default:
+				ops = append(ops, schedule.GC())
+			}
+		}
+
+		scripts[i] = schedule.Script{Level: level, Ops: append(ops, schedule.Commit())}
+	}
+
+	order := make(schedule.Schedule, 0, len(r))
+	for len(r) > 0 {
+		order = append(order, r.next()%len(scripts))
+	}
+
+	return scripts, order
+}
+
+// コミット順にトランザクションの書き込みを1つずつ適用する直列実行のモデルで、読んだ値を検査する。
+// snapshotならRepeatableReadはBegin時点のスナップショットを読み、そうでなければ（ロックで）その時点の最新を読む
+func checkSerial(scripts []schedule.Script, r schedule.Result, snapshot bool) error {
+	type txn struct {
+		snapshot map[string]string
+		writes   map[string]string
+	}
+
+	committed := make(map[string]string)
+	txs := make([]txn, len(scripts))
+	for _, event := range r.Events {
+		if event.Blocked {
+			continue
+		}
+
+		tx := &txs[event.Tx]
+		switch event.Op.Kind {
+		case schedule.OpBegin:
+			tx.snapshot = maps.Clone(committed)
+			tx.writes = make(map[string]string)
+		case schedule.OpGet:
+			if errors.Is(event.Err, lock.ErrTimeout) {
+				continue
+			}
+			if event.Err != nil && !errors.Is(event.Err, engine.ErrNotFound) {
+				return fmt.Errorf("%s: unexpected error", event)
+			}
+
+			state := committed
+			if snapshot && scripts[event.Tx].Level == engine.RepeatableRead {
+				state = tx.snapshot
+			}
+			want, ok := tx.writes[event.Op.Key]
+			if !ok {
+				want, ok = state[event.Op.Key]
+			}
+
+			got, found := event.Value, event.Err == nil
+			if found != ok || got != want {
+				return fmt.Errorf("%s: expected %q (found=%v)", event, want, ok)
+			}
+		case schedule.OpSet:
+			if event.Err == nil {
+				tx.writes[event.Op.Key] = event.Op.Value
+			}
+		case schedule.OpCommit:
+			if event.Err != nil {
+				return fmt.Errorf("%s: unexpected error", event)
+			}
+			maps.Copy(committed, tx.writes)
+		}
+	}
+
+	// 最後に見える値はコミット順に適用した結果と一致する
+	reader := r.Engine.Begin(engine.ReadCommitted)
+	defer reader.Commit()
+
+	for _, key := range fuzzKeys {
+		want, ok := committed[key]
+		got, err := reader.Get(key)
+		if (err == nil) != ok || got != want {
+			return fmt.Errorf("final %s: expected %q (found=%v), but got %q, %v", key, want, ok, got, err)
+		}
+	}
+
+	return nil
+}
+
+func FuzzSerial(f *testing.F) {
+	cases := []struct {
+		name      string
+		newEngine func(opts ...engine.Option) engine.Engine
+		snapshot  bool
+	}{
+		{name: "locking", newEngine: func(opts ...engine.Option) engine.Engine { return locking.NewLockingEngine(opts...) }},
+		{name: "appendonly", newEngine: func(opts ...engine.Option) engine.Engine { return appendonly.NewAppendOnlyEngine(opts...) }, snapshot: true},
+		{name: "delta", newEngine: func(opts ...engine.Option) engine.Engine { return delta.NewDeltaEngine(opts...) }, snapshot: true},
+	}
+
+	// 長く読むRepeatableReadの途中で上書きとGCが入るもの
+	f.Add([]byte{0, 1, 3, 0x00, 0x03, 0x06, 0, 1, 0x03, 0, 0, 1, 1, 0, 1, 0, 0})
+	f.Add([]byte{1, 1, 2, 0x00, 0x00, 0, 2, 0x03, 0x06, 1, 1, 0x0b, 0, 1, 2, 1, 2, 0, 1, 0, 0})
+	f.Add([]byte{2, 0, 1, 0x08, 1, 3, 0x0b, 0x0e, 0x08, 0, 2, 0x13, 0x16, 1, 1, 0x0c, 3, 2, 1, 0, 3, 2, 1, 0, 0, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		scripts, order := decodeWorkload(data)
+		scenario := schedule.Scenario{Scripts: scripts}
+
+		for _, c := range cases {
+			scenario.NewEngine = c.newEngine
+			result, err := scenario.Follow(order)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+
+			err = checkSerial(scripts, result, c.snapshot)
+			if err != nil {
+				t.Fatalf("%s: schedule %v: %v\n%s", c.name, result.Schedule, err, result.Trace())
+			}
+		}
+	})
+}
@@ -5,30 +5,42 @@ import (
 	"mvcc-go/engine"
 	"mvcc-go/engine/naive/storage"
 	"mvcc-go/lock"
+	"sync"
+	"time"
 )
 
 type Tx struct {
-	ID         int
-	engine     *LockingEngine
-	lockedKeys map[string]struct{}
+	ID          int
+	level       engine.IsolationLevel
+	engine      *LockingEngine
+	lockedKeys  map[string]struct{}
+	lockTimeout time.Duration
+	before      map[string]*string // キーごとの最初の書き込み前の値。nilならキーがなかった
+	done        bool
 }
 
-func newTx(engine *LockingEngine, id int) *Tx {
+func newTx(engine *LockingEngine, id int, level engine.IsolationLevel, options engine.TxOptions) *Tx {
 	return &Tx{
-		ID:         id,
-		engine:     engine,
-		lockedKeys: make(map[string]struct{}),
+		ID:          id,
+		level:       level,
+		engine:      engine,
+		lockedKeys:  make(map[string]struct{}),
+		lockTimeout: options.LockTimeout,
+		before:      make(map[string]*string),
 	}
 }
 
 func (tx *Tx) Get(key string) (string, error) {
-	err := tx.engine.lockManager.SLock(tx.ID, key)
+	err := tx.engine.lockManager.SLockTimeout(tx.ID, key, tx.lockTimeout)
 	if err != nil {
 		return "", fmt.Errorf("slock: %w", err)
 	}
 
 	tx.lockedKeys[key] = struct{}{}
 
+	tx.engine.mu.Lock()
+	defer tx.engine.mu.Unlock()
+
 	value, ok := tx.engine.storage.Get(key)
 	if !ok {
 		return "", engine.ErrNotFound
@@ -38,19 +50,60 @@ func (tx *Tx) Get(key string) (string, error) {
 }
 
 func (tx *Tx) Set(key, value string) error {
-	err := tx.engine.lockManager.XLock(tx.ID, key)
+	err := tx.engine.lockManager.XLockTimeout(tx.ID, key, tx.lockTimeout)
 	if err != nil {
 		return fmt.Errorf("xlock: %w", err)
 	}
 
 	tx.lockedKeys[key] = struct{}{}
 
+	tx.engine.mu.Lock()
+	defer tx.engine.mu.Unlock()
+
+	if _, ok := tx.before[key]; !ok {
+		tx.before[key] = nil
+		if old, ok := tx.engine.storage.Get(key); ok {
+			tx.before[key] = &old
+		}
+	}
+
 	tx.engine.storage.Set(key, value)
+	tx.engine.options.Observer.OnVersionCreated(tx.ID, key)
 
 	return nil
 }
 
 func (tx *Tx) Commit() error {
+	return tx.end(func() {
+		tx.engine.options.Observer.OnCommit(tx.ID, tx.level)
+	})
+}
+
+// Xロックを持ったまま書き込み前の値に戻すので、他のトランザクションには書き込みが見えない
+func (tx *Tx) Abort() error {
+	return tx.end(func() {
+		for key, old := range tx.before {
+			if old == nil {
+				tx.engine.storage.Delete(key)
+			} else {
+				tx.engine.storage.Set(key, *old)
+			}
+		}
+
+		tx.engine.options.Observer.OnAbort(tx.ID, tx.level)
+	})
+}
+
+func (tx *Tx) end(finish func()) error {
+	tx.engine.mu.Lock()
+	if tx.done {
+		tx.engine.mu.Unlock()
+		return engine.ErrTxDone
+	}
+	tx.done = true
+	finish()
+	tx.engine.mu.Unlock()
+
 	for key := range tx.lockedKeys {
 		err := tx.engine.lockManager.Unlock(tx.ID, key)
 		if err != nil {
@@ -62,25 +115,40 @@ func (tx *Tx) Commit() error {
 }
 
 var _ engine.Engine = &LockingEngine{}
+var _ engine.LockEngine = &LockingEngine{}
 
+// ロック待ちの間はmuを持たないので、複数のgoroutineから同時に使える
 type LockingEngine struct {
+	mu          sync.Mutex // storageを守る
 	storage     *storage.NaiveStorage
 	lockManager *lock.Manager
 	maxTxID     int
+	options     engine.Options
 }
 
-func NewLockingEngine() *LockingEngine {
+func NewLockingEngine(opts ...engine.Option) *LockingEngine {
+	options := engine.NewOptions(opts...)
+
 	return &LockingEngine{
 		storage:     storage.NewNaiveStorage(),
-		lockManager: lock.NewManager(),
+		lockManager: lock.NewManager(lock.WithTimeout(options.LockTimeout), lock.WithClock(options.Clock), lock.WithObserver(options.Observer)),
 		maxTxID:     0,
+		options:     options,
 	}
 }
 
-func (e *LockingEngine) Begin(level engine.IsolationLevel) engine.Tx {
+func (e *LockingEngine) Begin(level engine.IsolationLevel, opts ...engine.TxOption) engine.Tx {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	e.maxTxID++
+	e.options.Observer.OnBegin(e.maxTxID, level)
+
+	return newTx(e, e.maxTxID, level, engine.NewTxOptions(e.options, opts...))
+}
 
-	return newTx(e, e.maxTxID)
+func (e *LockingEngine) Locks() []lock.KeyLocks {
+	return e.lockManager.Snapshot()
 }
 
 func (e *LockingEngine) GC() (active, removed int) {
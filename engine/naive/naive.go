@@ -3,19 +3,32 @@ package naive
 import (
 	"mvcc-go/engine"
 	"mvcc-go/engine/naive/storage"
+	"sync"
 )
 
 type naiveTx struct {
+	id      int
+	level   engine.IsolationLevel
+	engine  *NaiveEngine
 	storage *storage.NaiveStorage
+	before  map[string]*string // キーごとの最初の書き込み前の値。nilならキーがなかった
+	done    bool
 }
 
-func newTx(storage *storage.NaiveStorage) *naiveTx {
+func newTx(e *NaiveEngine, id int, level engine.IsolationLevel) *naiveTx {
 	return &naiveTx{
-		storage: storage,
+		id:      id,
+		level:   level,
+		engine:  e,
+		storage: e.storage,
+		before:  make(map[string]*string),
 	}
 }
 
 func (tx *naiveTx) Get(key string) (string, error) {
+	tx.engine.mu.Lock()
+	defer tx.engine.mu.Unlock()
+
 	value, ok := tx.storage.Get(key)
 	if !ok {
 		return "", engine.ErrNotFound
@@ -25,29 +38,80 @@ func (tx *naiveTx) Get(key string) (string, error) {
 }
 
 func (tx *naiveTx) Set(key, value string) error {
+	tx.engine.mu.Lock()
+	defer tx.engine.mu.Unlock()
+
+	if _, ok := tx.before[key]; !ok {
+		tx.before[key] = nil
+		if old, ok := tx.storage.Get(key); ok {
+			tx.before[key] = &old
+		}
+	}
+
 	tx.storage.Set(key, value)
+	tx.engine.options.Observer.OnVersionCreated(tx.id, key)
 
 	return nil
 }
 
 func (tx *naiveTx) Commit() error {
+	return tx.end(func() {
+		tx.engine.options.Observer.OnCommit(tx.id, tx.level)
+	})
+}
+
+// 書き込み前の値に戻す。ロックがないので、その後に他のトランザクションが書いた値も上書きする
+func (tx *naiveTx) Abort() error {
+	return tx.end(func() {
+		for key, old := range tx.before {
+			if old == nil {
+				tx.storage.Delete(key)
+			} else {
+				tx.storage.Set(key, *old)
+			}
+		}
+
+		tx.engine.options.Observer.OnAbort(tx.id, tx.level)
+	})
+}
+
+func (tx *naiveTx) end(finish func()) error {
+	tx.engine.mu.Lock()
+	defer tx.engine.mu.Unlock()
+
+	if tx.done {
+		return engine.ErrTxDone
+	}
+	tx.done = true
+	finish()
+
 	return nil
 }
 
 var _ engine.Engine = &NaiveEngine{}
 
 type NaiveEngine struct {
+	mu      sync.Mutex // storageを守る
 	storage *storage.NaiveStorage
+	maxTxID int
+	options engine.Options
 }
 
-func NewNaiveEngine() *NaiveEngine {
+func NewNaiveEngine(opts ...engine.Option) *NaiveEngine {
 	return &NaiveEngine{
 		storage: storage.NewNaiveStorage(),
+		options: engine.NewOptions(opts...),
 	}
 }
 
-func (e *NaiveEngine) Begin(level engine.IsolationLevel) engine.Tx {
-	return newTx(e.storage)
+func (e *NaiveEngine) Begin(level engine.IsolationLevel, opts ...engine.TxOption) engine.Tx {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.maxTxID++
+	e.options.Observer.OnBegin(e.maxTxID, level)
+
+	return newTx(e, e.maxTxID, level)
 }
 
 func (e *NaiveEngine) GC() (active, removed int) {
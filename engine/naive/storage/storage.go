@@ -40,3 +40,12 @@ func (s *NaiveStorage) Set(key, value string) {
 		value: value,
 	})
 }
+
+func (s *NaiveStorage) Delete(key string) {
+	for i, r := range s.records {
+		if r.key == key {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+			return
+		}
+	}
+}
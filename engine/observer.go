@@ -0,0 +1,31 @@
+package engine
+
+import "mvcc-go/lock"
+
+// エンジン内部のイベントを受け取る。ロック待ちのイベントはlock.Managerから届く。
+// 全てのエンジンがOnBegin・OnCommit・OnAbort・OnVersionCreated（上書きするエンジンでは書くたび）を呼ぶ。
+// OnPurgeはdelta、OnVacuumはappendonlyだけが呼ぶ。naiveはロックを使わない
+type Observer interface {
+	lock.Observer
+
+	OnBegin(txID int, level IsolationLevel)
+	OnCommit(txID int, level IsolationLevel)
+	OnAbort(txID int, level IsolationLevel)
+	OnVersionCreated(txID int, key string)
+	OnPurge(txID int)
+	OnVacuum(active, removed int)
+}
+
+// 必要なメソッドだけ実装するために埋め込んで使う
+type NopObserver struct {
+	lock.NopObserver
+}
+
+var _ Observer = NopObserver{}
+
+func (NopObserver) OnBegin(txID int, level IsolationLevel)  {}
+func (NopObserver) OnCommit(txID int, level IsolationLevel) {}
+func (NopObserver) OnAbort(txID int, level IsolationLevel)  {}
+func (NopObserver) OnVersionCreated(txID int, key string)   {}
+func (NopObserver) OnPurge(txID int)                        {}
+func (NopObserver) OnVacuum(active, removed int)            {}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"io"
+	"log/slog"
+	"mvcc-go/clock"
+	"mvcc-go/lock"
+	"time"
+)
+
+type Options struct {
+	// 過去のコミット時点を読めるようにGCを待つ期間
+	Retention time.Duration
+
+	// 0ならlock.Timeout、lock.NoTimeoutなら待ち続ける
+	LockTimeout time.Duration
+
+	// コミット時刻やロック待ちに使う。テストではclock.Fakeを渡す
+	Clock clock.Clock
+
+	Logger   *slog.Logger
+	Observer Observer
+}
+
+type Option func(*Options)
+
+func NewOptions(opts ...Option) Options {
+	o := Options{
+		Clock:    clock.Real,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Observer: NopObserver{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.LockTimeout == 0 {
+		o.LockTimeout = lock.Timeout
+	}
+
+	return o
+}
+
+func WithRetention(d time.Duration) Option {
+	return func(o *Options) {
+		o.Retention = d
+	}
+}
+
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.LockTimeout = timeout
+	}
+}
+
+func WithClock(c clock.Clock) Option {
+	return func(o *Options) {
+		o.Clock = c
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+func WithObserver(observer Observer) Option {
+	return func(o *Options) {
+		o.Observer = observer
+	}
+}
+
+// トランザクションごとの設定
+type TxOptions struct {
+	// 0ならエンジンの設定、lock.NoTimeoutなら待ち続ける
+	LockTimeout time.Duration
+}
+
+type TxOption func(*TxOptions)
+
+// 未指定の項目はエンジンの設定を引き継ぐ
+func NewTxOptions(engineOptions Options, opts ...TxOption) TxOptions {
+	var o TxOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.LockTimeout == 0 {
+		o.LockTimeout = engineOptions.LockTimeout
+	}
+
+	return o
+}
+
+func WithTxLockTimeout(timeout time.Duration) TxOption {
+	return func(o *TxOptions) {
+		o.LockTimeout = timeout
+	}
+}
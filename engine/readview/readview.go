@@ -0,0 +1,186 @@
+package readview
+
+import (
+	"slices"
+	"sync/atomic"
+)
+
+// InnoDB風のスナップショット
+type ReadView struct {
+	CreatorTxID int
+	LowTxID     int // これより小さいtxIDは確定済み
+	HighTxID    int // これ以上のtxIDはビュー作成後に開始したもの
+	CommitNo    int // ビュー作成時点の最終コミット番号
+
+	// trueならtxIDではなくコミット番号がCommitNo以下かで可視性を判定する
+	Historical bool
+
+	// Trackerと共有する配列。ends[i]がseqより後（または0）ならビュー作成時点でids[i]は実行中
+	ids  []int
+	ends []int64
+	seq  int64
+}
+
+// 過去のコミット時点のビュー
+func AsOf(commitNo int) ReadView {
+	return ReadView{
+		CommitNo:   commitNo,
+		Historical: true,
+	}
+}
+
+// ビュー作成時点で未確定だったか
+func (v ReadView) IsActive(txID int) bool {
+	if txID < v.LowTxID {
+		return false
+	}
+
+	if txID >= v.HighTxID {
+		return true
+	}
+
+	i, ok := slices.BinarySearch(v.ids, txID)
+	if !ok {
+		return false
+	}
+
+	end := atomic.LoadInt64(&v.ends[i])
+	return end == 0 || end > v.seq
+}
+
+// ビュー作成時点で実行中だったtxID（昇順）
+func (v ReadView) Active() []int {
+	active := make([]int, 0)
+	for _, txID := range v.ids {
+		if txID >= v.LowTxID && v.IsActive(txID) {
+			active = append(active, txID)
+		}
+	}
+
+	return active
+}
+
+// 実行中トランザクションの一覧をインクリメンタルに管理する。
+// 終了したトランザクションはその場で消さずに終了順の番号を書き、半分以上が終了済みになったら詰め直す。
+// 配列は要素を書き換えずにappendするだけなので、ReadViewはコピーせずに共有できる
+type Tracker struct {
+	ids       []int   // 昇順
+	ends      []int64 // idsと同じ並び、終了順の番号（実行中は0）
+	commitNos []int   // idsと同じ並び、開始時点の最終コミット番号
+	head      int     // 先頭の実行中トランザクションの位置
+	ended     int     // head以降の終了済みの数
+	seq       int64
+	lastTxID  int
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		ids:       make([]int, 0),
+		ends:      make([]int64, 0),
+		commitNos: make([]int, 0),
+	}
+}
+
+// txIDは単調増加であること
+func (t *Tracker) Begin(txID, commitNo int) {
+	t.ids = append(t.ids, txID)
+	t.ends = append(t.ends, 0)
+	t.commitNos = append(t.commitNos, commitNo)
+	t.lastTxID = txID
+}
+
+func (t *Tracker) End(txID int) {
+	i, ok := t.find(txID)
+	if !ok {
+		return
+	}
+
+	t.seq++
+	atomic.StoreInt64(&t.ends[i], t.seq)
+	t.ended++
+
+	for t.head < len(t.ids) && t.ends[t.head] != 0 {
+		t.head++
+		t.ended--
+	}
+
+	if dead := t.head + t.ended; dead*2 > len(t.ids) {
+		t.compact()
+	}
+}
+
+// 実行中のものだけを新しい配列に移す。作成済みのReadViewは古い配列を使い続ける
+func (t *Tracker) compact() {
+	n := t.Len()
+	ids := make([]int, 0, n)
+	ends := make([]int64, 0, n)
+	commitNos := make([]int, 0, n)
+	for i := t.head; i < len(t.ids); i++ {
+		if t.ends[i] != 0 {
+			continue
+		}
+
+		ids = append(ids, t.ids[i])
+		ends = append(ends, 0)
+		commitNos = append(commitNos, t.commitNos[i])
+	}
+
+	t.ids, t.ends, t.commitNos = ids, ends, commitNos
+	t.head, t.ended = 0, 0
+}
+
+// 実行中ならidsでの位置を返す
+func (t *Tracker) find(txID int) (int, bool) {
+	i, ok := slices.BinarySearch(t.ids[t.head:], txID)
+	if !ok || t.ends[t.head+i] != 0 {
+		return 0, false
+	}
+
+	return t.head + i, true
+}
+
+func (t *Tracker) IsActive(txID int) bool {
+	_, ok := t.find(txID)
+	return ok
+}
+
+func (t *Tracker) Len() int {
+	return len(t.ids) - t.head - t.ended
+}
+
+// 0 if no active tx
+func (t *Tracker) MinTxID() int {
+	if t.Len() == 0 {
+		return 0
+	}
+
+	return t.ids[t.head]
+}
+
+// txIDもコミット番号も単調増加なので先頭が最小
+func (t *Tracker) MinCommitNo() (int, bool) {
+	if t.Len() == 0 {
+		return 0, false
+	}
+
+	return t.commitNos[t.head], true
+}
+
+func (t *Tracker) ReadView(txID, commitNo int) ReadView {
+	low := t.lastTxID + 1
+	if t.Len() > 0 {
+		low = t.ids[t.head]
+	}
+
+	n := len(t.ids)
+
+	return ReadView{
+		CreatorTxID: txID,
+		LowTxID:     low,
+		HighTxID:    t.lastTxID + 1,
+		CommitNo:    commitNo,
+		ids:         t.ids[t.head:n:n],
+		ends:        t.ends[t.head:n:n],
+		seq:         t.seq,
+	}
+}
@@ -0,0 +1,145 @@
+package readview_test
+
+import (
+	"mvcc-go/engine/readview"
+	"slices"
+	"testing"
+)
+
+func TestReadView(t *testing.T) {
+	tracker := readview.NewTracker()
+	for txID := 1; txID <= 100; txID++ {
+		tracker.Begin(txID, 0)
+	}
+	before := tracker.ReadView(0, 0)
+
+	for txID := 2; txID <= 100; txID += 2 {
+		tracker.End(txID)
+	}
+	odd := tracker.ReadView(0, 0)
+
+	for txID := 1; txID <= 99; txID += 2 {
+		tracker.End(txID)
+		tracker.Begin(100+txID, 0)
+	}
+	after := tracker.ReadView(0, 0)
+
+	for txID := 1; txID <= 100; txID++ {
+		if !before.IsActive(txID) {
+			t.Errorf("expected tx%d to be active in the first view", txID)
+		}
+		if odd.IsActive(txID) != (txID%2 == 1) {
+			t.Errorf("expected tx%d to be active=%v in the second view", txID, txID%2 == 1)
+		}
+		if after.IsActive(txID) {
+			t.Errorf("expected tx%d to be inactive in the last view", txID)
+		}
+	}
+
+	if got := odd.Active(); len(got) != 50 || got[0] != 1 || got[49] != 99 {
+		t.Errorf("unexpected active list %v", got)
+	}
+	if tracker.Len() != 50 || tracker.MinTxID() != 101 || after.LowTxID != 101 || !after.IsActive(199) {
+		t.Errorf("unexpected tracker: len=%d min=%d low=%d", tracker.Len(), tracker.MinTxID(), after.LowTxID)
+	}
+}
+
+// 半分以上が終わると詰め直すが、それより前に作ったビューは古い配列で判定を続ける
+func TestTrackerCompaction(t *testing.T) {
+	tracker := readview.NewTracker()
+	for txID := 1; txID <= 10; txID++ {
+		tracker.Begin(txID, txID-1)
+	}
+	before := tracker.ReadView(0, 9)
+
+	// 先頭以外を終わらせて、headが進まないまま詰め直させる
+	for txID := 2; txID <= 10; txID++ {
+		tracker.End(txID)
+	}
+	tracker.Begin(11, 9)
+	after := tracker.ReadView(0, 9)
+
+	if got := before.Active(); !slices.Equal(got, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}) {
+		t.Errorf("expected every tx active in the view before compaction, but got %v", got)
+	}
+	if got := after.Active(); !slices.Equal(got, []int{1, 11}) {
+		t.Errorf("expected [1 11] after compaction, but got %v", got)
+	}
+	for txID := 2; txID <= 10; txID++ {
+		if tracker.IsActive(txID) {
+			t.Errorf("expected tx%d to have ended", txID)
+		}
+	}
+	if tracker.Len() != 2 || tracker.MinTxID() != 1 || !tracker.IsActive(11) {
+		t.Errorf("unexpected tracker: len=%d min=%d", tracker.Len(), tracker.MinTxID())
+	}
+
+	// 詰め直した後も終了を記録できる
+	tracker.End(1)
+	if tracker.Len() != 1 || tracker.MinTxID() != 11 || !after.IsActive(1) {
+		t.Errorf("unexpected tracker after ending tx1: len=%d min=%d", tracker.Len(), tracker.MinTxID())
+	}
+}
+
+// ビューは作成後の終了を見ない。終了順の番号で作成時点と比べる
+func TestTrackerEndSeq(t *testing.T) {
+	tracker := readview.NewTracker()
+	for txID := 1; txID <= 3; txID++ {
+		tracker.Begin(txID, 0)
+	}
+
+	tracker.End(2)
+	view := tracker.ReadView(3, 0)
+	tracker.End(1)
+	tracker.End(2) // 終了済みなら何もしない
+	tracker.End(4) // 知らないtxIDも
+
+	if !view.IsActive(1) || view.IsActive(2) || !view.IsActive(3) {
+		t.Errorf("expected [1 3] active in the view, but got %v", view.Active())
+	}
+	if view.LowTxID != 1 || view.HighTxID != 4 || !view.IsActive(4) {
+		t.Errorf("unexpected bounds: low=%d high=%d", view.LowTxID, view.HighTxID)
+	}
+	if latest := tracker.ReadView(3, 0); !slices.Equal(latest.Active(), []int{3}) || latest.LowTxID != 3 {
+		t.Errorf("expected only tx3 active, but got %v (low=%d)", latest.Active(), latest.LowTxID)
+	}
+	if tracker.Len() != 1 {
+		t.Errorf("expected 1 active, but got %d", tracker.Len())
+	}
+}
+
+func TestTrackerMinCommitNo(t *testing.T) {
+	tracker := readview.NewTracker()
+	if _, ok := tracker.MinCommitNo(); ok {
+		t.Error("expected no commit number without active transactions")
+	}
+
+	tracker.Begin(1, 5)
+	tracker.Begin(2, 5)
+	tracker.Begin(3, 7)
+
+	tracker.End(2)
+	if got, ok := tracker.MinCommitNo(); !ok || got != 5 {
+		t.Errorf("expected 5 while tx1 is active, but got %d, %v", got, ok)
+	}
+
+	tracker.End(1)
+	if got, ok := tracker.MinCommitNo(); !ok || got != 7 {
+		t.Errorf("expected 7 after tx1 ended, but got %d, %v", got, ok)
+	}
+
+	tracker.End(3)
+	if _, ok := tracker.MinCommitNo(); ok || tracker.MinTxID() != 0 {
+		t.Errorf("expected no active transactions, but got min tx%d", tracker.MinTxID())
+	}
+	if view := tracker.ReadView(4, 7); view.LowTxID != 4 || view.HighTxID != 4 || view.IsActive(3) {
+		t.Errorf("unexpected view after every tx ended: %+v", view)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	view := readview.AsOf(3)
+	if !view.Historical || view.CommitNo != 3 || len(view.Active()) != 0 {
+		t.Errorf("unexpected historical view: %+v", view)
+	}
+}
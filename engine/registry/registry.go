@@ -0,0 +1,45 @@
+// エンジンを名前で選べるようにする。コマンドやサーバーから使う
+package registry
+
+import (
+	"fmt"
+	"maps"
+	"mvcc-go/engine"
+	"mvcc-go/engine/appendonly"
+	"mvcc-go/engine/delta"
+	"mvcc-go/engine/locking"
+	"mvcc-go/engine/naive"
+	"slices"
+)
+
+type Factory func(opts ...engine.Option) engine.Engine
+
+var factories = map[string]Factory{
+	"naive":      func(opts ...engine.Option) engine.Engine { return naive.NewNaiveEngine(opts...) },
+	"locking":    func(opts ...engine.Option) engine.Engine { return locking.NewLockingEngine(opts...) },
+	"appendonly": func(opts ...engine.Option) engine.Engine { return appendonly.NewAppendOnlyEngine(opts...) },
+	"delta":      func(opts ...engine.Option) engine.Engine { return delta.NewDeltaEngine(opts...) },
+}
+
+// 名前順
+func Names() []string {
+	return slices.Sorted(maps.Keys(factories))
+}
+
+func Lookup(name string) (Factory, error) {
+	f, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown engine %q (available: %v)", name, Names())
+	}
+
+	return f, nil
+}
+
+func ParseLevel(s string) (engine.IsolationLevel, error) {
+	switch level := engine.IsolationLevel(s); level {
+	case engine.ReadCommitted, engine.RepeatableRead:
+		return level, nil
+	}
+
+	return "", fmt.Errorf("unknown isolation level %q (available: %s, %s)", s, engine.ReadCommitted, engine.RepeatableRead)
+}
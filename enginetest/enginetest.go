@@ -0,0 +1,467 @@
+// engine.Engineの実装が満たすべき振る舞いをまとめたテスト。独自のエンジンもRunに渡せば同じ基準で検査できる
+package enginetest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"mvcc-go/clock"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/hermitage"
+	"mvcc-go/history"
+	"mvcc-go/lock"
+	"mvcc-go/schedule"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Capabilities struct {
+	// 保証する分離レベル。含まないレベルでもBeginはできるものとして、分離の検査だけを省く
+	Levels []engine.IsolationLevel
+
+	// engine.TimeTravelEngineを実装する
+	TimeTravel bool
+}
+
+func (c Capabilities) supports(level engine.IsolationLevel) bool {
+	return slices.Contains(c.Levels, level)
+}
+
+// newEngineは受け取ったOptionをそのままエンジンに渡すこと。Concurrentは複数のgoroutineから同時に呼ぶので、-raceで動かすとよい
+func Run(t *testing.T, newEngine registry.Factory, caps Capabilities) {
+	t.Run("ReadYourWrites", func(t *testing.T) { testReadYourWrites(t, newEngine) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, newEngine) })
+	t.Run("Abort", func(t *testing.T) { testAbort(t, newEngine) })
+	for _, level := range caps.Levels {
+		t.Run("Isolation/"+string(level), func(t *testing.T) { testIsolation(t, newEngine, level) })
+	}
+	t.Run("GCSafety", func(t *testing.T) { testGCSafety(t, newEngine, caps) })
+	if caps.TimeTravel {
+		t.Run("TimeTravel", func(t *testing.T) { testTimeTravel(t, newEngine) })
+	}
+	t.Run("Stress", func(t *testing.T) { testStress(t, newEngine, caps) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newEngine, caps) })
+}
+
+func write(t *testing.T, e engine.Engine, key, value string) {
+	t.Helper()
+
+	tx := e.Begin(engine.RepeatableRead)
+	err := tx.Set(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectGet(t *testing.T, tx engine.Tx, key, want string) {
+	t.Helper()
+
+	got, err := tx.Get(key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if got != want {
+		t.Errorf("get %s: expected %q, but got %q", key, want, got)
+	}
+}
+
+func expectNotFound(t *testing.T, tx engine.Tx, key string) {
+	t.Helper()
+
+	got, err := tx.Get(key)
+	if !errors.Is(err, engine.ErrNotFound) {
+		t.Errorf("get %s: expected %v, but got %q, %v", key, engine.ErrNotFound, got, err)
+	}
+}
+
+func testReadYourWrites(t *testing.T, newEngine registry.Factory) {
+	for _, level := range hermitage.Levels {
+		t.Run(string(level), func(t *testing.T) {
+			e := newEngine()
+
+			tx := e.Begin(level)
+			for _, value := range []string{"value0", "value1"} {
+				err := tx.Set("key", value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectGet(t, tx, "key", value)
+			}
+			err := tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tx = e.Begin(level)
+			expectGet(t, tx, "key", "value1")
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func testNotFound(t *testing.T, newEngine registry.Factory) {
+	e := newEngine()
+
+	tx := e.Begin(engine.ReadCommitted)
+	expectNotFound(t, tx, "key")
+	err := tx.Set("other", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNotFound(t, tx, "key")
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// アボートした書き込みは最初からなかったことになる
+	tx = e.Begin(engine.ReadCommitted)
+	err = tx.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx = e.Begin(engine.ReadCommitted)
+	expectNotFound(t, tx, "key")
+	expectGet(t, tx, "other", "value0")
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAbort(t *testing.T, newEngine registry.Factory) {
+	e := newEngine()
+	write(t, e, "key", "value0")
+
+	tx := e.Begin(engine.RepeatableRead)
+	for _, key := range []string{"key", "new"} {
+		err := tx.Set(key, "value1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tx.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx = e.Begin(engine.RepeatableRead)
+	expectGet(t, tx, "key", "value0")
+	expectNotFound(t, tx, "new")
+
+	// アボートしたトランザクションのロックは解放されている
+	err = tx.Set("key", "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Hermitageの履歴のうちlevelで防がなければならないもの。P4はlost update
+func forbidden(level engine.IsolationLevel) []string {
+	names := history.Forbidden(level)
+	if slices.Contains(names, history.LostUpdate) {
+		names = append(names, "P4")
+	}
+
+	return names
+}
+
+func testIsolation(t *testing.T, newEngine registry.Factory, level engine.IsolationLevel) {
+	for _, anomaly := range hermitage.Anomalies {
+		if !slices.Contains(forbidden(level), anomaly.Name) {
+			continue
+		}
+
+		outcome, result, err := anomaly.Run(newEngine, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outcome == hermitage.Allowed {
+			t.Errorf("%s (%s) must be prevented\n%s", anomaly.Name, anomaly.Description, result.Trace())
+		}
+	}
+
+	for _, workload := range []history.Workload{history.Register, history.ListAppend} {
+		for seed := range uint64(10) {
+			random := Random{Keys: []string{"x", "y", "z"}, Txs: 2 + int(seed%3), MaxOps: 3, Workload: workload}
+			scenario := random.Scenario(seed, newEngine, level)
+			err := scenario.Sample(seed, 10, checkHistory(workload, level))
+			if err != nil {
+				t.Fatalf("%s seed %d: %v", workload, seed, err)
+			}
+		}
+	}
+}
+
+func checkHistory(workload history.Workload, level engine.IsolationLevel) func(r schedule.Result) error {
+	return func(r schedule.Result) error {
+		return checkRecorded(Recorded(r), workload, level)
+	}
+}
+
+func checkRecorded(h history.History, workload history.Workload, level engine.IsolationLevel) error {
+	report, err := history.Check(h, workload, level)
+	if err != nil {
+		return err
+	}
+	if !report.Valid() {
+		return errors.New(report.String())
+	}
+
+	return nil
+}
+
+// 開いているトランザクションから見える版をGCが回収しないこと
+func testGCSafety(t *testing.T, newEngine registry.Factory, caps Capabilities) {
+	for _, level := range hermitage.Levels {
+		t.Run(string(level), func(t *testing.T) {
+			scenario := schedule.Scenario{
+				NewEngine: newEngine,
+				Setup: func(e engine.Engine) error {
+					tx := e.Begin(engine.RepeatableRead)
+					err := tx.Set("key", "value0")
+					if err != nil {
+						return err
+					}
+					return tx.Commit()
+				},
+				Scripts: []schedule.Script{
+					{Level: level, Ops: []schedule.Op{schedule.Get("key"), schedule.GC(), schedule.Get("key"), schedule.Commit()}},
+					{Level: level, Ops: []schedule.Op{schedule.Set("key", "value1"), schedule.GC(), schedule.Commit()}},
+					{Level: level, Ops: []schedule.Op{schedule.Set("key", "value2"), schedule.Commit()}},
+					{Level: level, Ops: []schedule.Op{schedule.GC(), schedule.Get("key"), schedule.GC(), schedule.Commit()}},
+				},
+			}
+
+			err := scenario.Sample(1, 100, func(r schedule.Result) error {
+				return checkGC(r, caps.supports(level) && level == engine.RepeatableRead)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func checkGC(r schedule.Result, repeatable bool) error {
+	written := []string{"value0", "value1", "value2"}
+	for _, event := range r.Events {
+		if event.Op.Kind != schedule.OpGet || event.Blocked {
+			continue
+		}
+		if event.Err != nil && !errors.Is(event.Err, lock.ErrTimeout) {
+			return fmt.Errorf("%s: version reclaimed while visible", event)
+		}
+		if event.Err == nil && !slices.Contains(written, event.Value) {
+			return fmt.Errorf("%s: never written", event)
+		}
+	}
+
+	first, second := r.Ops[0][0], r.Ops[0][2]
+	if repeatable && first.Err == nil && second.Err == nil && first.Value != second.Value {
+		return fmt.Errorf("expected %q after GC, but got %q", first.Value, second.Value)
+	}
+
+	// 書き込みは排他ロックでコミットまで直列になるので、最後に成功したSetが最新
+	want := "value0"
+	for _, event := range r.Events {
+		if event.Op.Kind == schedule.OpSet && !event.Blocked && event.Err == nil && succeeded(r.Ops[event.Tx], schedule.OpCommit) {
+			want = event.Op.Value
+		}
+	}
+
+	active, _ := r.Engine.GC()
+	if active != 0 {
+		return fmt.Errorf("expected 0 active after all transactions ended, but got %d", active)
+	}
+
+	tx := r.Engine.Begin(engine.ReadCommitted)
+	defer tx.Commit()
+
+	got, err := tx.Get("key")
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("expected %q finally, but got %q", want, got)
+	}
+
+	return nil
+}
+
+func succeeded(events []schedule.Event, kind schedule.OpKind) bool {
+	return slices.ContainsFunc(events, func(e schedule.Event) bool { return e.Op.Kind == kind && e.Err == nil })
+}
+
+func testTimeTravel(t *testing.T, newEngine registry.Factory) {
+	e, ok := newEngine().(engine.TimeTravelEngine)
+	if !ok {
+		t.Fatal("engine does not implement engine.TimeTravelEngine")
+	}
+
+	write(t, e, "key", "value0")
+
+	pinned, err := e.BeginAt(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, e, "key", "value1")
+	e.GC()
+
+	expectGet(t, pinned, "key", "value0")
+	err = pinned.Set("key", "value2")
+	if !errors.Is(err, engine.ErrReadOnly) {
+		t.Errorf("expected %v, but got %v", engine.ErrReadOnly, err)
+	}
+	err = pinned.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := e.BeginAt(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, tx, "key", "value1")
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 保持期間がなければ、誰も見ていない過去はGCで読めなくなる
+	write(t, e, "key", "value2")
+	e.GC()
+	_, err = e.BeginAt(1)
+	if !errors.Is(err, engine.ErrSnapshotTooOld) {
+		t.Errorf("expected %v, but got %v", engine.ErrSnapshotTooOld, err)
+	}
+}
+
+// 多くのトランザクションをGCと混ぜて様々な順序で動かす。保証する分離レベルでは履歴も検査する
+func testStress(t *testing.T, newEngine registry.Factory, caps Capabilities) {
+	for _, level := range hermitage.Levels {
+		t.Run(string(level), func(t *testing.T) {
+			for seed := range uint64(10) {
+				random := Random{Keys: []string{"x", "y", "z"}, Txs: 6, MaxOps: 3, Workload: history.ListAppend, GC: true}
+				scenario := random.Scenario(seed, newEngine, level)
+				err := scenario.Sample(seed, 20, func(r schedule.Result) error {
+					if caps.supports(level) {
+						err := checkHistory(history.ListAppend, level)(r)
+						if err != nil {
+							return err
+						}
+					}
+
+					active, _ := r.Engine.GC()
+					if active != 0 {
+						return fmt.Errorf("expected 0 active after all transactions ended, but got %d", active)
+					}
+
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("seed %d: %v", seed, err)
+				}
+			}
+		})
+	}
+}
+
+// 複数のgoroutineから同時にトランザクションとGCを動かす。保証する分離レベルでは履歴も検査する
+func testConcurrent(t *testing.T, newEngine registry.Factory, caps Capabilities) {
+	const workers, txs = 8, 20
+
+	for _, level := range hermitage.Levels {
+		t.Run(string(level), func(t *testing.T) {
+			// デッドロックはロックのタイムアウトでしか解けないので短くする
+			e := history.NewRecorder(newEngine(engine.WithLockTimeout(5*time.Millisecond)), clock.Real)
+
+			var wg sync.WaitGroup
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					rng := rand.New(rand.NewPCG(uint64(w), 4))
+					for i := range txs {
+						runConcurrentTx(e, rng, level, fmt.Sprintf("%d.%d", w, i))
+					}
+				}()
+			}
+			wg.Wait()
+
+			if caps.supports(level) {
+				err := checkRecorded(e.History(), history.ListAppend, level)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			active, _ := e.GC()
+			if active != 0 {
+				t.Errorf("expected 0 active after all transactions ended, but got %d", active)
+			}
+		})
+	}
+}
+
+// list-appendのトランザクションを1つ動かす。失敗したらAbortする
+func runConcurrentTx(e engine.Engine, rng *rand.Rand, level engine.IsolationLevel, id string) {
+	keys := []string{"x", "y", "z"}
+
+	tx := e.Begin(level)
+	err := func() error {
+		for j := range 1 + rng.IntN(3) {
+			key := keys[rng.IntN(len(keys))]
+
+			switch rng.IntN(4) {
+			case 0:
+				e.GC()
+			case 1:
+				_, err := tx.Get(key)
+				if err != nil && !errors.Is(err, engine.ErrNotFound) {
+					return err
+				}
+			default:
+				list, err := tx.Get(key)
+				if err != nil && !errors.Is(err, engine.ErrNotFound) {
+					return err
+				}
+				if list != "" {
+					list += ","
+				}
+				err = tx.Set(key, list+fmt.Sprintf("%s.%d", id, j))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}()
+	if err != nil {
+		tx.Abort()
+		return
+	}
+	tx.Commit()
+}
@@ -0,0 +1,45 @@
+package enginetest_test
+
+import (
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/enginetest"
+	"testing"
+)
+
+var levels = []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead}
+
+// registryの各エンジンが保証するもの
+var capabilities = map[string]enginetest.Capabilities{
+	// 分離を何も保証しない
+	"naive": {},
+	"locking": {
+		Levels: levels,
+	},
+	"appendonly": {
+		Levels:     levels,
+		TimeTravel: true,
+	},
+	"delta": {
+		Levels:     levels,
+		TimeTravel: true,
+	},
+}
+
+func TestEngines(t *testing.T) {
+	for _, name := range registry.Names() {
+		t.Run(name, func(t *testing.T) {
+			caps, ok := capabilities[name]
+			if !ok {
+				t.Fatalf("capabilities of %q are not declared", name)
+			}
+
+			newEngine, err := registry.Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			enginetest.Run(t, newEngine, caps)
+		})
+	}
+}
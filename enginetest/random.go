@@ -0,0 +1,63 @@
+package enginetest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"mvcc-go/clock"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/history"
+	"mvcc-go/schedule"
+)
+
+// ランダムなトランザクションの組の作り方。書く値はトランザクションと操作の番号から作るので一意になる
+type Random struct {
+	Keys   []string
+	Txs    int
+	MaxOps int // トランザクションあたりの操作数の上限。Registerで読んでから書くのは1操作と数える
+
+	// ListAppendなら書き込みをschedule.Appendに、RegisterならGetしてからSetにする
+	Workload history.Workload
+
+	// ところどころでGCを呼ぶ
+	GC bool
+}
+
+// seedから決まるシナリオ。エンジンをhistory.Recorderで包むので、結果の履歴はRecordedで取り出せる
+func (r Random) Scenario(seed uint64, newEngine registry.Factory, level engine.IsolationLevel) schedule.Scenario {
+	rng := rand.New(rand.NewPCG(seed, 3))
+
+	scripts := make([]schedule.Script, r.Txs)
+	for i := range scripts {
+		ops := make([]schedule.Op, 0)
+		for j := range 1 + rng.IntN(r.MaxOps) {
+			key := r.Keys[rng.IntN(len(r.Keys))]
+			value := fmt.Sprintf("%d.%d", i, j)
+
+			switch {
+			case r.GC && rng.IntN(4) == 0:
+				ops = append(ops, schedule.GC())
+			case rng.IntN(3) == 0:
+				ops = append(ops, schedule.Get(key))
+			case r.Workload == history.ListAppend:
+				ops = append(ops, schedule.Append(key, value))
+			default:
+				ops = append(ops, schedule.Get(key), schedule.Set(key, value))
+			}
+		}
+
+		scripts[i] = schedule.Script{Level: level, Ops: append(ops, schedule.Commit())}
+	}
+
+	return schedule.Scenario{
+		NewEngine: func(opts ...engine.Option) engine.Engine {
+			return history.NewRecorder(newEngine(opts...), clock.Real)
+		},
+		Scripts: scripts,
+	}
+}
+
+// Random.Scenarioを実行した結果の履歴
+func Recorded(r schedule.Result) history.History {
+	return r.Engine.(*history.Recorder).History()
+}
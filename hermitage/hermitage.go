@@ -0,0 +1,271 @@
+// Hermitage (https://github.com/ept/hermitage) の履歴でエンジンが許す異常を調べる
+package hermitage
+
+import (
+	"errors"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/schedule"
+	"slices"
+)
+
+type Outcome string
+
+const (
+	Allowed   Outcome = "allowed"   // 異常が観測された
+	Prevented Outcome = "prevented" // 待たせる・エラーにする・正しい値を返すのいずれかで防いだ
+)
+
+// 履歴の1操作。Txは1始まりで、最初に現れたときに暗黙にBeginする
+type Step struct {
+	Tx int
+	Op schedule.Op
+}
+
+type Anomaly struct {
+	Name        string
+	Description string
+	History     []Step
+
+	// 異常が観測されたか
+	Observed func(r Result) bool
+}
+
+// 全ての履歴は x=10, y=20 から始まる
+var initial = []schedule.Op{schedule.Set("x", "10"), schedule.Set("y", "20")}
+
+var Anomalies = []Anomaly{
+	{
+		Name:        "G0",
+		Description: "dirty write",
+		History: []Step{
+			{1, schedule.Set("x", "11")},
+			{2, schedule.Set("x", "12")},
+			{2, schedule.Set("y", "22")},
+			{1, schedule.Set("y", "21")},
+			{1, schedule.Commit()},
+			{2, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			x, y := r.Final("x"), r.Final("y")
+			return !(x == "11" && y == "21") && !(x == "12" && y == "22")
+		},
+	},
+	{
+		Name:        "G1a",
+		Description: "aborted read",
+		History: []Step{
+			{1, schedule.Set("x", "101")},
+			{2, schedule.Get("x")},
+			{1, schedule.Abort()},
+			{2, schedule.Get("x")},
+			{2, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			return r.Read(2, 0) == "101" || r.Read(2, 1) == "101"
+		},
+	},
+	{
+		Name:        "G1b",
+		Description: "intermediate read",
+		History: []Step{
+			{1, schedule.Set("x", "101")},
+			{2, schedule.Get("x")},
+			{1, schedule.Set("x", "11")},
+			{1, schedule.Commit()},
+			{2, schedule.Get("x")},
+			{2, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			return r.Read(2, 0) == "101" || r.Read(2, 1) == "101"
+		},
+	},
+	{
+		Name:        "G1c",
+		Description: "circular information flow",
+		History: []Step{
+			{1, schedule.Set("x", "11")},
+			{2, schedule.Set("y", "22")},
+			{1, schedule.Get("y")},
+			{2, schedule.Get("x")},
+			{1, schedule.Commit()},
+			{2, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			return r.Read(1, 1) == "22" && r.Read(2, 1) == "11"
+		},
+	},
+	{
+		Name:        "P4",
+		Description: "lost update",
+		History: []Step{
+			{1, schedule.Get("x")},
+			{2, schedule.Get("x")},
+			{1, schedule.Set("x", "11")},
+			{2, schedule.Set("x", "11")},
+			{1, schedule.Commit()},
+			{2, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			return r.Succeeded(1) && r.Succeeded(2) && r.Read(1, 0) == "10" && r.Read(2, 0) == "10"
+		},
+	},
+	{
+		Name:        "G-single",
+		Description: "read skew",
+		History: []Step{
+			{1, schedule.Get("x")},
+			{2, schedule.Get("x")},
+			{2, schedule.Get("y")},
+			{2, schedule.Set("x", "12")},
+			{2, schedule.Set("y", "18")},
+			{2, schedule.Commit()},
+			{1, schedule.Get("y")},
+			{1, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			return r.Read(1, 0) == "10" && r.Read(1, 1) == "18"
+		},
+	},
+	{
+		Name:        "G2-item",
+		Description: "write skew",
+		History: []Step{
+			{1, schedule.Get("x")},
+			{1, schedule.Get("y")},
+			{2, schedule.Get("x")},
+			{2, schedule.Get("y")},
+			{1, schedule.Set("x", "11")},
+			{2, schedule.Set("y", "21")},
+			{1, schedule.Commit()},
+			{2, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			return r.Succeeded(1) && r.Succeeded(2) &&
+				r.Read(1, 0) == "10" && r.Read(1, 1) == "20" && r.Read(2, 0) == "10" && r.Read(2, 1) == "20"
+		},
+	},
+	{
+		// 範囲検索がないので、存在しないキーを述語とみなして挿入が見えるかを調べる
+		Name:        "phantom",
+		Description: "phantom read of an inserted key",
+		History: []Step{
+			{1, schedule.Get("z")},
+			{2, schedule.Set("z", "30")},
+			{2, schedule.Commit()},
+			{1, schedule.Get("z")},
+			{1, schedule.Commit()},
+		},
+		Observed: func(r Result) bool {
+			first, second := r.Ops[0][0], r.Ops[0][1]
+			return errors.Is(first.Err, engine.ErrNotFound) && second.Err == nil
+		},
+	},
+}
+
+type Result struct {
+	schedule.Result
+}
+
+// txのn番目の操作で読んだ値。エラーなら空文字列
+func (r Result) Read(tx, n int) string {
+	event := r.Ops[tx-1][n]
+	if event.Err != nil {
+		return ""
+	}
+
+	return event.Value
+}
+
+// txの操作が全て成功したか
+func (r Result) Succeeded(tx int) bool {
+	return !slices.ContainsFunc(r.Ops[tx-1], func(e schedule.Event) bool { return e.Err != nil })
+}
+
+// 全て終わった後の値
+func (r Result) Final(key string) string {
+	tx := r.Engine.Begin(engine.ReadCommitted)
+	defer tx.Commit()
+
+	value, err := tx.Get(key)
+	if err != nil {
+		return ""
+	}
+
+	return value
+}
+
+func (a Anomaly) scenario(newEngine func(opts ...engine.Option) engine.Engine, level engine.IsolationLevel) (schedule.Scenario, schedule.Schedule) {
+	scripts := make([]schedule.Script, 0)
+	order := make(schedule.Schedule, 0, len(a.History))
+	for _, step := range a.History {
+		i := step.Tx - 1
+		for len(scripts) <= i {
+			scripts = append(scripts, schedule.Script{Level: level})
+		}
+
+		if len(scripts[i].Ops) == 0 {
+			order = append(order, i) // Begin
+		}
+		scripts[i].Ops = append(scripts[i].Ops, step.Op)
+		order = append(order, i)
+	}
+
+	return schedule.Scenario{
+		NewEngine: newEngine,
+		Setup: func(e engine.Engine) error {
+			tx := e.Begin(engine.RepeatableRead)
+			for _, op := range initial {
+				err := tx.Set(op.Key, op.Value)
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		},
+		Scripts: scripts,
+	}, order
+}
+
+// 履歴の順に実行する。ロック待ちになったトランザクションの操作は再開するまで後回しになる
+func (a Anomaly) Run(newEngine func(opts ...engine.Option) engine.Engine, level engine.IsolationLevel) (Outcome, Result, error) {
+	scenario, order := a.scenario(newEngine, level)
+
+	result, err := scenario.Follow(order)
+	if err != nil {
+		return "", Result{}, fmt.Errorf("%s: %w", a.Name, err)
+	}
+
+	r := Result{result}
+	if a.Observed(r) {
+		return Allowed, r, nil
+	}
+
+	return Prevented, r, nil
+}
+
+// engine -> isolation level -> anomaly -> outcome
+type Matrix map[string]map[engine.IsolationLevel]map[string]Outcome
+
+var Levels = []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead}
+
+// 全てのエンジンと分離レベルで全ての履歴を実行する
+func Check(engines map[string]func(opts ...engine.Option) engine.Engine) (Matrix, error) {
+	matrix := make(Matrix, len(engines))
+	for name, newEngine := range engines {
+		matrix[name] = make(map[engine.IsolationLevel]map[string]Outcome, len(Levels))
+		for _, level := range Levels {
+			matrix[name][level] = make(map[string]Outcome, len(Anomalies))
+			for _, anomaly := range Anomalies {
+				outcome, _, err := anomaly.Run(newEngine, level)
+				if err != nil {
+					return nil, fmt.Errorf("%s %s: %w", name, level, err)
+				}
+
+				matrix[name][level][anomaly.Name] = outcome
+			}
+		}
+	}
+
+	return matrix, nil
+}
@@ -0,0 +1,66 @@
+package hermitage_test
+
+import (
+	"encoding/json"
+	"flag"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/hermitage"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update testdata/matrix.json")
+
+// testdata/matrix.jsonがregistryの各エンジンの許す異常の仕様
+func TestMatrix(t *testing.T) {
+	engines := make(map[string]func(opts ...engine.Option) engine.Engine)
+	for _, name := range registry.Names() {
+		newEngine, err := registry.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		engines[name] = newEngine
+	}
+
+	got, err := hermitage.Check(engines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		b, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile("testdata/matrix.json", append(b, '\n'), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile("testdata/matrix.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want hermitage.Matrix
+	err = json.Unmarshal(b, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, newEngine := range engines {
+		for _, level := range hermitage.Levels {
+			for _, anomaly := range hermitage.Anomalies {
+				if got[name][level][anomaly.Name] == want[name][level][anomaly.Name] {
+					continue
+				}
+
+				_, result, _ := anomaly.Run(newEngine, level)
+				t.Errorf("%s %s %s (%s): expected %q, but got %q\n%s",
+					name, level, anomaly.Name, anomaly.Description,
+					want[name][level][anomaly.Name], got[name][level][anomaly.Name], result.Trace())
+			}
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package history
+
+import (
+	"cmp"
+	"fmt"
+	"mvcc-go/engine"
+	"slices"
+	"strings"
+)
+
+type Workload string
+
+const (
+	// 値はキーごとに一意。書く前に同じキーを読んでいれば、読んだ版の次の版とみなす
+	Register Workload = "register"
+
+	// 値は","区切りのリストで、書くたびに一意な要素を末尾に足す。リストから版の順序がわかる
+	ListAppend Workload = "list-append"
+)
+
+// Adyaの分類に、版の順序やありえない値についての異常を加えたもの
+const (
+	GarbageRead  = "garbage-read"  // 誰も書いていない値を読んだ
+	G0           = "G0"            // wwだけの循環
+	G1a          = "G1a"           // コミットしていない書き込みを読んだ
+	G1b          = "G1b"           // 最後ではない書き込みを読んだ
+	G1c          = "G1c"           // ww・wrだけの循環
+	LostUpdate   = "lost-update"   // 同じ版を2つのトランザクションが上書きした
+	GSingle      = "G-single"      // rwを1つだけ含む循環
+	GNonadjacent = "G-nonadjacent" // 隣り合わないrwを2つ以上含む循環
+)
+
+// levelで禁止する異常。RepeatableReadはスナップショット分離なのでwrite skewは許す
+func Forbidden(level engine.IsolationLevel) []string {
+	forbidden := []string{GarbageRead, G0, G1a, G1b, G1c}
+	if level == engine.RepeatableRead {
+		forbidden = append(forbidden, LostUpdate, GSingle, GNonadjacent)
+	}
+
+	return forbidden
+}
+
+type EdgeType string
+
+const (
+	WW EdgeType = "ww" // Fromが書いた版をToが上書きした
+	WR EdgeType = "wr" // Fromが書いた版をToが読んだ
+	RW EdgeType = "rw" // Fromが読んだ版をToが上書きした
+)
+
+type Edge struct {
+	From int
+	To   int
+	Type EdgeType
+	Key  string
+}
+
+type Anomaly struct {
+	Type  string
+	Cycle []Edge // 循環による異常のとき
+	Ops   []Op   // 反例に関わる操作
+}
+
+func (a Anomaly) String() string {
+	var b strings.Builder
+	b.WriteString(a.Type)
+
+	if len(a.Cycle) > 0 {
+		fmt.Fprintf(&b, ": T%d", a.Cycle[0].From)
+		for _, e := range a.Cycle {
+			fmt.Fprintf(&b, " -%s(%s)-> T%d", e.Type, e.Key, e.To)
+		}
+	}
+
+	for _, op := range a.Ops {
+		fmt.Fprintf(&b, "\n  %s", op)
+	}
+
+	return b.String()
+}
+
+type Report struct {
+	Level     engine.IsolationLevel
+	Anomalies []Anomaly // Levelで禁止されているものだけ
+}
+
+func (r Report) Valid() bool {
+	return len(r.Anomalies) == 0
+}
+
+func (r Report) String() string {
+	if r.Valid() {
+		return fmt.Sprintf("%s: valid", r.Level)
+	}
+
+	lines := make([]string, len(r.Anomalies))
+	for i, a := range r.Anomalies {
+		lines[i] = a.String()
+	}
+
+	return fmt.Sprintf("%s: %d anomalies\n%s", r.Level, len(r.Anomalies), strings.Join(lines, "\n"))
+}
+
+// 履歴から依存グラフを作り、levelで禁止されている異常を探す。循環は種類ごとに最短のものを1つ報告する
+func Check(h History, workload Workload, level engine.IsolationLevel) (Report, error) {
+	c := newChecker(h, workload)
+
+	err := c.indexWrites()
+	if err != nil {
+		return Report{}, err
+	}
+
+	c.inferVersionOrder()
+	c.checkReads()
+	c.addWWEdges()
+	c.findCycles()
+
+	report := Report{Level: level, Anomalies: make([]Anomaly, 0)}
+	forbidden := Forbidden(level)
+	for _, a := range c.anomalies {
+		if slices.Contains(forbidden, a.Type) {
+			report.Anomalies = append(report.Anomalies, a)
+		}
+	}
+
+	return report, nil
+}
+
+// 値が""の版は初期値（キーが存在しない、空のリスト）
+type version struct {
+	key   string
+	value string
+}
+
+type write struct {
+	tx    int
+	final bool // トランザクションの中でそのキーへの最後の書き込み
+	op    Op
+}
+
+type txn struct {
+	committed bool
+	ops       []Op // 成功したGetとSet
+}
+
+type checker struct {
+	history   History
+	workload  Workload
+	txs       map[int]*txn
+	ids       []int
+	writes    map[version]write
+	prev      map[version]version   // コミットされた版 -> 直前の版
+	next      map[version][]version // 版 -> 直後の版
+	edges     map[int][]Edge
+	anomalies []Anomaly
+}
+
+func newChecker(h History, workload Workload) *checker {
+	c := &checker{
+		history:  h,
+		workload: workload,
+		txs:      make(map[int]*txn),
+		writes:   make(map[version]write),
+		prev:     make(map[version]version),
+		next:     make(map[version][]version),
+		edges:    make(map[int][]Edge),
+	}
+
+	for _, op := range h {
+		t, ok := c.txs[op.Tx]
+		if !ok {
+			t = &txn{}
+			c.txs[op.Tx] = t
+			c.ids = append(c.ids, op.Tx)
+		}
+
+		if !op.OK() {
+			continue
+		}
+
+		switch op.Kind {
+		case KindGet, KindSet:
+			t.ops = append(t.ops, op)
+		case KindCommit:
+			t.committed = true
+		}
+	}
+	slices.Sort(c.ids)
+
+	return c
+}
+
+func (c *checker) committed(txID int) bool {
+	return c.txs[txID].committed
+}
+
+func (c *checker) indexWrites() error {
+	for _, id := range c.ids {
+		last := make(map[string]version)
+		for _, op := range c.txs[id].ops {
+			if op.Kind != KindSet {
+				continue
+			}
+
+			v := version{op.Key, op.Value}
+			if v.value == "" {
+				return fmt.Errorf("empty write: %s", op)
+			}
+			if w, ok := c.writes[v]; ok {
+				return fmt.Errorf("duplicate write: %s and %s", w.op, op)
+			}
+
+			c.writes[v] = write{tx: id, op: op}
+			last[op.Key] = v
+		}
+
+		for _, v := range last {
+			w := c.writes[v]
+			w.final = true
+			c.writes[v] = w
+		}
+	}
+
+	return nil
+}
+
+func readVersion(op Op) version {
+	if op.NotFound {
+		return version{key: op.Key}
+	}
+
+	return version{op.Key, op.Value}
+}
+
+func (c *checker) inferVersionOrder() {
+	for _, id := range c.ids {
+		if !c.committed(id) {
+			continue
+		}
+
+		// 書く前に最後に読んだ他のトランザクションの版
+		read := make(map[string]version)
+		before := make(map[string]version)
+		for _, op := range c.txs[id].ops {
+			switch op.Kind {
+			case KindGet:
+				v := readVersion(op)
+				if w, ok := c.writes[v]; ok && w.tx == id {
+					continue
+				}
+				read[op.Key] = v
+			case KindSet:
+				if _, ok := before[op.Key]; ok {
+					continue
+				}
+				if v, ok := read[op.Key]; ok {
+					before[op.Key] = v
+				}
+			}
+		}
+
+		for _, op := range c.txs[id].ops {
+			v := version{op.Key, op.Value}
+			if op.Kind != KindSet || !c.writes[v].final {
+				continue
+			}
+
+			p, ok := c.previous(id, v, before)
+			if !ok {
+				continue // 順序がわからない
+			}
+
+			c.prev[v] = p
+			c.next[p] = append(c.next[p], v)
+		}
+	}
+
+	for _, p := range sortedVersions(c.next) {
+		if len(c.next[p]) < 2 {
+			continue
+		}
+
+		ops := make([]Op, 0, len(c.next[p]))
+		for _, v := range c.next[p] {
+			ops = append(ops, c.writes[v].op)
+		}
+		c.anomalies = append(c.anomalies, Anomaly{Type: LostUpdate, Ops: ops})
+	}
+}
+
+func (c *checker) previous(txID int, v version, before map[string]version) (version, bool) {
+	if c.workload == Register {
+		p, ok := before[v.key]
+		return p, ok
+	}
+
+	// 自分が途中で足した要素を取り除いた最長のリスト
+	elements := strings.Split(v.value, ",")
+	for i := len(elements) - 1; i > 0; i-- {
+		p := version{v.key, strings.Join(elements[:i], ",")}
+		if w, ok := c.writes[p]; !ok || w.tx != txID {
+			return p, true
+		}
+	}
+
+	return version{key: v.key}, true
+}
+
+func (c *checker) checkReads() {
+	for _, id := range c.ids {
+		if !c.committed(id) {
+			continue
+		}
+
+		for _, op := range c.txs[id].ops {
+			if op.Kind != KindGet {
+				continue
+			}
+
+			v := readVersion(op)
+			if v.value != "" {
+				w, ok := c.writes[v]
+				switch {
+				case !ok:
+					c.anomalies = append(c.anomalies, Anomaly{Type: GarbageRead, Ops: []Op{op}})
+					continue
+				case w.tx == id:
+					continue // 自分の書き込み
+				case !c.committed(w.tx):
+					c.anomalies = append(c.anomalies, Anomaly{Type: G1a, Ops: []Op{w.op, op}})
+					continue
+				case !w.final:
+					c.anomalies = append(c.anomalies, Anomaly{Type: G1b, Ops: []Op{w.op, op}})
+					continue
+				}
+
+				c.addEdge(Edge{From: w.tx, To: id, Type: WR, Key: v.key})
+			}
+
+			for _, n := range c.next[v] {
+				c.addEdge(Edge{From: id, To: c.writes[n].tx, Type: RW, Key: v.key})
+			}
+		}
+	}
+}
+
+func (c *checker) addWWEdges() {
+	for _, v := range sortedVersions(c.prev) {
+		p := c.prev[v]
+		w, ok := c.writes[p]
+		if !ok || !c.committed(w.tx) || !w.final {
+			continue // 初期値か、読んだ時点で異常として報告済み
+		}
+
+		c.addEdge(Edge{From: w.tx, To: c.writes[v].tx, Type: WW, Key: v.key})
+	}
+}
+
+func (c *checker) addEdge(e Edge) {
+	if e.From == e.To {
+		return
+	}
+
+	for _, existing := range c.edges[e.From] {
+		if existing.To == e.To && existing.Type == e.Type {
+			return
+		}
+	}
+
+	c.edges[e.From] = append(c.edges[e.From], e)
+}
+
+func sortedVersions[V any](m map[version]V) []version {
+	versions := make([]version, 0, len(m))
+	for v := range m {
+		versions = append(versions, v)
+	}
+	slices.SortFunc(versions, func(a, b version) int {
+		return cmp.Or(cmp.Compare(a.key, b.key), cmp.Compare(a.value, b.value))
+	})
+
+	return versions
+}
+
+// 循環を辿っている途中の状態
+type pathState struct {
+	node   int
+	lastRW bool
+	rws    int // 2で頭打ち
+	wr     bool
+}
+
+func (s pathState) next(e Edge) pathState {
+	n := pathState{node: e.To, lastRW: e.Type == RW, rws: s.rws, wr: s.wr || e.Type == WR}
+	if e.Type == RW {
+		n.rws = min(2, n.rws+1)
+	}
+
+	return n
+}
+
+type cycleClass struct {
+	name   string
+	allow  func(s pathState, e Edge) bool     // 辺を辿れるか
+	accept func(first Edge, s pathState) bool // 始点に戻ったときに循環として認めるか
+}
+
+var cycleClasses = []cycleClass{
+	{
+		name:   G0,
+		allow:  func(s pathState, e Edge) bool { return e.Type == WW },
+		accept: func(first Edge, s pathState) bool { return true },
+	},
+	{
+		name:   G1c,
+		allow:  func(s pathState, e Edge) bool { return e.Type != RW },
+		accept: func(first Edge, s pathState) bool { return s.wr },
+	},
+	{
+		name:   GSingle,
+		allow:  func(s pathState, e Edge) bool { return e.Type != RW || s.rws == 0 },
+		accept: func(first Edge, s pathState) bool { return s.rws == 1 },
+	},
+	{
+		name:   GNonadjacent,
+		allow:  func(s pathState, e Edge) bool { return e.Type != RW || !s.lastRW },
+		accept: func(first Edge, s pathState) bool { return s.rws == 2 && !(first.Type == RW && s.lastRW) },
+	},
+}
+
+func (c *checker) findCycles() {
+	for _, class := range cycleClasses {
+		cycle := c.shortestCycle(class)
+		if cycle == nil {
+			continue
+		}
+
+		txIDs := make([]int, len(cycle))
+		for i, e := range cycle {
+			txIDs[i] = e.From
+		}
+		c.anomalies = append(c.anomalies, Anomaly{Type: class.name, Cycle: cycle, Ops: c.opsOf(txIDs)})
+	}
+}
+
+func (c *checker) shortestCycle(class cycleClass) []Edge {
+	var best []Edge
+	for _, from := range c.ids {
+		for _, first := range c.edges[from] {
+			start := pathState{node: from}
+			if !class.allow(start, first) {
+				continue
+			}
+
+			cycle := c.bfs(class, first, start.next(first))
+			if cycle != nil && (best == nil || len(cycle) < len(best)) {
+				best = cycle
+			}
+		}
+	}
+
+	return best
+}
+
+// firstを辿った後の状態から始点に戻る最短の経路を探す
+func (c *checker) bfs(class cycleClass, first Edge, start pathState) []Edge {
+	type visit struct {
+		parent pathState
+		edge   Edge
+	}
+
+	visited := map[pathState]visit{start: {}}
+	queue := []pathState{start}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		if s.node == first.From {
+			if !class.accept(first, s) {
+				continue
+			}
+
+			cycle := make([]Edge, 0)
+			for ; s != start; s = visited[s].parent {
+				cycle = append(cycle, visited[s].edge)
+			}
+			cycle = append(cycle, first)
+			slices.Reverse(cycle)
+
+			return cycle
+		}
+
+		for _, e := range c.edges[s.node] {
+			if !class.allow(s, e) {
+				continue
+			}
+
+			n := s.next(e)
+			if _, ok := visited[n]; ok {
+				continue
+			}
+
+			visited[n] = visit{parent: s, edge: e}
+			queue = append(queue, n)
+		}
+	}
+
+	return nil
+}
+
+// txIDsのトランザクションの操作を履歴の順に返す
+func (c *checker) opsOf(txIDs []int) []Op {
+	ops := make([]Op, 0)
+	for _, op := range c.history {
+		if slices.Contains(txIDs, op.Tx) {
+			ops = append(ops, op)
+		}
+	}
+
+	return ops
+}
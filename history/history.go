@@ -0,0 +1,102 @@
+// エンジンへの操作を記録し、記録した履歴が分離レベルを満たしているか検査する
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mvcc-go/engine"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindBegin  Kind = "begin"
+	KindGet    Kind = "get"
+	KindSet    Kind = "set"
+	KindCommit Kind = "commit"
+	KindAbort  Kind = "abort"
+)
+
+// 1回の呼び出し。Txは記録した順に1から振った番号でエンジンのtxIDとは関係ない
+type Op struct {
+	Tx       int                   `json:"tx"`
+	Kind     Kind                  `json:"kind"`
+	Level    engine.IsolationLevel `json:"level,omitempty"`
+	Key      string                `json:"key,omitempty"`
+	Value    string                `json:"value,omitempty"`
+	NotFound bool                  `json:"not_found,omitempty"`
+	Err      string                `json:"err,omitempty"`
+	Invoke   time.Time             `json:"invoke"`
+	Complete time.Time             `json:"complete"`
+}
+
+func (o Op) OK() bool {
+	return o.Err == ""
+}
+
+func (o Op) String() string {
+	s := fmt.Sprintf("T%d %s", o.Tx, o.Kind)
+	switch o.Kind {
+	case KindBegin:
+		s += " " + string(o.Level)
+	case KindGet:
+		s += " " + o.Key
+		if o.OK() {
+			if o.NotFound {
+				s += " -> not found"
+			} else {
+				s += fmt.Sprintf(" -> %q", o.Value)
+			}
+		}
+	case KindSet:
+		s += fmt.Sprintf(" %s=%q", o.Key, o.Value)
+	}
+
+	if !o.OK() {
+		s += " -> error: " + o.Err
+	}
+
+	return s
+}
+
+// 完了した順に並ぶ
+type History []Op
+
+// 1行に1つのJSONで書き出す
+func (h History) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, op := range h {
+		b, err := json.Marshal(op)
+		if err != nil {
+			return n, err
+		}
+
+		m, err := w.Write(append(b, '\n'))
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func Read(r io.Reader) (History, error) {
+	h := make(History, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var op Op
+		err := json.Unmarshal(scanner.Bytes(), &op)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", len(h)+1, err)
+		}
+
+		h = append(h, op)
+	}
+
+	return h, scanner.Err()
+}
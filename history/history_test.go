@@ -0,0 +1,237 @@
+package history_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/enginetest"
+	"mvcc-go/history"
+	"mvcc-go/schedule"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedから決まるランダムなトランザクションの組
+func randomScenario(t *testing.T, seed uint64, name string, level engine.IsolationLevel, workload history.Workload) schedule.Scenario {
+	t.Helper()
+
+	newEngine, err := registry.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := enginetest.Random{Keys: []string{"x", "y", "z"}, Txs: 2 + int(seed%3), MaxOps: 3, Workload: workload}
+
+	return random.Scenario(seed, newEngine, level)
+}
+
+// 失敗したら履歴をファイルに書き出してエラーにする
+func check(t *testing.T, workload history.Workload, level engine.IsolationLevel) func(r schedule.Result) error {
+	return func(r schedule.Result) error {
+		h := enginetest.Recorded(r)
+
+		report, err := history.Check(h, workload, level)
+		if err != nil {
+			return err
+		}
+		if report.Valid() {
+			return nil
+		}
+
+		path := filepath.Join(t.TempDir(), "history.jsonl")
+		var b bytes.Buffer
+		_, _ = h.WriteTo(&b)
+		_ = os.WriteFile(path, b.Bytes(), 0o644)
+
+		return fmt.Errorf("%s\nhistory: %s", report, path)
+	}
+}
+
+func TestRandomHistories(t *testing.T) {
+	cases := []struct {
+		engine string
+		level  engine.IsolationLevel
+	}{
+		{engine: "locking", level: engine.ReadCommitted},
+		{engine: "locking", level: engine.RepeatableRead},
+		{engine: "appendonly", level: engine.ReadCommitted},
+		{engine: "appendonly", level: engine.RepeatableRead},
+		{engine: "delta", level: engine.ReadCommitted},
+		{engine: "delta", level: engine.RepeatableRead},
+	}
+
+	for _, c := range cases {
+		for _, workload := range []history.Workload{history.Register, history.ListAppend} {
+			t.Run(fmt.Sprintf("%s_%s_%s", c.engine, c.level, workload), func(t *testing.T) {
+				for seed := range uint64(30) {
+					scenario := randomScenario(t, seed, c.engine, c.level, workload)
+					err := scenario.Sample(seed, 20, check(t, workload, c.level))
+					if err != nil {
+						t.Fatalf("seed %d: %v", seed, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// 検査が甘くないことを確かめるために、満たさないはずの分離レベルで検査する
+func TestRandomHistoriesFindAnomalies(t *testing.T) {
+	cases := []struct {
+		engine  string
+		level   engine.IsolationLevel
+		claimed engine.IsolationLevel
+	}{
+		{engine: "naive", level: engine.ReadCommitted, claimed: engine.ReadCommitted},
+		{engine: "naive", level: engine.RepeatableRead, claimed: engine.RepeatableRead},
+		{engine: "appendonly", level: engine.ReadCommitted, claimed: engine.RepeatableRead},
+		{engine: "delta", level: engine.ReadCommitted, claimed: engine.RepeatableRead},
+	}
+
+	for _, c := range cases {
+		for _, workload := range []history.Workload{history.Register, history.ListAppend} {
+			t.Run(fmt.Sprintf("%s_%s_%s", c.engine, c.level, workload), func(t *testing.T) {
+				for seed := range uint64(30) {
+					scenario := randomScenario(t, seed, c.engine, c.level, workload)
+					err := scenario.Sample(seed, 20, check(t, workload, c.claimed))
+
+					var failure *schedule.Failure
+					if errors.As(err, &failure) {
+						t.Log(failure)
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				t.Errorf("expected anomalies violating %s", c.claimed)
+			})
+		}
+	}
+}
+
+// 同じ版を読んだ2つのトランザクションがどちらも上書きしてコミットする
+func TestCheckLostUpdate(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	op := func(tx int, kind history.Kind, key, value string) history.Op {
+		at = at.Add(time.Second)
+		return history.Op{Tx: tx, Kind: kind, Key: key, Value: value, Invoke: at, Complete: at}
+	}
+
+	h := history.History{
+		op(1, history.KindBegin, "", ""),
+		op(1, history.KindSet, "x", "x0"),
+		op(1, history.KindCommit, "", ""),
+		op(2, history.KindBegin, "", ""),
+		op(3, history.KindBegin, "", ""),
+		op(2, history.KindGet, "x", "x0"),
+		op(3, history.KindGet, "x", "x0"),
+		op(2, history.KindSet, "x", "x2"),
+		op(2, history.KindCommit, "", ""),
+		op(3, history.KindSet, "x", "x3"),
+		op(3, history.KindCommit, "", ""),
+	}
+
+	report, err := history.Check(h, history.Register, engine.ReadCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() {
+		t.Errorf("expected valid under read committed, but got %s", report)
+	}
+
+	report, err = history.Check(h, history.Register, engine.RepeatableRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(report)
+
+	types := make([]string, len(report.Anomalies))
+	for i, a := range report.Anomalies {
+		types[i] = a.Type
+	}
+	if !slices.Contains(types, history.LostUpdate) {
+		t.Fatalf("expected %s, but got %s", history.LostUpdate, report)
+	}
+	for _, a := range report.Anomalies {
+		if a.Type == history.LostUpdate && (len(a.Ops) != 2 || a.Ops[0].Value != "x2" || a.Ops[1].Value != "x3") {
+			t.Errorf("expected the writes of T2 and T3, but got %s", a)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	op := func(tx int, kind history.Kind, key, value string) history.Op {
+		at = at.Add(time.Second)
+		return history.Op{Tx: tx, Kind: kind, Key: key, Value: value, Invoke: at, Complete: at}
+	}
+
+	// G-single（read skew）: T3が初期値を書いた後、T1はT2がyを書く前のxと書いた後のyを読む
+	h := history.History{
+		op(3, history.KindBegin, "", ""),
+		op(3, history.KindSet, "x", "x0"),
+		op(3, history.KindSet, "y", "y0"),
+		op(3, history.KindCommit, "", ""),
+		op(1, history.KindBegin, "", ""),
+		op(1, history.KindGet, "x", "x0"),
+		op(2, history.KindBegin, "", ""),
+		op(2, history.KindGet, "x", "x0"),
+		op(2, history.KindSet, "x", "x1"),
+		op(2, history.KindGet, "y", "y0"),
+		op(2, history.KindSet, "y", "y1"),
+		op(2, history.KindCommit, "", ""),
+		op(1, history.KindGet, "y", "y1"),
+		op(1, history.KindCommit, "", ""),
+	}
+
+	report, err := history.Check(h, history.Register, engine.ReadCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() {
+		t.Errorf("expected valid under read committed, but got %s", report)
+	}
+
+	report, err = history.Check(h, history.Register, engine.RepeatableRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(report)
+
+	if len(report.Anomalies) != 1 {
+		t.Fatalf("expected 1 anomaly, but got %s", report)
+	}
+	got := report.Anomalies[0]
+	want := []history.Edge{
+		{From: 1, To: 2, Type: history.RW, Key: "x"},
+		{From: 2, To: 1, Type: history.WR, Key: "y"},
+	}
+	if got.Type != history.GSingle || !reflect.DeepEqual(got.Cycle, want) {
+		t.Errorf("expected G-single %v, but got %s", want, got)
+	}
+	if !strings.HasPrefix(got.String(), "G-single: T1 -rw(x)-> T2 -wr(y)-> T1") {
+		t.Errorf("unexpected string: %s", got)
+	}
+
+	// 履歴はファイルに書き出して読み戻せる
+	var b bytes.Buffer
+	_, err = h.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := history.Read(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, h) {
+		t.Errorf("expected %v, but got %v", h, read)
+	}
+}
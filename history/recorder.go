@@ -0,0 +1,117 @@
+package history
+
+import (
+	"errors"
+	"mvcc-go/clock"
+	"mvcc-go/engine"
+	"slices"
+	"sync"
+)
+
+var _ engine.Engine = &Recorder{}
+
+// エンジンを包んで、Begin・Get・Set・Commit・Abortを呼び出しと完了の時刻とともに記録する
+type Recorder struct {
+	engine engine.Engine
+	clock  clock.Clock
+	mu     sync.Mutex
+	lastTx int
+	ops    History
+}
+
+func NewRecorder(e engine.Engine, c clock.Clock) *Recorder {
+	return &Recorder{
+		engine: e,
+		clock:  c,
+		ops:    make(History, 0),
+	}
+}
+
+func (r *Recorder) Begin(level engine.IsolationLevel, opts ...engine.TxOption) engine.Tx {
+	invoke := r.clock.Now()
+	inner := r.engine.Begin(level, opts...)
+
+	r.mu.Lock()
+	r.lastTx++
+	t := &tx{id: r.lastTx, tx: inner, recorder: r}
+	r.mu.Unlock()
+
+	r.record(Op{Tx: t.id, Kind: KindBegin, Level: level, Invoke: invoke})
+
+	return t
+}
+
+func (r *Recorder) GC() (active, removed int) {
+	return r.engine.GC()
+}
+
+func (r *Recorder) History() History {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.ops)
+}
+
+func (r *Recorder) record(op Op) {
+	op.Complete = r.clock.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ops = append(r.ops, op)
+}
+
+type tx struct {
+	id       int
+	tx       engine.Tx
+	recorder *Recorder
+}
+
+func (t *tx) Get(key string) (string, error) {
+	op := Op{Tx: t.id, Kind: KindGet, Key: key, Invoke: t.recorder.clock.Now()}
+
+	value, err := t.tx.Get(key)
+	switch {
+	case errors.Is(err, engine.ErrNotFound):
+		op.NotFound = true
+	case err != nil:
+		op.Err = err.Error()
+	default:
+		op.Value = value
+	}
+	t.recorder.record(op)
+
+	return value, err
+}
+
+func (t *tx) Set(key, value string) error {
+	op := Op{Tx: t.id, Kind: KindSet, Key: key, Value: value, Invoke: t.recorder.clock.Now()}
+
+	err := t.tx.Set(key, value)
+	if err != nil {
+		op.Err = err.Error()
+	}
+	t.recorder.record(op)
+
+	return err
+}
+
+func (t *tx) Commit() error {
+	return t.end(KindCommit, t.tx.Commit)
+}
+
+func (t *tx) Abort() error {
+	return t.end(KindAbort, t.tx.Abort)
+}
+
+func (t *tx) end(kind Kind, f func() error) error {
+	op := Op{Tx: t.id, Kind: kind, Invoke: t.recorder.clock.Now()}
+
+	err := f()
+	if err != nil {
+		op.Err = err.Error()
+	}
+	t.recorder.record(op)
+
+	return err
+}
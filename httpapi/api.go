@@ -0,0 +1,112 @@
+// エンジンをHTTP/JSONで他の言語のサービスから使えるようにする。
+//
+//	POST /tx                      {"level": "repeatable_read"} -> 201 {"id": "..."}
+//	GET  /tx/{id}/keys/{key}      -> 200 {"value": "..."}
+//	PUT  /tx/{id}/keys/{key}      {"value": "..."} -> 204
+//	POST /tx/{id}/commit          -> 204
+//	POST /tx/{id}/abort           -> 204
+//	POST /gc                      -> 200 {"active": 1, "removed": 2}
+//	GET  /stats                   -> 200
+//
+// 期限切れとServer.Closeではトランザクションをアボートする。
+// エラーは{"code": "...", "error": "..."}で返す。codeとステータスはcodesを参照
+package httpapi
+
+import (
+	"errors"
+	"mvcc-go/engine"
+	"mvcc-go/lock"
+	"net/http"
+)
+
+var ErrUnknownTx = errors.New("unknown or expired transaction")
+
+type BeginRequest struct {
+	Level engine.IsolationLevel `json:"level"`
+	// 0ならサーバーのエンジンの設定。負ならロックを取れるまで待つ
+	LockTimeoutMillis int `json:"lock_timeout_ms,omitempty"`
+}
+
+type BeginResponse struct {
+	ID    string                `json:"id"`
+	Level engine.IsolationLevel `json:"level"`
+}
+
+type GetResponse struct {
+	Value string `json:"value"`
+}
+
+type SetRequest struct {
+	Value string `json:"value"`
+}
+
+type GCResponse struct {
+	Active  int `json:"active"`
+	Removed int `json:"removed"`
+}
+
+type Stats struct {
+	Open      int `json:"open"` // 実行中のトランザクション
+	Began     int `json:"began"`
+	Committed int `json:"committed"`
+	Aborted   int `json:"aborted"`
+	Expired   int `json:"expired"` // 放置されて終わらせたトランザクション
+	// StatsEngineのときだけ
+	ChainLengths   map[string]int `json:"chain_lengths,omitempty"`
+	UndoLogRecords int            `json:"undo_log_records,omitempty"`
+}
+
+type code struct {
+	name   string
+	status int
+	err    error
+}
+
+// errors.Isで判定できるエラーとレスポンスの対応。上から順に調べる
+var codes = []code{
+	{"not_found", http.StatusNotFound, engine.ErrNotFound},
+	{"unknown_tx", http.StatusNotFound, ErrUnknownTx},
+	{"serialization_failure", http.StatusConflict, engine.ErrSerialization},
+	{"lock_timeout", http.StatusConflict, lock.ErrTimeout},
+	{"read_only", http.StatusForbidden, engine.ErrReadOnly},
+}
+
+// レスポンスのエラー。codeが分かればUnwrapで元のエラーになる
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	for _, c := range codes {
+		if c.name == e.Code {
+			return c.err
+		}
+	}
+
+	return nil
+}
+
+func newError(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return &Error{Status: c.status, Code: c.name, Message: err.Error()}
+		}
+	}
+
+	return &Error{Status: http.StatusInternalServerError, Code: "internal", Message: err.Error()}
+}
+
+func badRequest(err error) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: "bad_request", Message: err.Error()}
+}
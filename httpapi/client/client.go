@@ -0,0 +1,162 @@
+// httpapiのサーバーを使うクライアント。エラーはerrors.Isでengine.ErrNotFoundやlock.ErrTimeoutと比べられる
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mvcc-go/engine"
+	"mvcc-go/httpapi"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Option func(*Client)
+
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.http = c
+	}
+}
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// baseURLは"http://localhost:8080"の形
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type TxOption func(*httpapi.BeginRequest)
+
+// 負ならロックを取れるまで待つ
+func WithLockTimeout(d time.Duration) TxOption {
+	return func(req *httpapi.BeginRequest) {
+		if d < 0 {
+			req.LockTimeoutMillis = -1
+			return
+		}
+		req.LockTimeoutMillis = int(d.Milliseconds())
+	}
+}
+
+// サーバー側のトランザクション。同時に使うときも1リクエストずつ処理される
+type Tx struct {
+	client *Client
+	ID     string
+	Level  engine.IsolationLevel
+}
+
+func (c *Client) Begin(ctx context.Context, level engine.IsolationLevel, opts ...TxOption) (*Tx, error) {
+	req := httpapi.BeginRequest{Level: level}
+	for _, opt := range opts {
+		opt(&req)
+	}
+
+	var res httpapi.BeginResponse
+	err := c.do(ctx, http.MethodPost, "/tx", req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tx{client: c, ID: res.ID, Level: res.Level}, nil
+}
+
+func (t *Tx) Get(ctx context.Context, key string) (string, error) {
+	var res httpapi.GetResponse
+	err := t.client.do(ctx, http.MethodGet, t.keyPath(key), nil, &res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.Value, nil
+}
+
+func (t *Tx) Set(ctx context.Context, key, value string) error {
+	return t.client.do(ctx, http.MethodPut, t.keyPath(key), httpapi.SetRequest{Value: value}, nil)
+}
+
+func (t *Tx) Commit(ctx context.Context) error {
+	return t.client.do(ctx, http.MethodPost, "/tx/"+t.ID+"/commit", nil, nil)
+}
+
+func (t *Tx) Abort(ctx context.Context) error {
+	return t.client.do(ctx, http.MethodPost, "/tx/"+t.ID+"/abort", nil, nil)
+}
+
+func (t *Tx) keyPath(key string) string {
+	return "/tx/" + t.ID + "/keys/" + url.PathEscape(key)
+}
+
+func (c *Client) GC(ctx context.Context) (active, removed int, err error) {
+	var res httpapi.GCResponse
+	err = c.do(ctx, http.MethodPost, "/gc", nil, &res)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return res.Active, res.Removed, nil
+}
+
+func (c *Client) Stats(ctx context.Context) (httpapi.Stats, error) {
+	var stats httpapi.Stats
+	err := c.do(ctx, http.MethodGet, "/stats", nil, &stats)
+
+	return stats, err
+}
+
+// bodyがnilでなければJSONで送る。resがnilならレスポンスの本文は読まない
+func (c *Client) do(ctx context.Context, method, path string, body, res any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &httpapi.Error{Status: resp.StatusCode}
+		err := json.NewDecoder(resp.Body).Decode(apiErr)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return apiErr
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(res)
+}
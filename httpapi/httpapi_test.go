@@ -0,0 +1,222 @@
+package httpapi_test
+
+import (
+	"context"
+	"errors"
+	"mvcc-go/engine"
+	"mvcc-go/engine/appendonly"
+	"mvcc-go/engine/delta"
+	"mvcc-go/engine/locking"
+	"mvcc-go/engine/registry"
+	"mvcc-go/httpapi"
+	"mvcc-go/httpapi/client"
+	"mvcc-go/lock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newClient(t *testing.T, e engine.Engine, opts ...httpapi.Option) *client.Client {
+	t.Helper()
+
+	s := httpapi.NewServer(e, opts...)
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close()
+	})
+
+	return client.New(srv.URL, client.WithHTTPClient(srv.Client()))
+}
+
+func begin(t *testing.T, c *client.Client, level engine.IsolationLevel, opts ...client.TxOption) *client.Tx {
+	t.Helper()
+
+	tx, err := c.Begin(context.Background(), level, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, appendonly.NewAppendOnlyEngine())
+
+	tx1 := begin(t, c, engine.RepeatableRead)
+	tx2 := begin(t, c, engine.RepeatableRead)
+
+	// スラッシュを含むキーもそのまま使える
+	err := tx1.Set(ctx, "a/b", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tx1.Get(ctx, "a/b"); err != nil || v != "v1" {
+		t.Errorf("expected v1, but got %q, %v", v, err)
+	}
+	if _, err := tx2.Get(ctx, "a/b"); !errors.Is(err, engine.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, but got %v", err)
+	}
+
+	err = tx1.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tx2.Get(ctx, "a/b"); !errors.Is(err, engine.ErrNotFound) {
+		t.Errorf("expected ErrNotFound from the snapshot, but got %v", err)
+	}
+	tx3 := begin(t, c, engine.ReadCommitted)
+	if v, err := tx3.Get(ctx, "a/b"); err != nil || v != "v1" {
+		t.Errorf("expected v1, but got %q, %v", v, err)
+	}
+
+	err = tx2.Abort(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(ctx); !errors.Is(err, httpapi.ErrUnknownTx) {
+		t.Errorf("expected ErrUnknownTx after abort, but got %v", err)
+	}
+
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Began != 3 || stats.Committed != 1 || stats.Aborted != 1 || stats.Open != 1 || stats.ChainLengths["a/b"] != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("lock timeout", func(t *testing.T) {
+		c := newClient(t, locking.NewLockingEngine(engine.WithLockTimeout(lock.NoTimeout)))
+
+		tx1 := begin(t, c, engine.RepeatableRead)
+		tx2 := begin(t, c, engine.RepeatableRead, client.WithLockTimeout(20*time.Millisecond))
+		err := tx1.Set(ctx, "k", "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = tx2.Set(ctx, "k", "w")
+		var apiErr *httpapi.Error
+		if !errors.Is(err, lock.ErrTimeout) || !errors.As(err, &apiErr) || apiErr.Status != http.StatusConflict {
+			t.Errorf("expected 409 lock timeout, but got %#v", err)
+		}
+	})
+
+	t.Run("serialization", func(t *testing.T) {
+		c := newClient(t, appendonly.NewAppendOnlyEngine())
+
+		tx1 := begin(t, c, engine.RepeatableRead)
+		tx2 := begin(t, c, engine.RepeatableRead)
+		if err := tx1.Set(ctx, "k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx1.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tx2.Set(ctx, "k", "w"); !errors.Is(err, engine.ErrSerialization) {
+			t.Errorf("expected ErrSerialization, but got %v", err)
+		}
+	})
+
+	t.Run("bad level", func(t *testing.T) {
+		c := newClient(t, delta.NewDeltaEngine())
+
+		_, err := c.Begin(ctx, "serializable")
+		var apiErr *httpapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+			t.Errorf("expected 400, but got %v", err)
+		}
+	})
+}
+
+// 開いたままのトランザクションは、どのエンジンでもコミットせずにアボートする
+func TestCloseAborts(t *testing.T) {
+	ctx := context.Background()
+
+	for _, name := range registry.Names() {
+		t.Run(name, func(t *testing.T) {
+			newEngine, err := registry.Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := newEngine()
+
+			s := httpapi.NewServer(e)
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			c := client.New(srv.URL, client.WithHTTPClient(srv.Client()))
+
+			tx := begin(t, c, engine.RepeatableRead)
+			err = tx.Set(ctx, "k", "v")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			check := e.Begin(engine.RepeatableRead)
+			if _, err := check.Get("k"); !errors.Is(err, engine.ErrNotFound) {
+				t.Errorf("expected ErrNotFound, but got %v", err)
+			}
+			err = check.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, appendonly.NewAppendOnlyEngine(engine.WithLockTimeout(lock.NoTimeout)), httpapi.WithIdleTimeout(50*time.Millisecond))
+
+	tx1 := begin(t, c, engine.RepeatableRead)
+	err := tx1.Set(ctx, "k", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tx1が期限切れでアボートされればロックを取れる
+	tx2 := begin(t, c, engine.RepeatableRead)
+	err = tx2.Set(ctx, "k", "w")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tx1.Get(ctx, "k"); !errors.Is(err, httpapi.ErrUnknownTx) {
+		t.Errorf("expected ErrUnknownTx, but got %v", err)
+	}
+
+	err = tx2.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Expired != 1 || stats.Committed != 1 || stats.Open != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	_, removed, err := c.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected the aborted version to be removed, but got removed=%d", removed)
+	}
+}
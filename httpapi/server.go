@@ -0,0 +1,322 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/lock"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// これだけ操作されなかったトランザクションは終わらせる
+const DefaultIdleTimeout = 30 * time.Second
+
+type Option func(*Server)
+
+// 0以下なら終わらせない
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+type tx struct {
+	id string
+	mu sync.Mutex // 同じトランザクションへのリクエストを1つずつ処理する
+	tx engine.Tx
+
+	// 以下はServer.muで守る
+	busy  int // 処理中のリクエストの数。0のときだけ期限切れにする
+	timer *time.Timer
+}
+
+// トランザクションはIDで識別し、リクエストをまたいで開いたままにする
+type Server struct {
+	engine      engine.Engine
+	mux         *http.ServeMux
+	idleTimeout time.Duration
+
+	mu    sync.Mutex // 以下を守る
+	txs   map[string]*tx
+	stats Stats
+}
+
+func NewServer(e engine.Engine, opts ...Option) *Server {
+	s := &Server{
+		engine:      e,
+		mux:         http.NewServeMux(),
+		idleTimeout: DefaultIdleTimeout,
+		txs:         make(map[string]*tx),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mux.HandleFunc("POST /tx", s.handleBegin)
+	s.mux.HandleFunc("GET /tx/{id}/keys/{key}", s.handleGet)
+	s.mux.HandleFunc("PUT /tx/{id}/keys/{key}", s.handleSet)
+	s.mux.HandleFunc("POST /tx/{id}/commit", s.handleCommit)
+	s.mux.HandleFunc("POST /tx/{id}/abort", s.handleAbort)
+	s.mux.HandleFunc("POST /gc", s.handleGC)
+	s.mux.HandleFunc("GET /stats", s.handleStats)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// 開いているトランザクションを全て終わらせる。以後のリクエストにはErrUnknownTxを返す
+func (s *Server) Close() error {
+	s.mu.Lock()
+	txs := s.txs
+	s.txs = make(map[string]*tx)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, t := range txs {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+
+		t.mu.Lock()
+		errs = append(errs, t.tx.Abort())
+		t.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Server) handleBegin(w http.ResponseWriter, r *http.Request) {
+	var req BeginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, badRequest(fmt.Errorf("decode request: %w", err)))
+		return
+	}
+
+	if req.Level == "" {
+		req.Level = engine.RepeatableRead
+	}
+	level, err := registry.ParseLevel(string(req.Level))
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	opts := make([]engine.TxOption, 0, 1)
+	switch {
+	case req.LockTimeoutMillis > 0:
+		opts = append(opts, engine.WithTxLockTimeout(time.Duration(req.LockTimeoutMillis)*time.Millisecond))
+	case req.LockTimeoutMillis < 0:
+		opts = append(opts, engine.WithTxLockTimeout(lock.NoTimeout))
+	}
+
+	id, err := newID()
+	if err != nil {
+		writeError(w, newError(err))
+		return
+	}
+
+	t := &tx{id: id, tx: s.engine.Begin(level, opts...)}
+
+	s.mu.Lock()
+	s.txs[id] = t
+	s.stats.Began++
+	s.idle(t)
+	s.mu.Unlock()
+
+	w.Header().Set("Location", "/tx/"+id)
+	writeJSON(w, http.StatusCreated, BeginResponse{ID: id, Level: level})
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	var value string
+	err := s.with(r.PathValue("id"), func(t *tx) error {
+		var err error
+		value, err = t.tx.Get(r.PathValue("key"))
+		return err
+	})
+	if err != nil {
+		writeError(w, newError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, GetResponse{Value: value})
+}
+
+func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
+	var req SetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, badRequest(fmt.Errorf("decode request: %w", err)))
+		return
+	}
+
+	err = s.with(r.PathValue("id"), func(t *tx) error {
+		return t.tx.Set(r.PathValue("key"), req.Value)
+	})
+	if err != nil {
+		writeError(w, newError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
+	s.end(w, r.PathValue("id"), func(t *tx) error {
+		err := t.tx.Commit()
+		if err == nil {
+			s.count(&s.stats.Committed)
+		}
+		return err
+	})
+}
+
+func (s *Server) handleAbort(w http.ResponseWriter, r *http.Request) {
+	s.end(w, r.PathValue("id"), func(t *tx) error {
+		err := t.tx.Abort()
+		if err == nil {
+			s.count(&s.stats.Aborted)
+		}
+		return err
+	})
+}
+
+func (s *Server) end(w http.ResponseWriter, id string, finish func(t *tx) error) {
+	err := s.with(id, func(t *tx) error {
+		err := finish(t)
+
+		s.mu.Lock()
+		delete(s.txs, t.id)
+		s.mu.Unlock()
+
+		return err
+	})
+	if err != nil {
+		writeError(w, newError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) count(n *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	*n++
+}
+
+// トランザクションを1つずつ使う。使っている間は期限切れにしない
+func (s *Server) with(id string, f func(t *tx) error) error {
+	s.mu.Lock()
+	t, ok := s.txs[id]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownTx, id)
+	}
+	t.busy++
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		t.busy--
+		s.idle(t)
+		s.mu.Unlock()
+	}()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// 待っている間に他のリクエストで終わっているかもしれない
+	s.mu.Lock()
+	_, ok = s.txs[id]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownTx, id)
+	}
+
+	return f(t)
+}
+
+// 使われなくなったら期限切れのタイマーを動かす。must be called with s.mu locked.
+func (s *Server) idle(t *tx) {
+	if s.idleTimeout <= 0 || t.busy > 0 {
+		return
+	}
+
+	if t.timer == nil {
+		t.timer = time.AfterFunc(s.idleTimeout, func() { s.expire(t) })
+		return
+	}
+	t.timer.Reset(s.idleTimeout)
+}
+
+func (s *Server) expire(t *tx) {
+	s.mu.Lock()
+	if t.busy > 0 || s.txs[t.id] != t {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.txs, t.id)
+	s.stats.Expired++
+	s.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tx.Abort()
+}
+
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	active, removed := s.engine.GC()
+	writeJSON(w, http.StatusOK, GCResponse{Active: active, Removed: removed})
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	stats := s.stats
+	stats.Open = len(s.txs)
+	s.mu.Unlock()
+
+	if e, ok := s.engine.(engine.StatsEngine); ok {
+		engineStats := e.Stats()
+		stats.ChainLengths = engineStats.ChainLengths
+		stats.UndoLogRecords = engineStats.UndoLogRecords
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err *Error) {
+	writeJSON(w, err.Status, err)
+}
@@ -0,0 +1,330 @@
+// 1つのキーだけを読み書きするトランザクションの履歴が線形化可能か検査する（Porcupineと同じ探索）
+package linearizability
+
+import (
+	"fmt"
+	"mvcc-go/history"
+	"slices"
+	"strings"
+	"time"
+)
+
+// トランザクションの中で行ったGetかSet
+type Action struct {
+	Kind     history.Kind
+	Value    string
+	NotFound bool
+}
+
+func (a Action) String() string {
+	switch {
+	case a.Kind == history.KindSet:
+		return fmt.Sprintf("set %q", a.Value)
+	case a.NotFound:
+		return "get -> not found"
+	default:
+		return fmt.Sprintf("get -> %q", a.Value)
+	}
+}
+
+// 1つのキーに対するトランザクション。Beginの呼び出しからCommitの完了までのどこかで一度に起きたとみなす
+type Operation struct {
+	Tx       int
+	Key      string
+	Actions  []Action
+	Invoke   time.Time
+	Complete time.Time
+}
+
+func (o Operation) String() string {
+	actions := make([]string, len(o.Actions))
+	for i, a := range o.Actions {
+		actions[i] = a.String()
+	}
+
+	return fmt.Sprintf("T%d %s: %s", o.Tx, o.Key, strings.Join(actions, ", "))
+}
+
+// 履歴から1つのキーだけを読み書きしたトランザクションを取り出す。
+// 失敗したSetとアボートしたトランザクションの書き込みは反映されていないものとして除き、終わっていないものは無視する
+func Operations(h history.History) []Operation {
+	type txn struct {
+		op      Operation
+		keys    map[string]struct{}
+		done    bool
+		aborted bool
+	}
+
+	txs := make(map[int]*txn)
+	ids := make([]int, 0)
+	for _, op := range h {
+		t, ok := txs[op.Tx]
+		if !ok {
+			t = &txn{op: Operation{Tx: op.Tx}, keys: make(map[string]struct{})}
+			txs[op.Tx] = t
+			ids = append(ids, op.Tx)
+		}
+
+		switch op.Kind {
+		case history.KindBegin:
+			t.op.Invoke = op.Invoke
+		case history.KindGet, history.KindSet:
+			t.keys[op.Key] = struct{}{}
+			t.op.Key = op.Key
+			if op.OK() {
+				t.op.Actions = append(t.op.Actions, Action{Kind: op.Kind, Value: op.Value, NotFound: op.NotFound})
+			}
+		case history.KindCommit, history.KindAbort:
+			t.op.Complete = op.Complete
+			t.done = true
+			t.aborted = op.Kind == history.KindAbort || !op.OK()
+		}
+	}
+
+	ops := make([]Operation, 0, len(ids))
+	for _, id := range ids {
+		t := txs[id]
+		if !t.done || len(t.keys) != 1 {
+			continue
+		}
+
+		if t.aborted {
+			t.op.Actions = slices.DeleteFunc(t.op.Actions, func(a Action) bool { return a.Kind == history.KindSet })
+		}
+		if len(t.op.Actions) == 0 {
+			continue
+		}
+
+		ops = append(ops, t.op)
+	}
+
+	return ops
+}
+
+// レジスタの値
+type state struct {
+	value  string
+	exists bool
+}
+
+// opの操作を順に適用する。読んだ値が合わなければfalse
+func step(s state, op Operation) (state, bool) {
+	for _, a := range op.Actions {
+		switch a.Kind {
+		case history.KindSet:
+			s = state{value: a.Value, exists: true}
+		case history.KindGet:
+			if a.NotFound == s.exists || (s.exists && a.Value != s.value) {
+				return s, false
+			}
+		}
+	}
+
+	return s, true
+}
+
+type KeyResult struct {
+	Key          string
+	Linearizable bool
+	Operations   []Operation // 呼び出し順
+
+	// 見つかった線形化。線形化できなければ最も長く線形化できた途中まで（Operationsの添字）
+	Linearization []int
+}
+
+type Result struct {
+	Linearizable bool
+	Keys         []KeyResult // キー順
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+	for _, k := range r.Keys {
+		if k.Linearizable {
+			continue
+		}
+
+		fmt.Fprintf(&b, "key %s is not linearizable. longest linearizable prefix:\n", k.Key)
+		for _, i := range k.Linearization {
+			fmt.Fprintf(&b, "  %s\n", k.Operations[i])
+		}
+		fmt.Fprintf(&b, "  cannot linearize any of:\n")
+		for i, op := range k.Operations {
+			if !slices.Contains(k.Linearization, i) {
+				fmt.Fprintf(&b, "    %s\n", op)
+			}
+		}
+	}
+
+	if b.Len() == 0 {
+		return "linearizable"
+	}
+
+	return b.String()
+}
+
+// キーごとに独立して線形化を探す
+func Check(ops []Operation) Result {
+	byKey := make(map[string][]Operation)
+	for _, op := range ops {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	result := Result{Linearizable: true, Keys: make([]KeyResult, 0, len(keys))}
+	for _, key := range keys {
+		ops := byKey[key]
+		slices.SortStableFunc(ops, func(a, b Operation) int { return a.Invoke.Compare(b.Invoke) })
+
+		linearization, ok := linearize(ops)
+		result.Keys = append(result.Keys, KeyResult{
+			Key:           key,
+			Linearizable:  ok,
+			Operations:    ops,
+			Linearization: linearization,
+		})
+		result.Linearizable = result.Linearizable && ok
+	}
+
+	return result
+}
+
+// 呼び出しと完了のイベントを時刻順に並べた双方向リスト
+type entry struct {
+	op    int
+	call  bool
+	time  time.Time
+	match *entry // callなら対応するreturn
+	prev  *entry
+	next  *entry
+}
+
+func newEntries(ops []Operation) *entry {
+	entries := make([]*entry, 0, len(ops)*2)
+	for i, op := range ops {
+		ret := &entry{op: i, time: op.Complete}
+		entries = append(entries, &entry{op: i, call: true, time: op.Invoke, match: ret}, ret)
+	}
+
+	// 同時刻なら呼び出しを先にして重なっているとみなす
+	slices.SortStableFunc(entries, func(a, b *entry) int {
+		if c := a.time.Compare(b.time); c != 0 {
+			return c
+		}
+		if a.call == b.call {
+			return 0
+		}
+		if a.call {
+			return -1
+		}
+		return 1
+	})
+
+	head := &entry{op: -1}
+	prev := head
+	for _, e := range entries {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+
+	return head
+}
+
+// callとそのreturnをリストから外す
+func (e *entry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func (e *entry) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type cacheKey struct {
+	linearized string
+	state      state
+}
+
+// Wing & Gongの探索に、同じ(線形化済みの集合, 状態)を二度調べないキャッシュを加えたもの
+func linearize(ops []Operation) ([]int, bool) {
+	head := newEntries(ops)
+
+	type frame struct {
+		entry *entry
+		state state
+	}
+
+	linearized := make([]byte, (len(ops)+7)/8)
+	cache := make(map[cacheKey]struct{})
+	stack := make([]frame, 0, len(ops))
+	best := make([]int, 0)
+
+	s := state{}
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			next, ok := step(s, ops[e.op])
+			if ok {
+				linearized[e.op/8] |= 1 << (e.op % 8)
+				key := cacheKey{linearized: string(linearized), state: next}
+				if _, seen := cache[key]; !seen {
+					cache[key] = struct{}{}
+					stack = append(stack, frame{entry: e, state: s})
+					s = next
+					e.lift()
+					e = head.next
+
+					if len(stack) > len(best) {
+						best = best[:0]
+						for _, f := range stack {
+							best = append(best, f.entry.op)
+						}
+					}
+					continue
+				}
+				linearized[e.op/8] &^= 1 << (e.op % 8)
+			}
+
+			e = e.next
+			continue
+		}
+
+		// 線形化していない操作が完了してしまったので直前の選択をやり直す
+		if len(stack) == 0 {
+			return best, false
+		}
+
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		linearized[f.entry.op/8] &^= 1 << (f.entry.op % 8)
+		s = f.state
+		f.entry.unlift()
+		e = f.entry.next
+	}
+
+	order := make([]int, len(stack))
+	for i, f := range stack {
+		order[i] = f.entry.op
+	}
+
+	return order, true
+}
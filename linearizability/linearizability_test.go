@@ -0,0 +1,156 @@
+package linearizability_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/enginetest"
+	"mvcc-go/history"
+	"mvcc-go/linearizability"
+	"mvcc-go/schedule"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 1つのキーを読むか、読んでから書くトランザクションの組
+func randomScenario(t *testing.T, seed uint64, name string, level engine.IsolationLevel) schedule.Scenario {
+	t.Helper()
+
+	newEngine, err := registry.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := enginetest.Random{Keys: []string{"x", "y"}, Txs: 2 + int(seed%3), MaxOps: 1, Workload: history.Register}
+
+	return random.Scenario(seed, newEngine, level)
+}
+
+// 線形化できなければ図をファイルに書き出してエラーにする
+func check(t *testing.T) func(r schedule.Result) error {
+	return func(r schedule.Result) error {
+		h := enginetest.Recorded(r)
+
+		result := linearizability.Check(linearizability.Operations(h))
+		if result.Linearizable {
+			return nil
+		}
+
+		path := filepath.Join(t.TempDir(), "linearizability.html")
+		var b bytes.Buffer
+		_ = result.Visualize(&b)
+		_ = os.WriteFile(path, b.Bytes(), 0o644)
+
+		return fmt.Errorf("%s\nvisualization: %s", result, path)
+	}
+}
+
+func TestRandomHistories(t *testing.T) {
+	cases := []struct {
+		engine string
+		level  engine.IsolationLevel
+	}{
+		{engine: "locking", level: engine.ReadCommitted},
+		{engine: "locking", level: engine.RepeatableRead},
+		{engine: "appendonly", level: engine.RepeatableRead},
+		{engine: "delta", level: engine.RepeatableRead},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s_%s", c.engine, c.level), func(t *testing.T) {
+			for seed := range uint64(30) {
+				scenario := randomScenario(t, seed, c.engine, c.level)
+				err := scenario.Sample(seed, 20, check(t))
+				if err != nil {
+					t.Fatalf("seed %d: %v", seed, err)
+				}
+			}
+		})
+	}
+}
+
+// naiveは書き込みがすぐに見えるので、読んでから書くトランザクションが重なると線形化できない
+func TestRandomHistoriesNaive(t *testing.T) {
+	for seed := range uint64(30) {
+		scenario := randomScenario(t, seed, "naive", engine.ReadCommitted)
+		err := scenario.Sample(seed, 20, check(t))
+
+		var failure *schedule.Failure
+		if errors.As(err, &failure) {
+			t.Log(failure)
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Error("expected a non-linearizable history")
+}
+
+func TestCheck(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	op := func(tx int, invoke, complete int, actions ...linearizability.Action) linearizability.Operation {
+		return linearizability.Operation{
+			Tx:       tx,
+			Key:      "x",
+			Actions:  actions,
+			Invoke:   at.Add(time.Duration(invoke) * time.Second),
+			Complete: at.Add(time.Duration(complete) * time.Second),
+		}
+	}
+	get := func(value string) linearizability.Action {
+		return linearizability.Action{Kind: history.KindGet, Value: value}
+	}
+	set := func(value string) linearizability.Action {
+		return linearizability.Action{Kind: history.KindSet, Value: value}
+	}
+	notFound := linearizability.Action{Kind: history.KindGet, NotFound: true}
+
+	// T2の読み取りはT1の書き込みと重なっているのでどちらの値でもよい
+	result := linearizability.Check([]linearizability.Operation{
+		op(1, 0, 3, set("1")),
+		op(2, 1, 2, notFound),
+		op(3, 4, 5, get("1")),
+	})
+	if !result.Linearizable {
+		t.Errorf("expected linearizable, but got %s", result)
+	}
+
+	// T1が完了した後にT2は古い値を読んだ
+	result = linearizability.Check([]linearizability.Operation{
+		op(1, 0, 1, set("1")),
+		op(2, 2, 3, notFound),
+	})
+	if result.Linearizable {
+		t.Fatal("expected not linearizable")
+	}
+	if got := result.Keys[0].Linearization; len(got) != 1 || got[0] != 0 {
+		t.Errorf("expected longest prefix [0], but got %v", got)
+	}
+
+	// 重なった2つのトランザクションが同じ値を読んでから書いた（lost update）
+	result = linearizability.Check([]linearizability.Operation{
+		op(1, 0, 1, set("0")),
+		op(2, 2, 5, get("0"), set("2")),
+		op(3, 3, 4, get("0"), set("3")),
+		op(4, 6, 7, get("2")),
+	})
+	if result.Linearizable {
+		t.Fatal("expected not linearizable")
+	}
+	t.Log(result)
+
+	var b bytes.Buffer
+	err := result.Visualize(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "key x: not linearizable") || !strings.Contains(b.String(), "<svg") {
+		t.Errorf("unexpected visualization: %s", b.String())
+	}
+}
@@ -0,0 +1,122 @@
+package linearizability
+
+import (
+	"html/template"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	width      = 1000
+	laneHeight = 28
+	barHeight  = 20
+)
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>linearizability</title>
+<style>
+body { font-family: sans-serif; }
+rect.linearized { fill: #b7e1b0; stroke: #3a8a2e; }
+rect.failed { fill: #f4b4b4; stroke: #b02a2a; }
+text { font-size: 11px; pointer-events: none; }
+</style>
+</head>
+<body>
+{{range .}}
+<h2>key {{.Key}}: {{if .Linearizable}}linearizable{{else}}not linearizable{{end}}</h2>
+<p>緑は線形化できた操作で、数字はその順番。{{if not .Linearizable}}赤は最も長く線形化できた途中の後にどこにも置けなかった操作。{{end}}</p>
+<svg width="{{.Width}}" height="{{.Height}}">
+{{range .Bars}}<g>
+<title>{{.Title}}</title>
+<rect class="{{.Class}}" x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}" rx="3"></rect>
+<text x="{{.TextX}}" y="{{.TextY}}">{{.Label}}</text>
+</g>
+{{end}}</svg>
+{{end}}
+</body>
+</html>
+`))
+
+type bar struct {
+	Title, Class, Label string
+	X, Y, Width, Height float64
+	TextX, TextY        float64
+}
+
+type view struct {
+	Key           string
+	Linearizable  bool
+	Width, Height int
+	Bars          []bar
+}
+
+// キーごとに操作の区間を時間軸に並べたHTMLを書き出す
+func (r Result) Visualize(w io.Writer) error {
+	views := make([]view, 0, len(r.Keys))
+	for _, k := range r.Keys {
+		views = append(views, k.view())
+	}
+
+	return page.Execute(w, views)
+}
+
+func (k KeyResult) view() view {
+	v := view{Key: k.Key, Linearizable: k.Linearizable, Width: width}
+	if len(k.Operations) == 0 {
+		return v
+	}
+
+	start := k.Operations[0].Invoke
+	end := start
+	for _, op := range k.Operations {
+		if op.Complete.After(end) {
+			end = op.Complete
+		}
+	}
+	span := max(end.Sub(start), time.Nanosecond)
+	x := func(t time.Time) float64 {
+		return float64(t.Sub(start)) / float64(span) * (width - 2)
+	}
+
+	order := make(map[int]int, len(k.Linearization))
+	for n, i := range k.Linearization {
+		order[i] = n + 1
+	}
+
+	// 重ならない操作は同じ段に詰める
+	lanes := make([]time.Time, 0)
+	for i, op := range k.Operations {
+		lane := slices.IndexFunc(lanes, func(t time.Time) bool { return t.Before(op.Invoke) })
+		if lane < 0 {
+			lane = len(lanes)
+			lanes = append(lanes, op.Complete)
+		}
+		lanes[lane] = op.Complete
+
+		b := bar{
+			Title:  op.String(),
+			Class:  "failed",
+			Label:  op.String(),
+			X:      x(op.Invoke) + 1,
+			Y:      float64(lane*laneHeight) + 1,
+			Width:  max(x(op.Complete)-x(op.Invoke), 2),
+			Height: barHeight,
+		}
+		if n, ok := order[i]; ok {
+			b.Class = "linearized"
+			b.Label = "#" + strconv.Itoa(n) + " " + b.Label
+		}
+		b.TextX = b.X + 3
+		b.TextY = b.Y + barHeight - 6
+
+		v.Bars = append(v.Bars, b)
+	}
+	v.Height = len(lanes)*laneHeight + 2
+
+	return v
+}
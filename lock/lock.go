@@ -2,37 +2,106 @@ package lock
 
 import (
 	"errors"
+	"mvcc-go/clock"
 	"sync"
 	"time"
 )
 
+// デフォルトのロック待ち時間
 const Timeout = 100 * time.Millisecond
 
+// タイムアウトせずに待ち続ける
+const NoTimeout time.Duration = -1
+
 var ErrTimeout = errors.New("timeout")
 var ErrNotLocked = errors.New("not locked")
 
 type LockType string
 
 const (
-	sLock LockType = "s"
-	xLock LockType = "x"
+	Shared    LockType = "s"
+	Exclusive LockType = "x"
 )
 
+// Managerの内部ロックを保持したまま呼ばれるのでManagerを呼び返さないこと
+type Observer interface {
+	OnLockWait(txID int, key string, mode LockType)
+	OnLockGrant(txID int, key string, mode LockType, waited time.Duration)
+	OnLockTimeout(txID int, key string, mode LockType, waited time.Duration)
+}
+
+// Observerが実装していれば、待ちの循環に入ったままタイムアウトしたときにOnLockTimeoutの後で呼ぶ。
+// デッドロックはタイムアウトでしか解けないので、循環1つにつき最初にタイムアウトしたトランザクションで1回呼ばれる
+type DeadlockObserver interface {
+	OnDeadlock(txID int, key string, cycle []int)
+}
+
+// 必要なメソッドだけ実装するために埋め込んで使う
+type NopObserver struct{}
+
+func (NopObserver) OnLockWait(txID int, key string, mode LockType)                          {}
+func (NopObserver) OnLockGrant(txID int, key string, mode LockType, waited time.Duration)   {}
+func (NopObserver) OnLockTimeout(txID int, key string, mode LockType, waited time.Duration) {}
+
+type Option func(*Manager)
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.timeout = timeout
+	}
+}
+
+func WithClock(c clock.Clock) Option {
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+func WithObserver(o Observer) Option {
+	return func(m *Manager) {
+		m.observer = o
+	}
+}
+
 type Manager struct {
-	locks map[string]map[int]LockType
-	cond  sync.Cond
+	locks    map[string]map[int]LockType
+	waiting  map[int]waiting // txID -> 待っているロック
+	mu       sync.Mutex
+	released chan struct{} // ロックが解放されるたびにcloseして作り直す
+	timeout  time.Duration
+	clock    clock.Clock
+	observer Observer
 }
 
-func NewManager() *Manager {
-	return &Manager{
-		locks: make(map[string]map[int]LockType),
-		cond:  sync.Cond{L: &sync.Mutex{}},
+func NewManager(opts ...Option) *Manager {
+	m := &Manager{
+		locks:    make(map[string]map[int]LockType),
+		waiting:  make(map[int]waiting),
+		released: make(chan struct{}),
+		timeout:  Timeout,
+		clock:    clock.Real,
+		observer: NopObserver{},
 	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
 }
 
 func (m *Manager) SLock(txID int, key string) error {
-	m.cond.L.Lock()
-	defer m.cond.L.Unlock()
+	return m.SLockTimeout(txID, key, m.timeout)
+}
+
+func (m *Manager) XLock(txID int, key string) error {
+	return m.XLockTimeout(txID, key, m.timeout)
+}
+
+// timeoutがNoTimeoutなら取得できるまで待つ
+func (m *Manager) SLockTimeout(txID int, key string, timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	if _, ok := m.locks[key]; ok {
 		if _, ok := m.locks[key][txID]; ok {
@@ -40,61 +109,80 @@ func (m *Manager) SLock(txID int, key string) error {
 		}
 	}
 
-	start := time.Now()
+	start := m.clock.Now()
+	waited := false
 
 	for {
-		if time.Since(start) > Timeout {
-			return ErrTimeout
-		}
 		if !m.hasOtherXLock(txID, key) {
 			break
 		}
+		if timeout != NoTimeout && clock.Since(m.clock, start) >= timeout {
+			return m.timedOut(txID, key, Shared, start)
+		}
 
-		m.wait(Timeout - time.Since(start))
+		if !waited {
+			m.waiting[txID] = waiting{key: key, mode: Shared, since: start}
+			m.observer.OnLockWait(txID, key, Shared)
+			waited = true
+		}
+		m.wait(timeout, start)
 	}
 
+	delete(m.waiting, txID)
+	m.observer.OnLockGrant(txID, key, Shared, clock.Since(m.clock, start))
+
 	if _, ok := m.locks[key]; !ok {
 		m.locks[key] = make(map[int]LockType)
 	}
-	m.locks[key][txID] = sLock
+	m.locks[key][txID] = Shared
 
 	return nil
 }
 
-func (m *Manager) XLock(txID int, key string) error {
-	m.cond.L.Lock()
-	defer m.cond.L.Unlock()
+// timeoutがNoTimeoutなら取得できるまで待つ
+func (m *Manager) XLockTimeout(txID int, key string, timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	if _, ok := m.locks[key]; ok {
-		if lockType, ok := m.locks[key][txID]; ok && lockType == xLock {
+		if lockType, ok := m.locks[key][txID]; ok && lockType == Exclusive {
 			return nil
 		}
 	}
 
-	start := time.Now()
+	start := m.clock.Now()
+	waited := false
 
 	for {
-		if time.Since(start) > Timeout {
-			return ErrTimeout
-		}
 		if !m.hasOtherAnyLock(txID, key) {
 			break
 		}
+		if timeout != NoTimeout && clock.Since(m.clock, start) >= timeout {
+			return m.timedOut(txID, key, Exclusive, start)
+		}
 
-		m.wait(Timeout - time.Since(start))
+		if !waited {
+			m.waiting[txID] = waiting{key: key, mode: Exclusive, since: start}
+			m.observer.OnLockWait(txID, key, Exclusive)
+			waited = true
+		}
+		m.wait(timeout, start)
 	}
 
+	delete(m.waiting, txID)
+	m.observer.OnLockGrant(txID, key, Exclusive, clock.Since(m.clock, start))
+
 	if _, ok := m.locks[key]; !ok {
 		m.locks[key] = make(map[int]LockType)
 	}
-	m.locks[key][txID] = xLock
+	m.locks[key][txID] = Exclusive
 
 	return nil
 }
 
 func (m *Manager) Unlock(txID int, key string) error {
-	m.cond.L.Lock()
-	defer m.cond.L.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	if _, ok := m.locks[key]; !ok {
 		return ErrNotLocked
@@ -104,13 +192,13 @@ func (m *Manager) Unlock(txID int, key string) error {
 	}
 
 	delete(m.locks[key], txID)
-
-	if len(m.locks[key]) > 0 {
-		return nil
+	if len(m.locks[key]) == 0 {
+		delete(m.locks, key)
 	}
 
-	delete(m.locks, key)
-	m.cond.Broadcast()
+	// 残ったロックが自分のものだけならアップグレードできるので常に起こす
+	close(m.released)
+	m.released = make(chan struct{})
 
 	return nil
 }
@@ -121,7 +209,7 @@ func (m *Manager) hasOtherXLock(txID int, key string) bool {
 	}
 
 	for owner, lockType := range m.locks[key] { // there must be only 1 loop
-		if owner != txID && lockType == xLock {
+		if owner != txID && lockType == Exclusive {
 			return true
 		}
 	}
@@ -141,18 +229,23 @@ func (m *Manager) hasOtherAnyLock(txID int, key string) bool {
 	return true
 }
 
-// cond.Wait() with timeout. must be called with m.cond.L locked.
-func (m *Manager) wait(timeout time.Duration) {
-	done := make(chan struct{})
+// ロックが解放されるかタイムアウトするまで待つ。must be called with m.mu locked.
+func (m *Manager) wait(timeout time.Duration, start time.Time) {
+	released := m.released
+
+	m.mu.Unlock()
+	defer m.mu.Lock()
+
+	if timeout == NoTimeout {
+		<-released
+		return
+	}
 
-	go func() {
-		m.cond.Wait()
-		close(done)
-	}()
+	timer := m.clock.NewTimer(timeout - clock.Since(m.clock, start))
+	defer timer.Stop()
 
 	select {
-	case <-done:
-	case <-time.After(timeout):
-		m.cond.L.Lock()
+	case <-released:
+	case <-timer.C():
 	}
 }
@@ -2,8 +2,12 @@ package lock_test
 
 import (
 	"errors"
-	"log"
+	"mvcc-go/clock"
 	"mvcc-go/lock"
+	"reflect"
+	"runtime"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 )
@@ -11,13 +15,13 @@ import (
 func TestXLockXLockByMySelf(t *testing.T) {
 	manager := lock.NewManager()
 
-	log.Println("XLock")
+	t.Log("XLock")
 	err := manager.XLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("XLock by myself, should not be locked")
+	t.Log("XLock by myself, should not be locked")
 	err = manager.XLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
@@ -27,13 +31,13 @@ func TestXLockXLockByMySelf(t *testing.T) {
 func TestXLockSLockByMySelf(t *testing.T) {
 	manager := lock.NewManager()
 
-	log.Println("XLock")
+	t.Log("XLock")
 	err := manager.XLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("SLock by myself, should not be locked")
+	t.Log("SLock by myself, should not be locked")
 	err = manager.SLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
@@ -43,13 +47,13 @@ func TestXLockSLockByMySelf(t *testing.T) {
 func TestSLockSLockByMySelf(t *testing.T) {
 	manager := lock.NewManager()
 
-	log.Println("SLock")
+	t.Log("SLock")
 	err := manager.SLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("SLock by myself, should not be locked")
+	t.Log("SLock by myself, should not be locked")
 	err = manager.SLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
@@ -59,7 +63,7 @@ func TestSLockSLockByMySelf(t *testing.T) {
 func TestUnlockWithoutLock(t *testing.T) {
 	manager := lock.NewManager()
 
-	log.Println("Unlock without lock")
+	t.Log("Unlock without lock")
 	err := manager.Unlock(1, "key")
 	if !errors.Is(err, lock.ErrNotLocked) {
 		t.Errorf("expected %v, but got %v", lock.ErrNotLocked, err)
@@ -67,33 +71,34 @@ func TestUnlockWithoutLock(t *testing.T) {
 }
 
 func TestXLock(t *testing.T) {
-	manager := lock.NewManager()
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
 
-	log.Println("XLock")
+	t.Log("XLock")
 	err := manager.XLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("SLock, should locked and timeout")
-	err = manager.SLock(2, "key")
+	t.Log("SLock, should locked and timeout")
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return manager.SLock(2, "key") })
 	if !errors.Is(err, lock.ErrTimeout) {
 		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
 	}
 
-	log.Println("XLock, should locked and timeout")
-	err = manager.XLock(2, "key")
+	t.Log("XLock, should locked and timeout")
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return manager.XLock(2, "key") })
 	if !errors.Is(err, lock.ErrTimeout) {
 		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
 	}
 
-	log.Println("Unlock, there is no lock")
+	t.Log("Unlock, there is no lock")
 	err = manager.Unlock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("SLock, now should be able to lock")
+	t.Log("SLock, now should be able to lock")
 	err = manager.SLock(2, "key")
 	if err != nil {
 		t.Fatal(err)
@@ -103,45 +108,46 @@ func TestXLock(t *testing.T) {
 func TestSLock(t *testing.T) {
 	// t.Parallel() // Parrallel makes log messages mixed up
 
-	manager := lock.NewManager()
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
 
-	log.Println("SLock")
+	t.Log("SLock")
 	err := manager.SLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("SLock by other, should not be locked")
+	t.Log("SLock by other, should not be locked")
 	err = manager.SLock(2, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("XLock, should be locked and timeout")
-	err = manager.XLock(3, "key")
+	t.Log("XLock, should be locked and timeout")
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return manager.XLock(3, "key") })
 	if !errors.Is(err, lock.ErrTimeout) {
 		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
 	}
 
-	log.Println("Unlock, there are still 1 slock")
+	t.Log("Unlock, there are still 1 slock")
 	err = manager.Unlock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("XLock, still should be locked and timeout")
-	err = manager.XLock(3, "key")
+	t.Log("XLock, still should be locked and timeout")
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return manager.XLock(3, "key") })
 	if !errors.Is(err, lock.ErrTimeout) {
 		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
 	}
 
-	log.Println("Unlock again, there is no lock")
+	t.Log("Unlock again, there is no lock")
 	err = manager.Unlock(2, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("XLock, now should be able to lock")
+	t.Log("XLock, now should be able to lock")
 	err = manager.XLock(3, "key")
 	if err != nil {
 		t.Fatal(err)
@@ -149,44 +155,46 @@ func TestSLock(t *testing.T) {
 }
 
 func TestSLockUpgrade(t *testing.T) {
-	manager := lock.NewManager()
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
 
-	log.Println("SLock")
+	t.Log("SLock")
 	err := manager.SLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("upgrade to XLock")
+	t.Log("upgrade to XLock")
 	err = manager.XLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("SLock, should be locked and timeout")
-	err = manager.SLock(2, "key")
+	t.Log("SLock, should be locked and timeout")
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return manager.SLock(2, "key") })
 	if !errors.Is(err, lock.ErrTimeout) {
 		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
 	}
 }
 
 func TestSLockUpgradeWait(t *testing.T) {
-	manager := lock.NewManager()
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
 
-	log.Println("SLock")
+	t.Log("SLock")
 	err := manager.SLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("SLock by other")
+	t.Log("SLock by other")
 	err = manager.SLock(2, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("upgrade to XLock, should be locked and timeout")
-	err = manager.XLock(1, "key")
+	t.Log("upgrade to XLock, should be locked and timeout")
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return manager.XLock(1, "key") })
 	if !errors.Is(err, lock.ErrTimeout) {
 		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
 	}
@@ -195,9 +203,10 @@ func TestSLockUpgradeWait(t *testing.T) {
 func TestManyWaits(t *testing.T) {
 	// t.Parallel() // Parrallel makes log messages mixed up
 
-	manager := lock.NewManager()
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
 
-	log.Println("XLock")
+	t.Log("XLock")
 	err := manager.XLock(1, "key")
 	if err != nil {
 		t.Fatal(err)
@@ -205,26 +214,34 @@ func TestManyWaits(t *testing.T) {
 
 	waiters := 10
 	res := make([]error, waiters)
+	wg := sync.WaitGroup{}
 	for i := range waiters {
 		res[i] = errors.New("no result")
 
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
+
 			txID := i + 2
 			err := manager.XLock(txID, "key")
-			log.Printf("Xlock %d: %v\n", txID, err)
+			t.Logf("Xlock %d: %v", txID, err)
 			res[i] = err
 		}()
 	}
 
-	time.Sleep(lock.Timeout / 2)
+	clk.BlockUntil(waiters)
+	clk.Advance(lock.Timeout / 2)
 
-	log.Println("Unlock, should 1 waiter succeed to lock")
+	t.Log("Unlock, should 1 waiter succeed to lock")
 	err = manager.Unlock(1, "key")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(lock.Timeout/2 + 10*time.Millisecond) // 10ms for margin
+	waitUntil(func(locks lock.KeyLocks) bool { return len(locks.Holders) == 1 }, manager)
+
+	clk.Advance(lock.Timeout / 2)
+	wg.Wait()
 
 	success := 0
 	timeout := 0
@@ -250,3 +267,200 @@ func TestManyWaits(t *testing.T) {
 		t.Errorf("expected %d timeouts, but got %d", waiters-1, timeout)
 	}
 }
+
+func TestLockTimeoutError(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
+
+	t.Log("XLock")
+	err := manager.XLock(1, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("SLock, should locked and timeout with holders")
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error { return manager.SLock(2, "key") })
+
+	var timeoutErr *lock.LockTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected %T, but got %v", timeoutErr, err)
+	}
+	if !errors.Is(err, lock.ErrTimeout) {
+		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
+	}
+	if timeoutErr.Key != "key" || timeoutErr.Mode != lock.Shared || !slices.Equal(timeoutErr.Holders, []int{1}) ||
+		timeoutErr.Waited != lock.Timeout {
+		t.Errorf("unexpected error: %+v", timeoutErr)
+	}
+}
+
+type deadlockObserver struct {
+	lock.NopObserver
+	cycles [][]int
+}
+
+func (o *deadlockObserver) OnDeadlock(txID int, key string, cycle []int) {
+	o.cycles = append(o.cycles, cycle)
+}
+
+func TestDeadlock(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	observer := &deadlockObserver{}
+	manager := lock.NewManager(lock.WithClock(clk), lock.WithObserver(observer))
+
+	t.Log("tx1 XLock a, tx2 XLock b")
+	err := manager.XLock(1, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.XLock(2, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("tx1 waits for b, tx2 waits for a 10ms later")
+	errs := make(chan error)
+	go func() { errs <- manager.XLock(1, "b") }()
+	clk.BlockUntil(1)
+	clk.Advance(10 * time.Millisecond)
+	go func() { errs <- manager.SLock(2, "a") }()
+	clk.BlockUntil(2)
+
+	t.Log("tx1 times out first in the cycle")
+	clk.Advance(lock.Timeout - 10*time.Millisecond)
+	var timeoutErr *lock.LockTimeoutError
+	if err := <-errs; !errors.As(err, &timeoutErr) || timeoutErr.TxID != 1 || !slices.Equal(timeoutErr.Cycle, []int{1, 2}) {
+		t.Errorf("expected tx1 to time out in cycle [1 2], but got %v", err)
+	}
+
+	t.Log("tx2 times out after the cycle is broken")
+	clk.Advance(10 * time.Millisecond)
+	if err := <-errs; !errors.As(err, &timeoutErr) || timeoutErr.TxID != 2 || timeoutErr.Cycle != nil {
+		t.Errorf("expected tx2 to time out without a cycle, but got %v", err)
+	}
+
+	if !reflect.DeepEqual(observer.cycles, [][]int{{1, 2}}) {
+		t.Errorf("expected one deadlock [1 2], but got %v", observer.cycles)
+	}
+}
+
+func TestSnapshotAndBlockingChain(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
+
+	t.Log("tx1 XLock a, tx2 XLock b")
+	err := manager.XLock(1, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.XLock(2, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("tx2 waits for a, tx3 waits for b")
+	done := make(chan struct{})
+	go func() {
+		_ = manager.XLock(2, "a")
+		done <- struct{}{}
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(10 * time.Millisecond)
+
+	go func() {
+		_ = manager.SLock(3, "b")
+		done <- struct{}{}
+	}()
+	clk.BlockUntil(2)
+
+	snapshot := manager.Snapshot()
+	want := []lock.KeyLocks{
+		{
+			Key:     "a",
+			Holders: []lock.Holder{{TxID: 1, Mode: lock.Exclusive}},
+			Waiters: []lock.Waiter{{TxID: 2, Mode: lock.Exclusive, Waited: 10 * time.Millisecond}},
+		},
+		{
+			Key:     "b",
+			Holders: []lock.Holder{{TxID: 2, Mode: lock.Exclusive}},
+			Waiters: []lock.Waiter{{TxID: 3, Mode: lock.Shared, Waited: 0}},
+		},
+	}
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Errorf("expected %+v, but got %+v", want, snapshot)
+	}
+
+	chain := manager.BlockingChain(3)
+	if !slices.Equal(chain, []int{2, 1}) {
+		t.Errorf("expected [2 1], but got %v", chain)
+	}
+
+	clk.Advance(lock.Timeout)
+	<-done
+	<-done
+
+	if chain := manager.BlockingChain(3); len(chain) != 0 {
+		t.Errorf("expected no blockers after timeout, but got %v", chain)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk), lock.WithTimeout(10*time.Millisecond))
+
+	t.Log("XLock")
+	err := manager.XLock(1, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("XLock, should timeout before default timeout")
+	err = clk.AdvanceWhenBlocked(10*time.Millisecond, func() error { return manager.XLock(2, "key") })
+	if !errors.Is(err, lock.ErrTimeout) {
+		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
+	}
+}
+
+func TestNoTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	manager := lock.NewManager(lock.WithClock(clk))
+
+	t.Log("XLock")
+	err := manager.XLock(1, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("XLock without timeout, should wait longer than default timeout")
+	done := make(chan error)
+	go func() {
+		done <- manager.XLockTimeout(2, "key", lock.NoTimeout)
+	}()
+
+	waitUntil(func(locks lock.KeyLocks) bool { return len(locks.Waiters) == 1 }, manager)
+	clk.Advance(lock.Timeout * 10)
+
+	t.Log("Unlock, waiter should get the lock")
+	err = manager.Unlock(1, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// "key"のロックの状態がcondを満たすまで待つ
+func waitUntil(cond func(locks lock.KeyLocks) bool, manager *lock.Manager) {
+	for {
+		for _, locks := range manager.Snapshot() {
+			if locks.Key == "key" && cond(locks) {
+				return
+			}
+		}
+
+		runtime.Gosched()
+	}
+}
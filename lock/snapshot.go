@@ -0,0 +1,204 @@
+package lock
+
+import (
+	"cmp"
+	"fmt"
+	"mvcc-go/clock"
+	"slices"
+	"time"
+)
+
+type waiting struct {
+	key   string
+	mode  LockType
+	since time.Time
+}
+
+// errors.Is(err, ErrTimeout)で判定できる
+type LockTimeoutError struct {
+	TxID    int
+	Key     string
+	Mode    LockType
+	Holders []int // タイムアウト時点でkeyのロックを持っていたtxID
+	Waited  time.Duration
+	Cycle   []int // デッドロックしていれば待ちの循環。TxIDから待っている順
+}
+
+func (e *LockTimeoutError) Error() string {
+	s := fmt.Sprintf("%v: tx%d waited %v for %s lock on %q held by %v", ErrTimeout, e.TxID, e.Waited, e.Mode, e.Key, e.Holders)
+	if len(e.Cycle) > 0 {
+		s += fmt.Sprintf(" (deadlock %v)", e.Cycle)
+	}
+
+	return s
+}
+
+func (e *LockTimeoutError) Unwrap() error {
+	return ErrTimeout
+}
+
+// must be called with m.mu locked.
+func (m *Manager) timedOut(txID int, key string, mode LockType, start time.Time) error {
+	err := &LockTimeoutError{
+		TxID:    txID,
+		Key:     key,
+		Mode:    mode,
+		Holders: m.holders(txID, key),
+		Waited:  clock.Since(m.clock, start),
+		Cycle:   m.cycle(txID),
+	}
+	delete(m.waiting, txID)
+
+	m.observer.OnLockTimeout(txID, key, mode, err.Waited)
+	if o, ok := m.observer.(DeadlockObserver); ok && err.Cycle != nil {
+		o.OnDeadlock(txID, key, err.Cycle)
+	}
+
+	return err
+}
+
+// txIDから待ちをたどってtxIDに戻る最短の循環。なければnil。must be called with m.mu locked.
+func (m *Manager) cycle(txID int) []int {
+	prev := map[int]int{txID: -1}
+	queue := []int{txID}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		w, ok := m.waiting[current]
+		if !ok {
+			continue
+		}
+
+		for _, blocker := range m.blockers(current, w) {
+			if blocker == txID {
+				cycle := make([]int, 0)
+				for id := current; id != -1; id = prev[id] {
+					cycle = append(cycle, id)
+				}
+				slices.Reverse(cycle)
+				return cycle
+			}
+			if _, ok := prev[blocker]; ok {
+				continue
+			}
+			prev[blocker] = current
+			queue = append(queue, blocker)
+		}
+	}
+
+	return nil
+}
+
+// must be called with m.mu locked.
+func (m *Manager) holders(txID int, key string) []int {
+	holders := make([]int, 0, len(m.locks[key]))
+	for owner := range m.locks[key] {
+		if owner != txID {
+			holders = append(holders, owner)
+		}
+	}
+	slices.Sort(holders)
+
+	return holders
+}
+
+type Holder struct {
+	TxID int
+	Mode LockType
+}
+
+type Waiter struct {
+	TxID   int
+	Mode   LockType
+	Waited time.Duration
+}
+
+type KeyLocks struct {
+	Key     string
+	Holders []Holder
+	Waiters []Waiter
+}
+
+// pg_locks相当。キー順に返す
+func (m *Manager) Snapshot() []KeyLocks {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byKey := make(map[string]*KeyLocks)
+	entry := func(key string) *KeyLocks {
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = &KeyLocks{Key: key, Holders: make([]Holder, 0), Waiters: make([]Waiter, 0)}
+		}
+		return byKey[key]
+	}
+
+	for key, owners := range m.locks {
+		e := entry(key)
+		for txID, mode := range owners {
+			e.Holders = append(e.Holders, Holder{TxID: txID, Mode: mode})
+		}
+		slices.SortFunc(e.Holders, func(a, b Holder) int { return cmp.Compare(a.TxID, b.TxID) })
+	}
+
+	for txID, w := range m.waiting {
+		e := entry(w.key)
+		e.Waiters = append(e.Waiters, Waiter{TxID: txID, Mode: w.mode, Waited: clock.Since(m.clock, w.since)})
+	}
+
+	snapshot := make([]KeyLocks, 0, len(byKey))
+	for _, e := range byKey {
+		// 長く待っている順
+		slices.SortFunc(e.Waiters, func(a, b Waiter) int { return cmp.Compare(b.Waited, a.Waited) })
+		snapshot = append(snapshot, *e)
+	}
+	slices.SortFunc(snapshot, func(a, b KeyLocks) int { return cmp.Compare(a.Key, b.Key) })
+
+	return snapshot
+}
+
+// pg_blocking_pids相当。txIDを直接・間接にブロックしているtxIDを近い順に返す
+func (m *Manager) BlockingChain(txID int) []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	chain := make([]int, 0)
+	visited := map[int]struct{}{txID: {}}
+	queue := []int{txID}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		w, ok := m.waiting[current]
+		if !ok {
+			continue
+		}
+
+		for _, blocker := range m.blockers(current, w) {
+			if _, ok := visited[blocker]; ok {
+				continue // デッドロックしていると循環する
+			}
+			visited[blocker] = struct{}{}
+			chain = append(chain, blocker)
+			queue = append(queue, blocker)
+		}
+	}
+
+	return chain
+}
+
+// must be called with m.mu locked.
+func (m *Manager) blockers(txID int, w waiting) []int {
+	if w.mode == Exclusive {
+		return m.holders(txID, w.key)
+	}
+
+	blockers := make([]int, 0)
+	for _, owner := range m.holders(txID, w.key) {
+		if m.locks[w.key][owner] == Exclusive {
+			blockers = append(blockers, owner)
+		}
+	}
+
+	return blockers
+}
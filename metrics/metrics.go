@@ -0,0 +1,332 @@
+// エンジンとロックマネージャーのメトリクスをPrometheusのテキスト形式で出力する。
+// ロックはタイムアウトでしかデッドロックを解かないので、待ちの循環に入ったままのタイムアウトをデッドロックとして数える
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"mvcc-go/engine"
+	"mvcc-go/lock"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var LockWaitBuckets = []float64{0.0001, 0.001, 0.01, 0.05, 0.1, 0.5, 1, 5}
+var ChainLengthBuckets = []float64{1, 2, 4, 8, 16, 32, 64}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // bucketsと同じ並び、累積ではない
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// エンジン1つ分のメトリクス。engine.WithObserverやlock.WithObserverに渡して使う
+type Collector struct {
+	mu     sync.Mutex
+	name   string
+	engine engine.Engine
+
+	active       int
+	begins       map[engine.IsolationLevel]uint64
+	commits      map[engine.IsolationLevel]uint64
+	aborts       map[engine.IsolationLevel]uint64
+	lockWaits    map[lock.LockType]*histogram
+	lockTimeouts map[lock.LockType]uint64
+	deadlocks    uint64
+	versions     uint64
+	purged       uint64
+	vacuums      uint64
+	vacuumed     uint64
+}
+
+var _ engine.Observer = &Collector{}
+var _ lock.DeadlockObserver = &Collector{}
+
+func newCollector(name string) *Collector {
+	return &Collector{
+		name:         name,
+		begins:       make(map[engine.IsolationLevel]uint64),
+		commits:      make(map[engine.IsolationLevel]uint64),
+		aborts:       make(map[engine.IsolationLevel]uint64),
+		lockWaits:    make(map[lock.LockType]*histogram),
+		lockTimeouts: make(map[lock.LockType]uint64),
+	}
+}
+
+// engine.StatsEngineならバージョンチェーンとundo logのサイズも出力する
+func (c *Collector) SetEngine(e engine.Engine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.engine = e
+}
+
+func (c *Collector) OnBegin(txID int, level engine.IsolationLevel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active++
+	c.begins[level]++
+}
+
+func (c *Collector) OnCommit(txID int, level engine.IsolationLevel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active--
+	c.commits[level]++
+}
+
+func (c *Collector) OnAbort(txID int, level engine.IsolationLevel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active--
+	c.aborts[level]++
+}
+
+func (c *Collector) OnLockWait(txID int, key string, mode lock.LockType) {}
+
+func (c *Collector) OnLockGrant(txID int, key string, mode lock.LockType, waited time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lockWait(mode).observe(waited.Seconds())
+}
+
+func (c *Collector) OnLockTimeout(txID int, key string, mode lock.LockType, waited time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lockWait(mode).observe(waited.Seconds())
+	c.lockTimeouts[mode]++
+}
+
+func (c *Collector) OnDeadlock(txID int, key string, cycle []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadlocks++
+}
+
+func (c *Collector) lockWait(mode lock.LockType) *histogram {
+	if _, ok := c.lockWaits[mode]; !ok {
+		c.lockWaits[mode] = newHistogram(LockWaitBuckets)
+	}
+
+	return c.lockWaits[mode]
+}
+
+func (c *Collector) OnVersionCreated(txID int, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.versions++
+}
+
+func (c *Collector) OnPurge(txID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.purged++
+}
+
+func (c *Collector) OnVacuum(active, removed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.vacuums++
+	c.vacuumed += uint64(removed)
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []*Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make([]*Collector, 0),
+	}
+}
+
+// nameはengineラベルの値になる
+func (r *Registry) NewCollector(name string) *Collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := newCollector(name)
+	r.collectors = append(r.collectors, c)
+
+	return c
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+// Prometheusのテキスト形式で書き出す
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	// エンジンがObserverを呼んでいる間にロック順が逆にならないよう先に集める
+	stats := make(map[*Collector]engine.Stats)
+	for _, c := range collectors {
+		if s, ok := c.stats(); ok {
+			stats[c] = s
+		}
+	}
+
+	var b strings.Builder
+	write := func(name, typ, help string, f func(c *Collector)) {
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+		for _, c := range collectors {
+			c.mu.Lock()
+			f(c)
+			c.mu.Unlock()
+		}
+	}
+
+	write("mvcc_active_transactions", "gauge", "Number of transactions in progress.", func(c *Collector) {
+		fmt.Fprintf(&b, "mvcc_active_transactions{%s} %d\n", labels("engine", c.name), c.active)
+	})
+	write("mvcc_transactions_begun_total", "counter", "Transactions begun by isolation level.", func(c *Collector) {
+		writeByLevel(&b, "mvcc_transactions_begun_total", c.name, c.begins)
+	})
+	write("mvcc_commits_total", "counter", "Transactions committed by isolation level.", func(c *Collector) {
+		writeByLevel(&b, "mvcc_commits_total", c.name, c.commits)
+	})
+	write("mvcc_aborts_total", "counter", "Transactions aborted by isolation level.", func(c *Collector) {
+		writeByLevel(&b, "mvcc_aborts_total", c.name, c.aborts)
+	})
+	write("mvcc_lock_wait_seconds", "histogram", "Time spent acquiring locks.", func(c *Collector) {
+		for _, mode := range sortedKeys(c.lockWaits) {
+			writeHistogram(&b, "mvcc_lock_wait_seconds", labels("engine", c.name, "mode", string(mode)), c.lockWaits[mode])
+		}
+	})
+	write("mvcc_lock_timeouts_total", "counter", "Lock requests that timed out.", func(c *Collector) {
+		for _, mode := range sortedKeys(c.lockTimeouts) {
+			fmt.Fprintf(&b, "mvcc_lock_timeouts_total{%s} %d\n", labels("engine", c.name, "mode", string(mode)), c.lockTimeouts[mode])
+		}
+	})
+	write("mvcc_deadlocks_total", "counter", "Lock timeouts that broke a wait-for cycle.", func(c *Collector) {
+		fmt.Fprintf(&b, "mvcc_deadlocks_total{%s} %d\n", labels("engine", c.name), c.deadlocks)
+	})
+	write("mvcc_versions_created_total", "counter", "Row versions written.", func(c *Collector) {
+		fmt.Fprintf(&b, "mvcc_versions_created_total{%s} %d\n", labels("engine", c.name), c.versions)
+	})
+	write("mvcc_version_chain_length", "histogram", "Retained versions per key.", func(c *Collector) {
+		s, ok := stats[c]
+		if !ok {
+			return
+		}
+
+		h := newHistogram(ChainLengthBuckets)
+		for _, length := range s.ChainLengths {
+			h.observe(float64(length))
+		}
+		writeHistogram(&b, "mvcc_version_chain_length", labels("engine", c.name), h)
+	})
+	write("mvcc_undo_log_records", "gauge", "Records held in undo logs.", func(c *Collector) {
+		s, ok := stats[c]
+		if !ok {
+			return
+		}
+
+		fmt.Fprintf(&b, "mvcc_undo_log_records{%s} %d\n", labels("engine", c.name), s.UndoLogRecords)
+	})
+	write("mvcc_purged_undo_logs_total", "counter", "Per-transaction undo logs purged.", func(c *Collector) {
+		fmt.Fprintf(&b, "mvcc_purged_undo_logs_total{%s} %d\n", labels("engine", c.name), c.purged)
+	})
+	write("mvcc_vacuum_runs_total", "counter", "Vacuum runs.", func(c *Collector) {
+		fmt.Fprintf(&b, "mvcc_vacuum_runs_total{%s} %d\n", labels("engine", c.name), c.vacuums)
+	})
+	write("mvcc_vacuum_removed_versions_total", "counter", "Versions removed by vacuum.", func(c *Collector) {
+		fmt.Fprintf(&b, "mvcc_vacuum_removed_versions_total{%s} %d\n", labels("engine", c.name), c.vacuumed)
+	})
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (c *Collector) stats() (engine.Stats, bool) {
+	c.mu.Lock()
+	e, ok := c.engine.(engine.StatsEngine)
+	c.mu.Unlock()
+
+	if !ok {
+		return engine.Stats{}, false
+	}
+
+	return e.Stats(), true
+}
+
+func writeByLevel(b *strings.Builder, name, engineName string, values map[engine.IsolationLevel]uint64) {
+	for _, level := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s{%s} %d\n", name, labels("engine", engineName, "level", string(level)), values[level])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 名前と値を交互に並べる。値はPrometheusのテキスト形式に従って\、"、改行だけをエスケープする
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+
+	return b.String()
+}
+
+func writeHistogram(b *strings.Builder, name, labels string, h *histogram) {
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(b, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
@@ -0,0 +1,151 @@
+package metrics_test
+
+import (
+	"errors"
+	"io"
+	"mvcc-go/clock"
+	"mvcc-go/engine"
+	"mvcc-go/engine/delta"
+	"mvcc-go/engine/locking"
+	"mvcc-go/lock"
+	"mvcc-go/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	deltaCollector := registry.NewCollector("delta")
+	deltaEngine := delta.NewDeltaEngine(engine.WithObserver(deltaCollector))
+	deltaCollector.SetEngine(deltaEngine)
+
+	clk := clock.NewFake(time.Now())
+	lockingCollector := registry.NewCollector("locking")
+	lockingEngine := locking.NewLockingEngine(engine.WithObserver(lockingCollector), engine.WithClock(clk))
+	lockingCollector.SetEngine(lockingEngine)
+
+	for _, value := range []string{"value0", "value1"} {
+		tx := deltaEngine.Begin(engine.RepeatableRead)
+		err := tx.Set("key", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := deltaEngine.Begin(engine.ReadCommitted)
+
+	tx1 := lockingEngine.Begin(engine.ReadCommitted)
+	err := tx1.Set("key", "value0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2 := lockingEngine.Begin(engine.ReadCommitted)
+	err = clk.AdvanceWhenBlocked(lock.Timeout, func() error {
+		_, err := tx2.Get("key")
+		return err
+	})
+	if !errors.Is(err, lock.ErrTimeout) {
+		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
+	}
+
+	body := scrape(t, registry)
+	for _, want := range []string{
+		`mvcc_active_transactions{engine="delta"} 1`,
+		`mvcc_active_transactions{engine="locking"} 2`,
+		`mvcc_commits_total{engine="delta",level="repeatable_read"} 2`,
+		`mvcc_transactions_begun_total{engine="delta",level="read_committed"} 1`,
+		`mvcc_lock_timeouts_total{engine="locking",mode="s"} 1`,
+		`mvcc_lock_wait_seconds_count{engine="locking",mode="x"} 1`,
+		`mvcc_lock_wait_seconds_bucket{engine="locking",mode="s",le="0.1"} 1`,
+		`mvcc_lock_wait_seconds_bucket{engine="locking",mode="s",le="+Inf"} 1`,
+		`mvcc_deadlocks_total{engine="locking"} 0`,
+		`mvcc_versions_created_total{engine="delta"} 2`,
+		`mvcc_version_chain_length_bucket{engine="delta",le="1"} 1`,
+		`mvcc_undo_log_records{engine="delta"} 0`,
+		`mvcc_purged_undo_logs_total{engine="delta"} 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("expected %q in response", want)
+		}
+	}
+
+	err = reader.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func scrape(t *testing.T, registry *metrics.Registry) string {
+	t.Helper()
+
+	server := httptest.NewServer(registry.Handler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(body))
+
+	return string(body)
+}
+
+func TestDeadlocks(t *testing.T) {
+	registry := metrics.NewRegistry()
+	collector := registry.NewCollector("locking")
+	clk := clock.NewFake(time.Now())
+	e := locking.NewLockingEngine(engine.WithObserver(collector), engine.WithClock(clk))
+
+	tx1 := e.Begin(engine.ReadCommitted)
+	tx2 := e.Begin(engine.ReadCommitted)
+	for tx, key := range map[engine.Tx]string{tx1: "a", tx2: "b"} {
+		err := tx.Set(key, "value0")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 両方が待ちに入ってから同時にタイムアウトする。先にタイムアウトした方が循環を解く
+	errs := make(chan error, 1)
+	go func() { errs <- tx1.Set("b", "value1") }()
+	clk.BlockUntil(1)
+	err := clk.AdvanceWhenBlocked(lock.Timeout, func() error { return tx2.Set("a", "value1") })
+	for _, err := range []error{err, <-errs} {
+		if !errors.Is(err, lock.ErrTimeout) {
+			t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
+		}
+	}
+
+	body := scrape(t, registry)
+	for _, want := range []string{
+		`mvcc_lock_timeouts_total{engine="locking",mode="x"} 2`,
+		`mvcc_deadlocks_total{engine="locking"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("expected %q in response", want)
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCollector("a\"b\\c\nd")
+
+	want := `mvcc_active_transactions{engine="a\"b\\c\nd"} 0`
+	if body := scrape(t, registry); !strings.Contains(body, want+"\n") {
+		t.Errorf("expected %q in response", want)
+	}
+}
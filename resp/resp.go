@@ -0,0 +1,142 @@
+// Redisのクライアントから使えるように、RESP2でGET・SET・DEL・MULTI・EXEC・DISCARD・WATCHを受け付ける。
+//
+//	ISOLATION [read_committed|repeatable_read]   # 接続ごとの分離レベル。引数がなければ今の分離レベルを返す
+//
+// MULTIからEXECまでは接続ごとに1つのengine.Txを使い、キューに入れたコマンドをEXECでまとめて実行してコミットする。
+// WATCHしたキーは、WATCHした時点からEXECまでに他のトランザクションが新しいバージョンをコミットしていれば
+// EXECを中止してnullを返す
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errProtocol = errors.New("protocol error")
+
+// Redisと同じ上限。ヘッダーの数を信じて先に確保せず、受け取った分だけ増やす
+const (
+	maxArgs    = 1024 * 1024
+	maxBulkLen = 512 * 1024 * 1024
+)
+
+// クライアントから受け取るコマンド。"*<n>\r\n$<len>\r\n...\r\n"の配列か、空白で区切った1行（inline）
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length %q", errProtocol, line)
+	}
+
+	args := make([]string, 0, min(n, 16))
+	for range n {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errProtocol, line)
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length %q", errProtocol, line)
+		}
+
+		var b strings.Builder
+		_, err = io.CopyN(&b, r, int64(size))
+		if err != nil {
+			return nil, err
+		}
+
+		crlf := make([]byte, 2)
+		_, err = io.ReadFull(r, crlf)
+		if err != nil {
+			return nil, err
+		}
+		if string(crlf) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string is not terminated by CRLF", errProtocol)
+		}
+		args = append(args, b.String())
+	}
+
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// クライアントへの応答
+type reply interface {
+	writeTo(w *bufio.Writer)
+}
+
+type simpleString string
+
+func (s simpleString) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+// "ERR ..."のように種類から始める
+type errorReply string
+
+func (e errorReply) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "-%s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(string(e)))
+}
+
+func errorf(format string, args ...any) errorReply {
+	return errorReply("ERR " + fmt.Sprintf(format, args...))
+}
+
+type integer int
+
+func (i integer) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, ":%d\r\n", i)
+}
+
+type bulkString string
+
+func (b bulkString) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(b), string(b))
+}
+
+// 存在しないキーのGET
+type nullBulk struct{}
+
+func (nullBulk) writeTo(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+type array []reply
+
+func (a array) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "*%d\r\n", len(a))
+	for _, r := range a {
+		r.writeTo(w)
+	}
+}
+
+// WATCHしたキーが変わって中止したEXEC
+type nullArray struct{}
+
+func (nullArray) writeTo(w *bufio.Writer) {
+	w.WriteString("*-1\r\n")
+}
@@ -0,0 +1,467 @@
+package resp_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mvcc-go/engine"
+	"mvcc-go/engine/locking"
+	"mvcc-go/engine/registry"
+	"mvcc-go/resp"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// テスト用の最小限のRESPクライアント。応答はredis-cliに似た形の文字列にする
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) do(args ...string) string {
+	c.t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	return c.send(b.String())
+}
+
+// 生のバイト列を送って応答を1つ読む
+func (c *client) send(raw string) string {
+	c.t.Helper()
+
+	_, err := c.conn.Write([]byte(raw))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return c.read()
+}
+
+func (c *client) read() string {
+	c.t.Helper()
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return "(error) " + line[1:]
+	case ':':
+		return "(integer) " + line[1:]
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		b := make([]byte, n+2)
+		_, err := io.ReadFull(c.r, b)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return strconv.Quote(string(b[:n]))
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+
+	c.t.Fatalf("unexpected reply %q", line)
+	return ""
+}
+
+func serve(t *testing.T, e engine.Engine, opts ...resp.Option) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := resp.NewServer(e, opts...)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	return l.Addr().String()
+}
+
+type step struct {
+	args []string
+	want string
+}
+
+func run(t *testing.T, c *client, steps []step) {
+	t.Helper()
+
+	for _, s := range steps {
+		if got := c.do(s.args...); got != s.want {
+			t.Errorf("%v: expected %s, but got %s", s.args, s.want, got)
+		}
+	}
+}
+
+func args(s string) []string {
+	return strings.Fields(s)
+}
+
+func TestCommands(t *testing.T) {
+	for _, name := range registry.Names() {
+		t.Run(name, func(t *testing.T) {
+			newEngine, err := registry.Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := dial(t, serve(t, newEngine()))
+
+			run(t, c, []step{
+				{args("PING"), "PONG"},
+				{args("set k v1"), "OK"},
+				{args("GET k"), `"v1"`},
+				{[]string{"SET", "k", "with space"}, "OK"},
+				{args("GET k"), `"with space"`},
+				{args("SET"), "(error) ERR wrong number of arguments for 'set' command"},
+				{args("GET missing"), "(nil)"},
+				{args("DEL k missing"), "(integer) 1"},
+				{args("GET k"), "(nil)"},
+				{args("DEL k"), "(integer) 0"},
+				{args("FLUSHALL"), "(error) ERR unknown command 'FLUSHALL'"},
+				{args("ISOLATION"), `"repeatable_read"`},
+				{args("ISOLATION serializable"), `(error) ERR unknown isolation level "serializable" (available: read_committed, repeatable_read)`},
+			})
+
+			// telnetで打つようなinlineのコマンド
+			if got := c.send("SET k v2\r\n"); got != "OK" {
+				t.Errorf("expected OK, but got %s", got)
+			}
+			if got := c.send("GET k\r\n"); got != `"v2"` {
+				t.Errorf(`expected "v2", but got %s`, got)
+			}
+		})
+	}
+}
+
+func TestMulti(t *testing.T) {
+	newEngine, err := registry.Lookup("appendonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, newEngine())
+	c1, c2 := dial(t, addr), dial(t, addr)
+
+	run(t, c1, []step{
+		{args("EXEC"), "(error) ERR EXEC without MULTI"},
+		{args("MULTI"), "OK"},
+		{args("SET a 1"), "QUEUED"},
+		{args("GET a"), "QUEUED"},
+		{args("MULTI"), "(error) ERR MULTI calls can not be nested"},
+	})
+
+	// コミットするまで他の接続からは見えない
+	run(t, c2, []step{{args("GET a"), "(nil)"}})
+
+	run(t, c1, []step{
+		{args("DEL a"), "QUEUED"},
+		{args("SET b 2"), "QUEUED"},
+		{args("EXEC"), `[OK, "1", (integer) 1, OK]`},
+		{args("MULTI"), "OK"},
+		{args("SET b 3"), "QUEUED"},
+		{args("DISCARD"), "OK"},
+		{args("GET b"), `"2"`},
+		{args("MULTI"), "OK"},
+		{args("SET b"), "(error) ERR wrong number of arguments for 'set' command"},
+		{args("SET b 4"), "QUEUED"},
+		{args("EXEC"), "(error) EXECABORT Transaction discarded because of previous errors."},
+		{args("GET b"), `"2"`},
+	})
+}
+
+func TestWatch(t *testing.T) {
+	for _, name := range []string{"appendonly", "delta"} {
+		t.Run(name, func(t *testing.T) {
+			newEngine, err := registry.Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := serve(t, newEngine())
+			c1, c2 := dial(t, addr), dial(t, addr)
+
+			run(t, c1, []step{
+				{args("SET counter 1"), "OK"},
+				{args("WATCH counter"), "OK"},
+				{args("GET counter"), `"1"`},
+			})
+			run(t, c2, []step{{args("SET counter 5"), "OK"}})
+			run(t, c1, []step{
+				{args("MULTI"), "OK"},
+				{args("SET counter 2"), "QUEUED"},
+				{args("EXEC"), "(nil)"},
+				{args("GET counter"), `"5"`},
+
+				// 変わっていなければ実行する。EXECでWATCHは外れる
+				{args("WATCH counter"), "OK"},
+				{args("MULTI"), "OK"},
+				{args("SET counter 6"), "QUEUED"},
+				{args("EXEC"), "[OK]"},
+			})
+			run(t, c2, []step{{args("SET counter 7"), "OK"}})
+			run(t, c1, []step{
+				{args("MULTI"), "OK"},
+				{args("SET other 1"), "QUEUED"},
+				{args("EXEC"), "[OK]"},
+
+				// 削除も変更として扱う
+				{args("WATCH counter"), "OK"},
+				{args("UNWATCH"), "OK"},
+				{args("WATCH counter"), "OK"},
+			})
+			run(t, c2, []step{{args("DEL counter"), "(integer) 1"}})
+			run(t, c1, []step{
+				{args("MULTI"), "OK"},
+				{args("WATCH counter"), "(error) ERR WATCH inside MULTI is not allowed"},
+				{args("GET counter"), "QUEUED"},
+				{args("EXEC"), "(nil)"},
+			})
+		})
+	}
+
+	t.Run("locking", func(t *testing.T) {
+		newEngine, err := registry.Lookup("locking")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, serve(t, newEngine()))
+
+		run(t, c, []step{{args("WATCH k"), "(error) ERR WATCH is not supported by this engine"}})
+	})
+}
+
+// MULTIで始めたトランザクションのスナップショットから読む
+func TestIsolation(t *testing.T) {
+	newEngine, err := registry.Lookup("appendonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, newEngine(), resp.WithLevel(engine.ReadCommitted))
+	c1, c2 := dial(t, addr), dial(t, addr)
+
+	for _, tt := range []struct {
+		level string
+		want  string
+	}{
+		{"repeatable_read", `["1"]`},
+		{"read_committed", `["2"]`},
+	} {
+		run(t, c2, []step{{args("SET k 1"), "OK"}})
+		run(t, c1, []step{
+			{args("ISOLATION " + tt.level), "OK"},
+			{args("MULTI"), "OK"},
+			{args("ISOLATION read_committed"), "(error) ERR ISOLATION inside MULTI is not allowed"},
+			{args("GET k"), "QUEUED"},
+		})
+		run(t, c2, []step{{args("SET k 2"), "OK"}})
+		run(t, c1, []step{{args("EXEC"), tt.want}})
+	}
+
+	// repeatable_readでは、MULTIの後にコミットされたキーに書くと中止する
+	run(t, c1, []step{
+		{args("ISOLATION"), `"read_committed"`},
+		{args("ISOLATION repeatable_read"), "OK"},
+		{args("MULTI"), "OK"},
+		{args("SET k 3"), "QUEUED"},
+	})
+	run(t, c2, []step{{args("SET k 4"), "OK"}})
+	run(t, c1, []step{
+		{args("EXEC"), "(nil)"},
+		{args("GET k"), `"4"`},
+	})
+}
+
+// EXECを途中で中止したら、それまでに実行した書き込みも残さない
+func TestExecAtomic(t *testing.T) {
+	for _, name := range []string{"appendonly", "delta"} {
+		t.Run(name, func(t *testing.T) {
+			newEngine, err := registry.Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := serve(t, newEngine())
+			c1, c2 := dial(t, addr), dial(t, addr)
+
+			run(t, c1, []step{
+				{args("MULTI"), "OK"},
+				{args("SET a 1"), "QUEUED"},
+				{args("SET b 1"), "QUEUED"},
+			})
+			run(t, c2, []step{{args("SET b 2"), "OK"}})
+			run(t, c1, []step{{args("EXEC"), "(nil)"}})
+			run(t, c2, []step{
+				{args("GET a"), "(nil)"},
+				{args("GET b"), `"2"`},
+			})
+		})
+	}
+}
+
+type beginCounter struct {
+	engine.NopObserver
+	begins atomic.Int64
+}
+
+func (o *beginCounter) OnBegin(txID int, level engine.IsolationLevel) {
+	o.begins.Add(1)
+}
+
+// PINGはMULTIの外でも中でもトランザクションを始めない
+func TestPing(t *testing.T) {
+	observer := &beginCounter{}
+	c := dial(t, serve(t, locking.NewLockingEngine(engine.WithObserver(observer))))
+
+	run(t, c, []step{
+		{args("PING"), "PONG"},
+		{args("PING hello"), `"hello"`},
+	})
+	if n := observer.begins.Load(); n != 0 {
+		t.Errorf("expected no transactions for PING, but got %d", n)
+	}
+
+	run(t, c, []step{
+		{args("MULTI"), "OK"},
+		{args("PING"), "QUEUED"},
+		{args("EXEC"), "[PONG]"},
+	})
+	if n := observer.begins.Load(); n != 1 {
+		t.Errorf("expected only the MULTI transaction, but got %d", n)
+	}
+}
+
+var errAbort = errors.New("abort failed")
+
+// Abortが失敗するトランザクションを返す
+type failingAbortEngine struct {
+	engine.Engine
+}
+
+func (e failingAbortEngine) Begin(level engine.IsolationLevel, opts ...engine.TxOption) engine.Tx {
+	return failingAbortTx{e.Engine.Begin(level, opts...)}
+}
+
+type failingAbortTx struct {
+	engine.Tx
+}
+
+func (tx failingAbortTx) Abort() error {
+	return errors.Join(errAbort, tx.Tx.Abort())
+}
+
+// 取り消しに失敗したことを応答で知らせる
+func TestAbortError(t *testing.T) {
+	e := locking.NewLockingEngine(engine.WithLockTimeout(10 * time.Millisecond))
+	c := dial(t, serve(t, failingAbortEngine{e}))
+
+	run(t, c, []step{
+		{args("MULTI"), "OK"},
+		{args("SET k v"), "QUEUED"},
+		{args("DISCARD"), "(error) ERR abort failed"},
+		{args("EXEC"), "(error) ERR EXEC without MULTI"},
+	})
+
+	holder := e.Begin(engine.RepeatableRead)
+	err := holder.Set("k", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Abort()
+
+	if got := c.do("GET", "k"); !strings.Contains(got, "timeout") || !strings.HasSuffix(got, " abort failed") {
+		t.Errorf("expected lock timeout and abort failure, but got %s", got)
+	}
+}
+
+// 長さのヘッダーを信じて確保せず、上限を超えたらプロトコルエラーで接続を切る
+func TestOversizedHeader(t *testing.T) {
+	newEngine, err := registry.Lookup("delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, newEngine())
+
+	for _, tt := range []struct {
+		raw  string
+		want string
+	}{
+		{"*9223372036854775807\r\n", `(error) ERR protocol error: invalid multibulk length "*9223372036854775807"`},
+		{"*1048577\r\n", `(error) ERR protocol error: invalid multibulk length "*1048577"`},
+		{"*1\r\n$9223372036854775807\r\n", `(error) ERR protocol error: invalid bulk length "$9223372036854775807"`},
+		{"*1\r\n$536870913\r\n", `(error) ERR protocol error: invalid bulk length "$536870913"`},
+	} {
+		c := dial(t, addr)
+		if got := c.send(tt.raw); got != tt.want {
+			t.Errorf("%q: expected %s, but got %s", tt.raw, tt.want, got)
+		}
+		if _, err := c.r.ReadByte(); err == nil {
+			t.Errorf("%q: expected the connection to be closed", tt.raw)
+		}
+	}
+
+	// サーバーは動き続けている
+	run(t, dial(t, addr), []step{{args("PING"), "PONG"}})
+}
+
+func TestPipeline(t *testing.T) {
+	newEngine, err := registry.Lookup("delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, serve(t, newEngine()))
+
+	got := []string{c.send("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"), c.read()}
+	if strings.Join(got, " ") != `OK "v"` {
+		t.Errorf(`expected OK "v", but got %v`, got)
+	}
+
+	if got := c.send("*1\r\n$4\r\nQUIT\r\n"); got != "OK" {
+		t.Errorf("expected OK, but got %s", got)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
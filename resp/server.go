@@ -0,0 +1,443 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"net"
+	"strings"
+	"sync"
+)
+
+// エンジンには削除がないので、DELは墓標を書く。値と区別できるように値には印をつけて保存する
+const (
+	tombstone   = "-"
+	valuePrefix = "+"
+)
+
+type Option func(*Server)
+
+// 新しい接続の分離レベル。ISOLATIONで接続ごとに変えられる
+func WithLevel(level engine.IsolationLevel) Option {
+	return func(s *Server) {
+		s.level = level
+	}
+}
+
+type Server struct {
+	engine engine.Engine
+	level  engine.IsolationLevel
+
+	// Redisと同じく、EXECと自動コミットの書き込みは1つずつ実行する。
+	// WATCHしたキーのバージョンを調べてからコミットするまでに他の書き込みが入らない
+	mu sync.Mutex
+
+	connsMu   sync.Mutex // 以下を守る
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewServer(e engine.Engine, opts ...Option) *Server {
+	s := &Server{
+		engine:    e,
+		level:     engine.RepeatableRead,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Closeされるまで接続を受け付ける。Closeで止まったときはnilを返す
+func (s *Server) Serve(l net.Listener) error {
+	s.connsMu.Lock()
+	if s.closed {
+		s.connsMu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listeners[l] = struct{}{}
+	s.connsMu.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.connsMu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.connsMu.Unlock()
+
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.connsMu.Lock()
+		if s.closed {
+			s.connsMu.Unlock()
+			nc.Close()
+			continue
+		}
+		s.conns[nc] = struct{}{}
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+
+		go s.serveConn(nc)
+	}
+}
+
+// 受け付けを止めて全ての接続を切り、実行中のトランザクションを終わらせる
+func (s *Server) Close() error {
+	s.connsMu.Lock()
+	s.closed = true
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for nc := range s.conns {
+		nc.Close()
+	}
+	s.connsMu.Unlock()
+
+	s.wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	c := &conn{server: s, level: s.level}
+	defer func() {
+		c.discard()
+		nc.Close()
+
+		s.connsMu.Lock()
+		delete(s.conns, nc)
+		s.connsMu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	for {
+		args, err := readCommand(r)
+		if errors.Is(err, errProtocol) {
+			errorf("%v", err).writeTo(w)
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		reply, quit := c.exec(args)
+		reply.writeTo(w)
+
+		// パイプラインで続けて送られてきたコマンドの応答はまとめて書く
+		if r.Buffered() == 0 || quit {
+			err := w.Flush()
+			if err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// 正の数なら引数の数（コマンド名を含む）、負の数なら最小の数
+var arity = map[string]int{
+	"GET":       2,
+	"SET":       3,
+	"DEL":       -2,
+	"PING":      -1,
+	"MULTI":     1,
+	"EXEC":      1,
+	"DISCARD":   1,
+	"WATCH":     -2,
+	"UNWATCH":   1,
+	"ISOLATION": -1,
+	"QUIT":      1,
+}
+
+// MULTIの中でキューに入れるコマンド
+var queueable = map[string]bool{"GET": true, "SET": true, "DEL": true, "PING": true}
+
+type conn struct {
+	server  *Server
+	level   engine.IsolationLevel
+	tx      engine.Tx      // MULTIからEXEC・DISCARDまで
+	queue   [][]string     // MULTIの後に受け取ったコマンド
+	dirty   bool           // キューに入れるときに誤りがあったので、EXECを実行しない
+	watched map[string]int // キー -> WATCHしたときのバージョン
+}
+
+func (c *conn) exec(args []string) (r reply, quit bool) {
+	name := strings.ToUpper(args[0])
+
+	n, ok := arity[name]
+	if !ok {
+		c.dirty = c.tx != nil
+		return errorf("unknown command '%s'", args[0]), false
+	}
+	if (n > 0 && len(args) != n) || (n < 0 && len(args) < -n) {
+		c.dirty = c.tx != nil
+		return errorf("wrong number of arguments for '%s' command", strings.ToLower(name)), false
+	}
+
+	if c.tx != nil && queueable[name] {
+		c.queue = append(c.queue, append([]string{name}, args[1:]...))
+		return simpleString("QUEUED"), false
+	}
+
+	switch name {
+	case "MULTI":
+		if c.tx != nil {
+			return errorf("MULTI calls can not be nested"), false
+		}
+		c.tx = c.server.engine.Begin(c.level)
+		return simpleString("OK"), false
+	case "EXEC":
+		return c.execQueue(), false
+	case "DISCARD":
+		if c.tx == nil {
+			return errorf("DISCARD without MULTI"), false
+		}
+		return c.abort(simpleString("OK")), false
+	case "PING":
+		return ping(args[1:]), false
+	case "WATCH":
+		return c.watch(args[1:]...), false
+	case "UNWATCH":
+		c.watched = nil
+		return simpleString("OK"), false
+	case "ISOLATION":
+		return c.isolation(args[1:]...), false
+	case "QUIT":
+		return simpleString("OK"), true
+	}
+
+	return c.autocommit(append([]string{name}, args[1:]...)), false
+}
+
+// 1つのコマンドを自分だけのトランザクションで実行する
+func (c *conn) autocommit(args []string) reply {
+	if args[0] != "GET" {
+		c.server.mu.Lock()
+		defer c.server.mu.Unlock()
+	}
+
+	tx := c.server.engine.Begin(c.level)
+	r, err := run(tx, args)
+	if err != nil {
+		return errorf("%v", errors.Join(err, tx.Abort()))
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorf("%v", err)
+	}
+
+	return r
+}
+
+// WATCHしたキーが変わっていたり、repeatable_readでMULTIの後にコミットされたキーに書いたりしたらnullを返す。
+// 途中で中止したときはそれまでの書き込みもアボートする
+func (c *conn) execQueue() reply {
+	if c.tx == nil {
+		return errorf("EXEC without MULTI")
+	}
+	if c.dirty {
+		return c.abort(errorReply("EXECABORT Transaction discarded because of previous errors."))
+	}
+
+	// 中止したときの後始末もほかの書き込みと重ならないようにする
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	for key, version := range c.watched {
+		if c.server.version(key) != version {
+			return c.abort(nullArray{})
+		}
+	}
+
+	replies := make(array, 0, len(c.queue))
+	for _, args := range c.queue {
+		r, err := run(c.tx, args)
+		if errors.Is(err, engine.ErrSerialization) {
+			return c.abort(nullArray{})
+		}
+		if err != nil {
+			r = errorf("%v", err)
+		}
+		replies = append(replies, r)
+	}
+
+	err := c.tx.Commit()
+	c.tx = nil
+	c.discard()
+	if err != nil {
+		return errorf("%v", err)
+	}
+
+	return replies
+}
+
+// MULTIで始めたトランザクションを終わらせ、キューとWATCHを捨てる
+func (c *conn) discard() error {
+	var err error
+	if c.tx != nil {
+		err = c.tx.Abort()
+	}
+
+	c.tx = nil
+	c.queue = nil
+	c.dirty = false
+	c.watched = nil
+
+	return err
+}
+
+// discardしてrを返す。アボートに失敗したらそのエラーを返す
+func (c *conn) abort(r reply) reply {
+	err := c.discard()
+	if err != nil {
+		return errorf("%v", err)
+	}
+
+	return r
+}
+
+func (c *conn) watch(keys ...string) reply {
+	if c.tx != nil {
+		return errorf("WATCH inside MULTI is not allowed")
+	}
+	if _, ok := c.server.engine.(engine.HistoryEngine); !ok {
+		return errorf("WATCH is not supported by this engine")
+	}
+
+	if c.watched == nil {
+		c.watched = make(map[string]int)
+	}
+	for _, key := range keys {
+		if _, ok := c.watched[key]; !ok {
+			c.watched[key] = c.server.version(key)
+		}
+	}
+
+	return simpleString("OK")
+}
+
+// 今始めたトランザクションから見えるバージョンを書いたトランザクション。バージョンがなければ0
+func (s *Server) version(key string) int {
+	for _, v := range s.engine.(engine.HistoryEngine).History(key) {
+		if v.Visible {
+			return v.BeginTxID
+		}
+	}
+
+	return 0
+}
+
+func (c *conn) isolation(args ...string) reply {
+	if len(args) == 0 {
+		return bulkString(c.level)
+	}
+	if len(args) > 1 {
+		return errorf("syntax error")
+	}
+	if c.tx != nil {
+		return errorf("ISOLATION inside MULTI is not allowed")
+	}
+
+	level, err := registry.ParseLevel(strings.ToLower(args[0]))
+	if err != nil {
+		return errorf("%v", err)
+	}
+	c.level = level
+
+	return simpleString("OK")
+}
+
+// データを読み書きするコマンド。argsの先頭は大文字のコマンド名
+// エンジンには触れない
+func ping(args []string) reply {
+	if len(args) > 0 {
+		return bulkString(args[0])
+	}
+
+	return simpleString("PONG")
+}
+
+func run(tx engine.Tx, args []string) (reply, error) {
+	switch args[0] {
+	case "PING":
+		return ping(args[1:]), nil
+	case "GET":
+		value, ok, err := get(tx, args[1])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nullBulk{}, nil
+		}
+		return bulkString(value), nil
+	case "SET":
+		err := tx.Set(args[1], valuePrefix+args[2])
+		if err != nil {
+			return nil, err
+		}
+		return simpleString("OK"), nil
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			_, ok, err := get(tx, key)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+
+			err = tx.Set(key, tombstone)
+			if err != nil {
+				return nil, err
+			}
+			deleted++
+		}
+		return integer(deleted), nil
+	}
+
+	panic("unknown command: " + args[0])
+}
+
+func get(tx engine.Tx, key string) (value string, ok bool, err error) {
+	stored, err := tx.Get(key)
+	if errors.Is(err, engine.ErrNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok = strings.CutPrefix(stored, valuePrefix)
+
+	return value, ok, nil
+}
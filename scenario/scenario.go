@@ -0,0 +1,470 @@
+// トランザクションの操作を1行ずつ並べたテキストで、期待する結果・エラー・ロック待ちを書いて検査する。
+//
+//	# '#'から行末まではコメント
+//	engines: appendonly delta   # 省略すると全てのエンジン
+//	levels: repeatable_read     # 省略すると全ての分離レベル
+//
+//	tx1: set key=value0
+//	tx1: commit                 # コミット・アボートした後に同じ名前を使うと新しいトランザクションになる
+//	tx2: begin read_committed   # 省略すると最初の操作の前に実行時の分離レベルでBeginする
+//	tx2: set key=value1
+//	tx3: get key -> "value0"    # 値。空白や予約語を含まなければ引用符は省略できる
+//	tx3: get missing -> not found
+//	tx2: commit -> ok
+//	tx3: set key=x -> error: could not serialize   # エラーの文字列に含まれること。"-> error"だけなら何かのエラー
+//	tx4: get key -> blocked -> "value1"            # ロック待ちに入り、再開した後の結果
+//	tx4: gc -> "active=0 removed=0"                # トランザクションを開いたままGCする
+//
+// 期待を書かなかった操作は結果もロック待ちも検査しない。
+// ロック待ちのトランザクションの後の行は、待ちが解けるまで後回しにして実行する（schedule.Scenario.Follow）
+package scenario
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/schedule"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type ExpectKind string
+
+const (
+	ExpectNone     ExpectKind = ""
+	ExpectOK       ExpectKind = "ok"
+	ExpectValue    ExpectKind = "value"
+	ExpectNotFound ExpectKind = "not found"
+	ExpectError    ExpectKind = "error" // Valueが空でなければエラーの文字列に含まれること
+)
+
+type Expect struct {
+	Blocked bool
+	Kind    ExpectKind
+	Value   string
+}
+
+func (e Expect) String() string {
+	parts := make([]string, 0, 2)
+	if e.Blocked {
+		parts = append(parts, "blocked")
+	}
+
+	switch e.Kind {
+	case ExpectValue:
+		parts = append(parts, strconv.Quote(e.Value))
+	case ExpectError:
+		if e.Value != "" {
+			parts = append(parts, "error: "+e.Value)
+		} else {
+			parts = append(parts, "error")
+		}
+	case ExpectOK, ExpectNotFound:
+		parts = append(parts, string(e.Kind))
+	}
+
+	return strings.Join(parts, " -> ")
+}
+
+func (e Expect) empty() bool {
+	return !e.Blocked && e.Kind == ExpectNone
+}
+
+type Step struct {
+	Line   int
+	Tx     string
+	Op     schedule.Op
+	Level  engine.IsolationLevel // Beginのときだけ。空なら実行時の分離レベル
+	Expect Expect
+
+	script int // 何番目のトランザクションか
+	op     int // スクリプトの中の添字。Beginは-1
+}
+
+func (s Step) String() string {
+	op := s.Op.String()
+	if s.Op.Kind == schedule.OpBegin && s.Level != "" {
+		op += " " + string(s.Level)
+	}
+
+	return fmt.Sprintf("%s: %s", s.Tx, op)
+}
+
+type Scenario struct {
+	Name    string
+	Engines []string                // 空なら全てのエンジン
+	Levels  []engine.IsolationLevel // 空なら全ての分離レベル
+	Steps   []Step
+
+	scripts []script
+	order   schedule.Schedule
+}
+
+type script struct {
+	name  string
+	level engine.IsolationLevel
+	ops   []schedule.Op
+}
+
+func ParseFile(path string) (Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	defer f.Close()
+
+	return Parse(path, f)
+}
+
+// エラーは"name:line: "から始まる
+func Parse(name string, r io.Reader) (Scenario, error) {
+	s := Scenario{Name: name}
+	open := make(map[string]int) // トランザクション名 -> 実行中のスクリプトの添字
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+
+		err := s.parseLine(text, line, open)
+		if err != nil {
+			return Scenario{}, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Scenario{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if len(s.Steps) == 0 {
+		return Scenario{}, fmt.Errorf("%s: no steps", name)
+	}
+
+	return s, nil
+}
+
+// 行頭か空白の後の'#'から行末まで
+func stripComment(line string) string {
+	for i, r := range line {
+		if r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func (s *Scenario) parseLine(text string, line int, open map[string]int) error {
+	name, rest, ok := strings.Cut(text, ":")
+	if !ok {
+		return fmt.Errorf("expected \"<tx>: <op>\", but got %q", text)
+	}
+	name, rest = strings.TrimSpace(name), strings.TrimSpace(rest)
+
+	switch name {
+	case "engines":
+		if len(s.Steps) > 0 {
+			return fmt.Errorf("engines must come before steps")
+		}
+		for _, e := range strings.Fields(rest) {
+			if _, err := registry.Lookup(e); err != nil {
+				return err
+			}
+			s.Engines = append(s.Engines, e)
+		}
+		return nil
+	case "levels":
+		if len(s.Steps) > 0 {
+			return fmt.Errorf("levels must come before steps")
+		}
+		for _, l := range strings.Fields(rest) {
+			level, err := registry.ParseLevel(l)
+			if err != nil {
+				return err
+			}
+			s.Levels = append(s.Levels, level)
+		}
+		return nil
+	}
+
+	if strings.ContainsAny(name, " \t") || name == "" {
+		return fmt.Errorf("invalid transaction name %q", name)
+	}
+
+	parts := strings.Split(rest, "->")
+	step, err := parseOp(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return err
+	}
+	step.Line, step.Tx = line, name
+
+	step.Expect, err = parseExpect(parts[1:])
+	if err != nil {
+		return err
+	}
+	if step.Op.Kind == schedule.OpBegin && !step.Expect.empty() {
+		return fmt.Errorf("begin takes no expectation")
+	}
+
+	i, ok := open[name]
+	if !ok {
+		i = len(s.scripts)
+		open[name] = i
+		s.scripts = append(s.scripts, script{name: name})
+		s.order = append(s.order, i) // Begin
+
+		if step.Op.Kind == schedule.OpBegin {
+			s.scripts[i].level = step.Level
+			step.script, step.op = i, -1
+			s.Steps = append(s.Steps, step)
+			return nil
+		}
+	} else if step.Op.Kind == schedule.OpBegin {
+		return fmt.Errorf("%s has already begun", name)
+	}
+
+	s.scripts[i].ops = append(s.scripts[i].ops, step.Op)
+	s.order = append(s.order, i)
+	step.script, step.op = i, len(s.scripts[i].ops)-1
+	s.Steps = append(s.Steps, step)
+
+	if step.Op.Kind == schedule.OpCommit || step.Op.Kind == schedule.OpAbort {
+		delete(open, name)
+	}
+
+	return nil
+}
+
+func parseOp(text string) (Step, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return Step{}, fmt.Errorf("missing operation")
+	}
+
+	arg := func() (string, error) {
+		if len(fields) != 2 {
+			return "", fmt.Errorf("%s takes 1 argument, but got %q", fields[0], text)
+		}
+		return fields[1], nil
+	}
+	noArg := func() error {
+		if len(fields) != 1 {
+			return fmt.Errorf("%s takes no argument, but got %q", fields[0], text)
+		}
+		return nil
+	}
+
+	switch fields[0] {
+	case "begin":
+		step := Step{Op: schedule.Op{Kind: schedule.OpBegin}}
+		switch len(fields) {
+		case 1:
+		case 2:
+			level, err := registry.ParseLevel(fields[1])
+			if err != nil {
+				return Step{}, err
+			}
+			step.Level = level
+		default:
+			return Step{}, fmt.Errorf("begin takes at most 1 argument, but got %q", text)
+		}
+		return step, nil
+	case "get":
+		key, err := arg()
+		return Step{Op: schedule.Get(key)}, err
+	case "set":
+		a, err := arg()
+		if err != nil {
+			return Step{}, err
+		}
+		key, value, ok := strings.Cut(a, "=")
+		if !ok {
+			return Step{}, fmt.Errorf("expected set key=value, but got %q", text)
+		}
+		return Step{Op: schedule.Set(key, value)}, nil
+	case "append":
+		a, err := arg()
+		if err != nil {
+			return Step{}, err
+		}
+		key, value, ok := strings.Cut(a, "+=")
+		if !ok {
+			return Step{}, fmt.Errorf("expected append key+=value, but got %q", text)
+		}
+		return Step{Op: schedule.Append(key, value)}, nil
+	case "commit":
+		return Step{Op: schedule.Commit()}, noArg()
+	case "abort":
+		return Step{Op: schedule.Abort()}, noArg()
+	case "gc":
+		return Step{Op: schedule.GC()}, noArg()
+	}
+
+	return Step{}, fmt.Errorf("unknown operation %q", fields[0])
+}
+
+// "blocked"の後に結果を1つまで書ける
+func parseExpect(parts []string) (Expect, error) {
+	var expect Expect
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if expect.Kind != ExpectNone {
+			return Expect{}, fmt.Errorf("unexpected %q after the result", part)
+		}
+
+		switch {
+		case part == "blocked":
+			if i != 0 {
+				return Expect{}, fmt.Errorf("blocked must come first")
+			}
+			expect.Blocked = true
+		case part == "ok":
+			expect.Kind = ExpectOK
+		case part == "not found":
+			expect.Kind = ExpectNotFound
+		case part == "error":
+			expect.Kind = ExpectError
+		case strings.HasPrefix(part, "error:"):
+			expect.Kind = ExpectError
+			expect.Value = strings.TrimSpace(strings.TrimPrefix(part, "error:"))
+		case strings.HasPrefix(part, `"`):
+			value, err := strconv.Unquote(part)
+			if err != nil {
+				return Expect{}, fmt.Errorf("invalid quoted value %s: %w", part, err)
+			}
+			expect.Kind, expect.Value = ExpectValue, value
+		case part == "" || strings.ContainsAny(part, " \t"):
+			return Expect{}, fmt.Errorf("invalid expectation %q (quote values with spaces)", part)
+		default:
+			expect.Kind, expect.Value = ExpectValue, part
+		}
+	}
+
+	return expect, nil
+}
+
+// 期待と異なった操作
+type Mismatch struct {
+	Step Step
+	Got  string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("line %d: %s: expected %s, but got %s", m.Step.Line, m.Step, m.Step.Expect, m.Got)
+}
+
+type Report struct {
+	Level      engine.IsolationLevel
+	Mismatches []Mismatch
+	Trace      string // 実際に実行した順の操作と結果。トランザクションはファイルでの名前で表す
+}
+
+func (r Report) Passed() bool {
+	return len(r.Mismatches) == 0
+}
+
+// levelはbeginで分離レベルを指定しなかったトランザクションに使う
+func (s Scenario) Run(newEngine func(opts ...engine.Option) engine.Engine, level engine.IsolationLevel) (Report, error) {
+	scripts := make([]schedule.Script, len(s.scripts))
+	for i, sc := range s.scripts {
+		scripts[i] = schedule.Script{Level: sc.level, Ops: sc.ops}
+		if sc.level == "" {
+			scripts[i].Level = level
+		}
+	}
+
+	result, err := schedule.Scenario{NewEngine: newEngine, Scripts: scripts}.Follow(s.order)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Level: level, Trace: s.trace(result)}
+	blocked := blockedOps(result)
+	for _, step := range s.Steps {
+		if step.Expect.empty() {
+			continue
+		}
+
+		event := result.Ops[step.script][step.op]
+		wasBlocked := blocked[[2]int{step.script, step.op}]
+		if !step.Expect.Match(wasBlocked, event.Value, event.Err) {
+			report.Mismatches = append(report.Mismatches, Mismatch{Step: step, Got: describe(event, wasBlocked)})
+		}
+	}
+
+	return report, nil
+}
+
+// ロック待ちに入った操作。キーはスクリプトと操作の添字
+func blockedOps(r schedule.Result) map[[2]int]bool {
+	blocked := make(map[[2]int]bool)
+	next := make([]int, len(r.Ops)) // 次に完了する操作の添字。Beginの分だけ1ずらす
+	for _, event := range r.Events {
+		if event.Blocked {
+			blocked[[2]int{event.Tx, next[event.Tx] - 1}] = true
+			continue
+		}
+		next[event.Tx]++
+	}
+
+	return blocked
+}
+
+// 操作がロック待ちに入ったか・結果の値・エラーが期待どおりか。期待を書かなかった操作は常にtrue
+func (e Expect) Match(blocked bool, value string, err error) bool {
+	if e.empty() {
+		return true
+	}
+	if blocked != e.Blocked {
+		return false
+	}
+
+	switch e.Kind {
+	case ExpectOK:
+		return err == nil
+	case ExpectValue:
+		return err == nil && value == e.Value
+	case ExpectNotFound:
+		return errors.Is(err, engine.ErrNotFound)
+	case ExpectError:
+		return err != nil && strings.Contains(err.Error(), e.Value)
+	}
+
+	return true
+}
+
+func describe(event schedule.Event, blocked bool) string {
+	var got string
+	switch {
+	case errors.Is(event.Err, engine.ErrNotFound):
+		got = "not found"
+	case event.Err != nil:
+		got = fmt.Sprintf("error: %v", event.Err)
+	case event.Op.Kind == schedule.OpGet || event.Op.Kind == schedule.OpAppend || event.Op.Kind == schedule.OpGC:
+		got = strconv.Quote(event.Value)
+	default:
+		got = "ok"
+	}
+
+	if blocked {
+		return "blocked -> " + got
+	}
+
+	return got
+}
+
+func (s Scenario) trace(r schedule.Result) string {
+	lines := make([]string, len(r.Events))
+	for i, event := range r.Events {
+		// "tx0 get key -> ..."のtx0をファイルでの名前にする
+		_, rest, _ := strings.Cut(event.String(), " ")
+		lines[i] = fmt.Sprintf("%s: %s", s.scripts[event.Tx].name, rest)
+	}
+
+	return strings.Join(lines, "\n")
+}
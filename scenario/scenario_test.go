@@ -0,0 +1,114 @@
+package scenario_test
+
+import (
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/scenario"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTestdata(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		s, err := scenario.ParseFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		engines := s.Engines
+		if len(engines) == 0 {
+			engines = registry.Names()
+		}
+		levels := s.Levels
+		if len(levels) == 0 {
+			levels = []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead}
+		}
+
+		for _, name := range engines {
+			for _, level := range levels {
+				t.Run(filepath.Base(path)+"/"+name+"/"+string(level), func(t *testing.T) {
+					newEngine, err := registry.Lookup(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					report, err := s.Run(newEngine, level)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, m := range report.Mismatches {
+						t.Error(m)
+					}
+					if !report.Passed() {
+						t.Log("\n" + report.Trace)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestMismatch(t *testing.T) {
+	s, err := scenario.Parse("test", strings.NewReader(`
+tx1: set key=value0
+tx2: get key -> "value0"   # naiveなら見える
+tx2: get missing -> "value"
+tx1: commit -> blocked
+tx2: commit
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Run(func(opts ...engine.Option) engine.Engine {
+		newEngine, _ := registry.Lookup("appendonly")
+		return newEngine(opts...)
+	}, engine.RepeatableRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, len(report.Mismatches))
+	for i, m := range report.Mismatches {
+		got[i] = m.String()
+	}
+	want := []string{
+		`line 3: tx2: get key: expected "value0", but got not found`,
+		`line 4: tx2: get missing: expected "value", but got not found`,
+		`line 5: tx1: commit: expected blocked, but got ok`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected\n%s\nbut got\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{"tx1 get key", `test:1: expected "<tx>: <op>"`},
+		{"tx1: put key=value", `test:1: unknown operation "put"`},
+		{"tx1: set key", `test:1: expected set key=value`},
+		{"tx1: get key -> value with space", `test:1: invalid expectation`},
+		{"tx1: get key -> ok -> blocked", `test:1: unexpected "blocked" after the result`},
+		{"tx1: get key\ntx1: begin", `test:2: tx1 has already begun`},
+		{"tx1: begin serializable", `test:1: unknown isolation level "serializable"`},
+		{"tx1: get key\nengines: naive", `test:2: engines must come before steps`},
+		{"engines: oracle", `test:1: unknown engine "oracle"`},
+		{"# only comments", `test: no steps`},
+	}
+
+	for _, c := range cases {
+		_, err := scenario.Parse("test", strings.NewReader(c.input))
+		if err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("%q: expected error starting with %q, but got %v", c.input, c.want, err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"mvcc-go/clock"
+	"mvcc-go/engine"
+	"mvcc-go/lock"
+	"sync"
+	"time"
+)
+
+type signal struct {
+	parked   bool
+	deadline time.Time // parkedのとき、待ちがタイムアウトする時刻
+	resume   chan struct{}
+	value    string
+	err      error
+}
+
+// ロック待ちに入るたびにrunnerへ制御を返す時計。時刻はステップごとに1nsずつ進む
+type stepClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	signals chan<- signal
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *stepClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = t
+}
+
+// lock.Managerがロックを待つ直前に呼ばれる。再開されたら発火済みのタイマーを返して待ち直させる
+func (c *stepClock) NewTimer(d time.Duration) clock.Timer {
+	resume := make(chan struct{})
+	c.signals <- signal{parked: true, resume: resume, deadline: c.Now().Add(d)}
+	<-resume
+
+	t := firedTimer{c: make(chan time.Time, 1)}
+	t.c <- c.Now()
+
+	return t
+}
+
+type firedTimer struct {
+	c chan time.Time
+}
+
+func (t firedTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t firedTimer) Stop() bool {
+	return false
+}
+
+type worker struct {
+	script Script
+	tx     engine.Tx
+	next   int // 次に実行するOpの添字、-1はBegin
+	step   chan struct{}
+	resume chan struct{} // ロック待ちの間だけnil以外
+	// ロック待ちがタイムアウトする時刻。1ステップの中で待ち直すこともあるので待つたびに更新する
+	deadline time.Time
+}
+
+func (w *worker) op() Op {
+	if w.next < 0 {
+		return Op{Kind: OpBegin}
+	}
+
+	return w.script.Ops[w.next]
+}
+
+func (w *worker) done() bool {
+	return w.next >= len(w.script.Ops)
+}
+
+// 同時に動くgoroutineは常に1つだけになるように、workerを1つ進めては止まるまで待つ
+type runner struct {
+	engine  engine.Engine
+	clock   *stepClock
+	signals chan signal
+	workers []*worker
+	result  Result
+}
+
+func newRunner(s Scenario) *runner {
+	signals := make(chan signal)
+	c := &stepClock{now: time.Unix(0, 0), signals: signals}
+
+	r := &runner{
+		engine:  s.NewEngine(engine.WithClock(c), engine.WithLockTimeout(lock.Timeout)),
+		clock:   c,
+		signals: signals,
+		workers: make([]*worker, len(s.Scripts)),
+	}
+	r.result = Result{
+		Engine: r.engine,
+		Ops:    make([][]Event, len(s.Scripts)),
+	}
+
+	for i, script := range s.Scripts {
+		r.workers[i] = &worker{
+			script: script,
+			next:   -1,
+			step:   make(chan struct{}),
+		}
+	}
+
+	return r
+}
+
+func (r *runner) start() {
+	for _, w := range r.workers {
+		go r.work(w)
+	}
+}
+
+func (r *runner) work(w *worker) {
+	for range w.step {
+		value, err := r.do(w)
+		r.signals <- signal{value: value, err: err}
+	}
+}
+
+func (r *runner) do(w *worker) (string, error) {
+	op := w.op()
+
+	switch op.Kind {
+	case OpBegin:
+		w.tx = r.engine.Begin(w.script.Level)
+		return "", nil
+	case OpGet:
+		return w.tx.Get(op.Key)
+	case OpSet:
+		return "", w.tx.Set(op.Key, op.Value)
+	case OpAppend:
+		list, err := w.tx.Get(op.Key)
+		if err != nil && !errors.Is(err, engine.ErrNotFound) {
+			return "", err
+		}
+		if list != "" {
+			list += ","
+		}
+		list += op.Value
+		return list, w.tx.Set(op.Key, list)
+	case OpCommit:
+		return "", w.tx.Commit()
+	case OpAbort:
+		return "", w.tx.Abort()
+	case OpGC:
+		active, removed := r.engine.GC()
+		return fmt.Sprintf("active=%d removed=%d", active, removed), nil
+	}
+
+	panic("unknown op: " + op.Kind)
+}
+
+func (r *runner) step(i int) {
+	r.clock.set(r.clock.Now().Add(time.Nanosecond))
+
+	r.workers[i].step <- struct{}{}
+	r.wait(i)
+}
+
+func (r *runner) retry(i int) {
+	close(r.workers[i].resume)
+	r.wait(i)
+}
+
+// workerが操作を終えるかロック待ちに入るまで待つ
+func (r *runner) wait(i int) {
+	w := r.workers[i]
+
+	sig := <-r.signals
+	if sig.parked {
+		w.deadline = sig.deadline
+		if w.resume == nil {
+			r.result.Events = append(r.result.Events, Event{Tx: i, Op: w.op(), Blocked: true})
+		}
+		w.resume = sig.resume
+		return
+	}
+
+	w.resume = nil
+
+	event := Event{Tx: i, Op: w.op(), Value: sig.value, Err: sig.err}
+	r.result.Events = append(r.result.Events, event)
+	if w.next >= 0 {
+		r.result.Ops[i] = append(r.result.Ops[i], event)
+	}
+
+	w.next++
+	if w.done() {
+		close(w.step)
+	}
+}
+
+// 直前のステップでロックが解放されたかもしれないので、待っているものを添字順に再開する
+func (r *runner) retryBlocked() {
+	for i, w := range r.workers {
+		if w.resume != nil {
+			r.retry(i)
+		}
+	}
+}
+
+func (r *runner) runnable() []int {
+	runnable := make([]int, 0, len(r.workers))
+	for i, w := range r.workers {
+		if !w.done() && w.resume == nil {
+			runnable = append(runnable, i)
+		}
+	}
+
+	return runnable
+}
+
+// 全員がロック待ちなら最初に期限が来るものをタイムアウトさせる。待っているものがなければfalse
+func (r *runner) timeout() bool {
+	oldest := -1
+	for i, w := range r.workers {
+		if w.resume == nil {
+			continue
+		}
+		if oldest < 0 || w.deadline.Before(r.workers[oldest].deadline) {
+			oldest = i
+		}
+	}
+
+	if oldest < 0 {
+		return false
+	}
+
+	r.clock.set(r.workers[oldest].deadline)
+	r.retry(oldest)
+
+	return true
+}
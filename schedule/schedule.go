@@ -0,0 +1,289 @@
+// トランザクションのスクリプトを決められた順序で1操作ずつ実行するテスト用のスケジューラ
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"mvcc-go/engine"
+	"slices"
+	"strings"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+type OpKind string
+
+const (
+	OpBegin  OpKind = "begin"
+	OpGet    OpKind = "get"
+	OpSet    OpKind = "set"
+	OpAppend OpKind = "append"
+	OpCommit OpKind = "commit"
+	OpAbort  OpKind = "abort"
+	OpGC     OpKind = "gc"
+)
+
+type Op struct {
+	Kind  OpKind
+	Key   string
+	Value string
+}
+
+func Get(key string) Op {
+	return Op{Kind: OpGet, Key: key}
+}
+
+func Set(key, value string) Op {
+	return Op{Kind: OpSet, Key: key, Value: value}
+}
+
+// keyの値の末尾に","区切りでvalueを足す。同じステップの中でGetしてからSetする
+func Append(key, value string) Op {
+	return Op{Kind: OpAppend, Key: key, Value: value}
+}
+
+func Commit() Op {
+	return Op{Kind: OpCommit}
+}
+
+func Abort() Op {
+	return Op{Kind: OpAbort}
+}
+
+// スクリプトのトランザクションを開いたままエンジンのGCを呼ぶ。値は"active=1 removed=2"の形
+func GC() Op {
+	return Op{Kind: OpGC}
+}
+
+func (o Op) String() string {
+	switch o.Kind {
+	case OpGet:
+		return fmt.Sprintf("get %s", o.Key)
+	case OpSet:
+		return fmt.Sprintf("set %s=%s", o.Key, o.Value)
+	case OpAppend:
+		return fmt.Sprintf("append %s+=%s", o.Key, o.Value)
+	default:
+		return string(o.Kind)
+	}
+}
+
+// 1トランザクション分の操作。Beginは暗黙に最初の1ステップになる
+type Script struct {
+	Level engine.IsolationLevel
+	Ops   []Op
+}
+
+// i番目のステップで進めるスクリプトの添字。ロック待ちからの再開はステップに含めない
+type Schedule []int
+
+func (s Schedule) String() string {
+	return fmt.Sprint([]int(s))
+}
+
+type Event struct {
+	Tx      int // スクリプトの添字
+	Op      Op
+	Value   string
+	Err     error
+	Blocked bool // ロック待ちに入った
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("tx%d %s", e.Tx, e.Op)
+	switch {
+	case e.Blocked:
+		s += " (blocked)"
+	case e.Err != nil:
+		s += fmt.Sprintf(" -> error: %v", e.Err)
+	case e.Op.Kind == OpGet || e.Op.Kind == OpAppend || e.Op.Kind == OpGC:
+		s += fmt.Sprintf(" -> %q", e.Value)
+	}
+
+	return s
+}
+
+type Result struct {
+	Engine   engine.Engine
+	Schedule Schedule
+	Events   []Event
+
+	// Ops[i][j]はScripts[i].Ops[j]の結果
+	Ops [][]Event
+
+	runnable [][]int // 各ステップで選べたスクリプト
+}
+
+func (r Result) Trace() string {
+	lines := make([]string, len(r.Events))
+	for i, e := range r.Events {
+		lines[i] = e.String()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// 失敗したスケジュール。Scenario.Runに渡せば同じ実行を再現できる
+type Failure struct {
+	Schedule Schedule
+	Trace    string
+	Err      error
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("schedule %v: %v\n%s", f.Schedule, f.Err, f.Trace)
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+type Scenario struct {
+	// 受け取ったOptionをそのままエンジンに渡すこと
+	NewEngine func(opts ...engine.Option) engine.Engine
+
+	// スクリプトより前に実行する。ロック待ちしないこと
+	Setup func(e engine.Engine) error
+
+	Scripts []Script
+}
+
+// scheduleの順に実行する。足りない分は実行できる中で最小の添字を選ぶ
+func (s Scenario) Run(schedule Schedule) (Result, error) {
+	var invalid error
+	result, err := s.run(func(step int, runnable []int) int {
+		if step >= len(schedule) {
+			return runnable[0]
+		}
+		if !slices.Contains(runnable, schedule[step]) {
+			if invalid == nil {
+				invalid = fmt.Errorf("%w: step %d: tx%d is not runnable", ErrInvalidSchedule, step, schedule[step])
+			}
+			return runnable[0]
+		}
+
+		return schedule[step]
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	if invalid == nil && len(schedule) > len(result.Schedule) {
+		invalid = fmt.Errorf("%w: %d steps given, but finished in %d", ErrInvalidSchedule, len(schedule), len(result.Schedule))
+	}
+
+	return result, invalid
+}
+
+// orderの順に実行するが、ロック待ちで進められないスクリプトのステップは再開するまで後回しにする
+func (s Scenario) Follow(order Schedule) (Result, error) {
+	pending := slices.Clone(order)
+
+	return s.run(func(step int, runnable []int) int {
+		for i, tx := range pending {
+			if slices.Contains(runnable, tx) {
+				pending = slices.Delete(pending, i, i+1)
+				return tx
+			}
+		}
+
+		return runnable[0]
+	})
+}
+
+// 全てのインターリーブを辞書順に試す。checkが失敗したら*Failureを返す
+func (s Scenario) Explore(check func(Result) error) (runs int, err error) {
+	var prefix Schedule
+	for {
+		result, err := s.Run(prefix)
+		if err != nil {
+			return runs, err
+		}
+		runs++
+
+		err = check(result)
+		if err != nil {
+			return runs, newFailure(result, err)
+		}
+
+		prefix = nextSchedule(result)
+		if prefix == nil {
+			return runs, nil
+		}
+	}
+}
+
+// seedから決まるn通りのインターリーブを試す。checkが失敗したら*Failureを返す
+func (s Scenario) Sample(seed uint64, n int, check func(Result) error) error {
+	rng := rand.New(rand.NewPCG(seed, 0))
+
+	for range n {
+		result, err := s.run(func(step int, runnable []int) int {
+			return runnable[rng.IntN(len(runnable))]
+		})
+		if err != nil {
+			return err
+		}
+
+		err = check(result)
+		if err != nil {
+			return newFailure(result, err)
+		}
+	}
+
+	return nil
+}
+
+func (s Scenario) run(choose func(step int, runnable []int) int) (Result, error) {
+	r := newRunner(s)
+
+	if s.Setup != nil {
+		err := s.Setup(r.engine)
+		if err != nil {
+			return Result{}, fmt.Errorf("setup: %w", err)
+		}
+	}
+
+	r.start()
+
+	for {
+		r.retryBlocked()
+
+		runnable := r.runnable()
+		if len(runnable) == 0 {
+			if !r.timeout() {
+				break // 全て終わった
+			}
+			continue
+		}
+
+		next := choose(len(r.result.Schedule), runnable)
+		r.result.Schedule = append(r.result.Schedule, next)
+		r.result.runnable = append(r.result.runnable, runnable)
+		r.step(next)
+	}
+
+	return r.result, nil
+}
+
+func newFailure(r Result, err error) *Failure {
+	return &Failure{
+		Schedule: r.Schedule,
+		Trace:    r.Trace(),
+		Err:      err,
+	}
+}
+
+// 最後に選択肢が残っているステップで次のスクリプトを選んだスケジュール。試し終わったらnil
+func nextSchedule(r Result) Schedule {
+	for i := len(r.Schedule) - 1; i >= 0; i-- {
+		for _, tx := range r.runnable[i] {
+			if tx > r.Schedule[i] {
+				return append(slices.Clone(r.Schedule[:i]), tx)
+			}
+		}
+	}
+
+	return nil
+}
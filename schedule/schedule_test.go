@@ -0,0 +1,222 @@
+package schedule_test
+
+import (
+	"errors"
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/locking"
+	"mvcc-go/engine/naive"
+	"mvcc-go/lock"
+	"mvcc-go/schedule"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newLockingEngine(opts ...engine.Option) engine.Engine {
+	return locking.NewLockingEngine(opts...)
+}
+
+func newNaiveEngine(opts ...engine.Option) engine.Engine {
+	return naive.NewNaiveEngine(opts...)
+}
+
+func TestRunBlocksAndResumes(t *testing.T) {
+	scenario := schedule.Scenario{
+		NewEngine: newLockingEngine,
+		Scripts: []schedule.Script{
+			{Level: engine.ReadCommitted, Ops: []schedule.Op{schedule.Set("key", "value0"), schedule.Commit()}},
+			{Level: engine.ReadCommitted, Ops: []schedule.Op{schedule.Get("key"), schedule.Commit()}},
+		},
+	}
+
+	result, err := scenario.Run(schedule.Schedule{0, 0, 1, 1, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + result.Trace())
+
+	want := []string{
+		"tx0 begin",
+		"tx0 set key=value0",
+		"tx1 begin",
+		"tx1 get key (blocked)",
+		"tx0 commit",
+		`tx1 get key -> "value0"`,
+		"tx1 commit",
+	}
+	if got := strings.Split(result.Trace(), "\n"); !slices.Equal(got, want) {
+		t.Errorf("expected %q, but got %q", want, got)
+	}
+
+	// tx1はロック待ちの間ステップを持たないので、残りは自動で埋まる
+	if want := (schedule.Schedule{0, 0, 1, 1, 0, 1}); !slices.Equal(result.Schedule, want) {
+		t.Errorf("expected %v, but got %v", want, result.Schedule)
+	}
+}
+
+func TestFollowPostponesBlockedSteps(t *testing.T) {
+	scenario := schedule.Scenario{
+		NewEngine: newLockingEngine,
+		Scripts: []schedule.Script{
+			{Level: engine.ReadCommitted, Ops: []schedule.Op{schedule.Set("key", "value0"), schedule.Commit()}},
+			{Level: engine.ReadCommitted, Ops: []schedule.Op{schedule.Get("key"), schedule.Commit()}},
+		},
+	}
+
+	// tx1のcommitはgetが待っている間は進められないので、tx0のcommitの後に回る
+	result, err := scenario.Follow(schedule.Schedule{0, 0, 1, 1, 1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (schedule.Schedule{0, 0, 1, 1, 0, 1}); !slices.Equal(result.Schedule, want) {
+		t.Errorf("expected %v, but got %v", want, result.Schedule)
+	}
+}
+
+func TestRunTimesOutDeadlock(t *testing.T) {
+	scenario := schedule.Scenario{
+		NewEngine: newLockingEngine,
+		Scripts: []schedule.Script{
+			{Level: engine.ReadCommitted, Ops: []schedule.Op{schedule.Set("a", "0"), schedule.Set("b", "0"), schedule.Commit()}},
+			{Level: engine.ReadCommitted, Ops: []schedule.Op{schedule.Set("b", "1"), schedule.Set("a", "1"), schedule.Commit()}},
+		},
+	}
+
+	result, err := scenario.Run(schedule.Schedule{0, 0, 1, 1, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + result.Trace())
+
+	// 先に待ち始めたtx0がタイムアウトし、コミットでaを解放するとtx1が進む
+	if err := result.Ops[0][1].Err; !errors.Is(err, lock.ErrTimeout) {
+		t.Errorf("expected %v, but got %v", lock.ErrTimeout, err)
+	}
+	for _, event := range result.Ops[1] {
+		if event.Err != nil {
+			t.Errorf("unexpected error: %v", event)
+		}
+	}
+}
+
+func TestRunInvalidSchedule(t *testing.T) {
+	scenario := schedule.Scenario{
+		NewEngine: newLockingEngine,
+		Scripts: []schedule.Script{
+			{Level: engine.ReadCommitted, Ops: []schedule.Op{schedule.Commit()}},
+		},
+	}
+
+	_, err := scenario.Run(schedule.Schedule{0, 0, 0})
+	if !errors.Is(err, schedule.ErrInvalidSchedule) {
+		t.Errorf("expected %v, but got %v", schedule.ErrInvalidSchedule, err)
+	}
+}
+
+// 2つのトランザクションが同じキーを読んでから書く
+func lostUpdate(newEngine func(opts ...engine.Option) engine.Engine) schedule.Scenario {
+	script := func(value string) schedule.Script {
+		return schedule.Script{
+			Level: engine.RepeatableRead,
+			Ops:   []schedule.Op{schedule.Get("key"), schedule.Set("key", value), schedule.Commit()},
+		}
+	}
+
+	return schedule.Scenario{
+		NewEngine: newEngine,
+		Setup: func(e engine.Engine) error {
+			tx := e.Begin(engine.RepeatableRead)
+			err := tx.Set("key", "value0")
+			if err != nil {
+				return err
+			}
+			return tx.Commit()
+		},
+		Scripts: []schedule.Script{script("value1"), script("value2")},
+	}
+}
+
+// 後から書いた方が先に書かれた値を読んでいなければ更新が失われている
+func checkNoLostUpdate(r schedule.Result) error {
+	for i := range r.Ops {
+		if r.Ops[i][1].Err != nil {
+			return nil
+		}
+	}
+
+	first, second := 0, 1
+	if r.Events[len(r.Events)-1].Tx == 0 {
+		first, second = 1, 0
+	}
+	if r.Ops[second][0].Value != r.Ops[first][1].Op.Value {
+		return fmt.Errorf("lost update: tx%d read %q", second, r.Ops[second][0].Value)
+	}
+
+	return nil
+}
+
+func TestExplore(t *testing.T) {
+	runs, err := lostUpdate(newLockingEngine).Explore(func(r schedule.Result) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4ステップずつの2つのスクリプトなら最大C(8,4)=70通り。ロック待ちで選べないものは除かれる
+	if runs <= 1 || runs > 70 {
+		t.Errorf("unexpected runs: %d", runs)
+	}
+
+	again, err := lostUpdate(newLockingEngine).Explore(func(r schedule.Result) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != runs {
+		t.Errorf("expected %d runs, but got %d", runs, again)
+	}
+}
+
+func TestExploreReportsFailure(t *testing.T) {
+	// naiveはロックもスナップショットも持たないので、先にコミットされた更新を上書きできる
+	scenario := lostUpdate(newNaiveEngine)
+
+	_, err := scenario.Explore(checkNoLostUpdate)
+
+	var failure *schedule.Failure
+	if !errors.As(err, &failure) {
+		t.Fatalf("expected %T, but got %v", failure, err)
+	}
+	t.Log(failure)
+
+	// 報告されたスケジュールで同じ実行を再現できる
+	result, err := scenario.Run(failure.Schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Trace() != failure.Trace {
+		t.Errorf("expected trace\n%s\nbut got\n%s", failure.Trace, result.Trace())
+	}
+	if checkNoLostUpdate(result) == nil {
+		t.Error("expected lost update on replay")
+	}
+}
+
+func TestSample(t *testing.T) {
+	var schedules []string
+	for range 2 {
+		var got []string
+		err := lostUpdate(newLockingEngine).Sample(1, 10, func(r schedule.Result) error {
+			got = append(got, r.Schedule.String())
+			return checkNoLostUpdate(r)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if schedules != nil && !slices.Equal(got, schedules) {
+			t.Errorf("expected the same schedules for the same seed, but got %v and %v", schedules, got)
+		}
+		schedules = got
+	}
+}
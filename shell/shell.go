@@ -0,0 +1,652 @@
+// 名前付きのセッションでトランザクションを1ステップずつ動かし、
+// ロック待ちとバージョンチェーンを見せる対話シェル
+package shell
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/lock"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const Help = `commands:
+  begin <session> [read_committed|repeatable_read]
+  <session> get <key>
+  <session> set <key> <value>
+  <session> append <key> <value>  (append to a comma separated list)
+  commit <session>             (or <session> commit)
+  abort <session>              (or <session> abort)
+  <session> explain <key>
+  gc
+  sessions | locks | versions
+  dot [file]                   (graphviz of the versions, seen from open sessions)
+  help | quit
+`
+
+type Option func(*Shell)
+
+// ステップごとのバージョンチェーンの表示
+func WithVersions(show bool) Option {
+	return func(s *Shell) {
+		s.showVersions = show
+	}
+}
+
+// Beginで採番されたtxIDを受け取る
+type observer struct {
+	engine.NopObserver
+
+	mu     sync.Mutex
+	lastID int
+}
+
+func (o *observer) OnBegin(txID int, level engine.IsolationLevel) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.lastID = txID
+}
+
+type result struct {
+	value string
+	err   error
+}
+
+// タイムラインの1行。ブロックされた操作は、ブロックされたときと再開して終わったときの2つになる
+type Event struct {
+	Seq     int
+	Time    time.Time
+	Session string // gcなら空
+	TxID    int
+	Op      string // "get k"のようにコマンドからセッション名を除いたもの
+	Value   string // getは読んだ値、gcは"active=1 removed=2"の形
+	Err     error
+	Blocked bool
+	Resumed bool
+}
+
+// 結果の表示。"not found"・"error: ..."・引用符つきの値・"ok"のいずれか
+func (e Event) Result() string {
+	command, _, _ := strings.Cut(e.Op, " ")
+
+	switch {
+	case e.Blocked:
+		return "blocked"
+	case errors.Is(e.Err, engine.ErrNotFound):
+		return "not found"
+	case e.Err != nil:
+		return fmt.Sprintf("error: %v", e.Err)
+	case command == "get" || command == "append":
+		return fmt.Sprintf("%q", e.Value)
+	case command == "explain":
+		return "\n" + e.Value
+	case command == "gc":
+		return e.Value
+	}
+
+	return "ok"
+}
+
+type session struct {
+	name  string
+	txID  int
+	level engine.IsolationLevel
+	tx    engine.Tx
+	ended bool
+
+	// ブロックされている操作。終わるとresultsに結果が届く
+	pending string
+	results chan result
+}
+
+type Shell struct {
+	engine       engine.Engine
+	observer     *observer
+	out          io.Writer
+	showVersions bool
+
+	sessions map[string]*session
+	names    map[int]string // txID -> セッション名
+	keys     map[string]struct{}
+	events   []Event
+}
+
+func New(newEngine registry.Factory, out io.Writer, engineOpts []engine.Option, opts ...Option) *Shell {
+	o := &observer{}
+
+	s := &Shell{
+		engine:       newEngine(append(engineOpts, engine.WithObserver(o))...),
+		observer:     o,
+		out:          out,
+		showVersions: true,
+		sessions:     make(map[string]*session),
+		names:        make(map[int]string),
+		keys:         make(map[string]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *Shell) Engine() engine.Engine {
+	return s.engine
+}
+
+// 1行ずつ実行する。promptが空でなければ各行の前に出力する。quitか入力の終わりで戻る
+func (s *Shell) Run(in io.Reader, prompt string) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt != "" {
+			fmt.Fprint(s.out, prompt)
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+
+		quit := s.Exec(scanner.Text())
+		if quit {
+			return nil
+		}
+	}
+}
+
+// 1行を実行して、ブロックされている操作の結果・ロック待ち・バージョンチェーンを表示する。
+// '#'以降はコメント。quitならtrueを返す
+func (s *Shell) Exec(line string) (quit bool) {
+	err := s.Do(line)
+	if errors.Is(err, ErrQuit) {
+		return true
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "error: %v\n", err)
+	}
+
+	return false
+}
+
+var ErrQuit = errors.New("quit")
+
+// Execと同じだが、コマンドの誤りやエンジンが対応していない操作を表示せずに返す。quitならErrQuit
+func (s *Shell) Do(line string) error {
+	line, _, _ = strings.Cut(line, "#")
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+
+	stepped, err := s.exec(args)
+	if err != nil {
+		return err
+	}
+
+	if stepped {
+		s.collect()
+		s.printBlocked()
+		if s.showVersions {
+			s.printVersions()
+		}
+	}
+
+	return nil
+}
+
+// エンジンの状態を変えうるコマンドならsteppedがtrue
+func (s *Shell) exec(args []string) (stepped bool, err error) {
+	switch args[0] {
+	case "help":
+		fmt.Fprint(s.out, Help)
+		return false, nil
+	case "quit", "exit":
+		return false, ErrQuit
+	case "sessions":
+		s.printSessions()
+		return false, nil
+	case "locks":
+		s.printLocks()
+		return false, nil
+	case "versions":
+		s.printVersions()
+		return false, nil
+	case "dot":
+		if len(args) > 2 {
+			return false, fmt.Errorf("usage: dot [file]")
+		}
+		return false, s.dot(args[1:]...)
+	case "gc":
+		active, removed := s.engine.GC()
+		s.record(Event{Op: "gc", Value: fmt.Sprintf("active=%d removed=%d", active, removed)})
+		fmt.Fprintf(s.out, "gc: active=%d removed=%d\n", active, removed)
+		return true, nil
+	case "begin":
+		if len(args) < 2 || len(args) > 3 {
+			return false, fmt.Errorf("usage: begin <session> [level]")
+		}
+		return true, s.begin(args[1], args[2:]...)
+	case "commit", "abort":
+		if len(args) != 2 {
+			return false, fmt.Errorf("usage: %s <session>", args[0])
+		}
+		return true, s.do(args[1], args[0])
+	}
+
+	if len(args) < 2 {
+		return false, fmt.Errorf("unknown command %q (try help)", args[0])
+	}
+
+	return true, s.do(args[0], args[1], args[2:]...)
+}
+
+func (s *Shell) begin(name string, args ...string) error {
+	if sess, ok := s.sessions[name]; ok && !sess.ended {
+		return fmt.Errorf("session %s is still open", name)
+	}
+
+	level := engine.RepeatableRead
+	if len(args) > 0 {
+		var err error
+		level, err = registry.ParseLevel(args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	tx := s.engine.Begin(level)
+
+	s.observer.mu.Lock()
+	txID := s.observer.lastID
+	s.observer.mu.Unlock()
+
+	s.sessions[name] = &session{name: name, txID: txID, level: level, tx: tx, results: make(chan result, 1)}
+	s.names[txID] = name
+	s.record(Event{Session: name, TxID: txID, Op: "begin " + string(level)})
+	fmt.Fprintf(s.out, "%s: begin %s (tx%d)\n", name, level, txID)
+
+	return nil
+}
+
+// 操作を別のgoroutineで始め、終わる前にロック待ちになったらブロックされたとみなす
+func (s *Shell) do(name, command string, args ...string) error {
+	sess, ok := s.sessions[name]
+	if !ok || sess.ended {
+		return fmt.Errorf("no open session %s (begin it first)", name)
+	}
+	if sess.pending != "" {
+		return fmt.Errorf("session %s is blocked on %q", name, sess.pending)
+	}
+
+	op, err := s.op(sess, command, args...)
+	if err != nil {
+		return err
+	}
+
+	desc := strings.Join(append([]string{command}, args...), " ")
+	go func() {
+		value, err := op()
+		sess.results <- result{value: value, err: err}
+	}()
+
+	r, ok := s.await(sess)
+	if ok {
+		s.finish(sess, desc, r, false)
+		return nil
+	}
+
+	sess.pending = desc
+	event := s.record(Event{Session: name, TxID: sess.txID, Op: desc, Blocked: true})
+	fmt.Fprintf(s.out, "%s: %s -> %s\n", name, desc, event.Result())
+
+	return nil
+}
+
+// 操作の結果を待つ。他のトランザクションが持つロックを待ち始めたらokをfalseで返す
+func (s *Shell) await(sess *session) (r result, ok bool) {
+	for {
+		select {
+		case r := <-sess.results:
+			return r, true
+		default:
+		}
+
+		if s.blocked(sess.txID) {
+			return result{}, false
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// lock.Managerで待っていて、待っているロックを他のトランザクションがまだ持っている。
+// 解放された直後は起こされて取り直すまでWaitersに残るので、持ち主も見る
+func (s *Shell) blocked(txID int) bool {
+	locker, ok := s.engine.(engine.LockEngine)
+	if !ok {
+		return false
+	}
+
+	for _, kl := range locker.Locks() {
+		for _, w := range kl.Waiters {
+			if w.TxID != txID {
+				continue
+			}
+
+			for _, h := range kl.Holders {
+				if h.TxID != txID && (w.Mode == lock.Exclusive || h.Mode == lock.Exclusive) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *Shell) op(sess *session, command string, args ...string) (func() (string, error), error) {
+	tx := sess.tx
+	switch {
+	case command == "get" && len(args) == 1:
+		s.keys[args[0]] = struct{}{}
+		return func() (string, error) {
+			return tx.Get(args[0])
+		}, nil
+	case command == "set" && len(args) == 2:
+		s.keys[args[0]] = struct{}{}
+		return func() (string, error) {
+			return "", tx.Set(args[0], args[1])
+		}, nil
+	case command == "append" && len(args) == 2:
+		// schedule.Appendと同じく","区切りで末尾に足す
+		s.keys[args[0]] = struct{}{}
+		return func() (string, error) {
+			list, err := tx.Get(args[0])
+			if err != nil && !errors.Is(err, engine.ErrNotFound) {
+				return "", err
+			}
+			if list != "" {
+				list += ","
+			}
+			list += args[1]
+			return list, tx.Set(args[0], list)
+		}, nil
+	case command == "commit" && len(args) == 0:
+		return func() (string, error) {
+			return "", tx.Commit()
+		}, nil
+	case command == "abort" && len(args) == 0:
+		return func() (string, error) {
+			return "", tx.Abort()
+		}, nil
+	case command == "explain" && len(args) == 1:
+		explainer, ok := s.engine.(engine.ExplainEngine)
+		if !ok {
+			return nil, fmt.Errorf("explain is not supported by this engine")
+		}
+		return func() (string, error) {
+			ex, err := explainer.Explain(tx, args[0])
+			return strings.TrimRight(ex.String(), "\n"), err
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown command %q with %d arguments (try help)", command, len(args))
+}
+
+func (s *Shell) finish(sess *session, desc string, r result, resumed bool) {
+	event := s.record(Event{Session: sess.name, TxID: sess.txID, Op: desc, Value: r.value, Err: r.err, Resumed: resumed})
+	text := event.Result()
+	if resumed {
+		text += " (resumed)"
+	}
+	fmt.Fprintf(s.out, "%s: %s -> %s\n", sess.name, desc, text)
+
+	sess.pending = ""
+	if strings.HasPrefix(desc, "commit") || strings.HasPrefix(desc, "abort") {
+		sess.ended = true
+	}
+}
+
+func (s *Shell) record(event Event) Event {
+	event.Seq = len(s.events) + 1
+	event.Time = time.Now()
+	s.events = append(s.events, event)
+
+	return event
+}
+
+// ブロックされていた操作のうち、このステップで終わったものの結果を表示する。
+// 待ちが解けた操作は、終わるか再びロック待ちになるまで待つ
+func (s *Shell) collect() {
+	for _, name := range slices.Sorted(maps.Keys(s.sessions)) {
+		sess := s.sessions[name]
+		if sess.pending == "" {
+			continue
+		}
+
+		if r, ok := s.await(sess); ok {
+			s.finish(sess, sess.pending, r, true)
+		}
+	}
+}
+
+// ブロックされていた操作のうち、既に終わったものの結果を待たずに集める。
+// 操作しない間にロック待ちがタイムアウトしたのを拾う
+func (s *Shell) Poll() {
+	for _, name := range slices.Sorted(maps.Keys(s.sessions)) {
+		sess := s.sessions[name]
+		if sess.pending == "" {
+			continue
+		}
+
+		select {
+		case r := <-sess.results:
+			s.finish(sess, sess.pending, r, true)
+		default:
+		}
+	}
+}
+
+// 実行した順
+func (s *Shell) Events() []Event {
+	return slices.Clone(s.events)
+}
+
+// 操作したことのあるキーを名前順に返す
+func (s *Shell) Keys() []string {
+	return slices.Sorted(maps.Keys(s.keys))
+}
+
+type SessionState struct {
+	Name    string
+	TxID    int
+	Level   engine.IsolationLevel
+	Ended   bool
+	Pending string // ブロックされている操作
+	Waiting string // lock.Managerで待っているロック
+}
+
+// 名前順
+func (s *Shell) Sessions() []SessionState {
+	states := make([]SessionState, 0, len(s.sessions))
+	for _, name := range slices.Sorted(maps.Keys(s.sessions)) {
+		sess := s.sessions[name]
+		state := SessionState{Name: name, TxID: sess.txID, Level: sess.level, Ended: sess.ended, Pending: sess.pending}
+		if sess.pending != "" {
+			state.Waiting = strings.TrimPrefix(s.waitingFor(sess.txID), ", ")
+		}
+		states = append(states, state)
+	}
+
+	return states
+}
+
+// txIDをセッション名つきで表す
+func (s *Shell) tx(txID int) string {
+	id := fmt.Sprintf("tx%d", txID)
+	if name, ok := s.names[txID]; ok && name != id {
+		return fmt.Sprintf("%s(%s)", name, id)
+	}
+
+	return id
+}
+
+func (s *Shell) txs(txIDs []int) string {
+	names := make([]string, len(txIDs))
+	for i, txID := range txIDs {
+		names[i] = s.tx(txID)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func (s *Shell) printBlocked() {
+	for _, name := range slices.Sorted(maps.Keys(s.sessions)) {
+		sess := s.sessions[name]
+		if sess.pending == "" {
+			continue
+		}
+
+		fmt.Fprintf(s.out, "  blocked: %s on %q%s\n", name, sess.pending, s.waitingFor(sess.txID))
+	}
+}
+
+// lock.Managerで待っているロックと、それを持っているトランザクション
+func (s *Shell) waitingFor(txID int) string {
+	locker, ok := s.engine.(engine.LockEngine)
+	if !ok {
+		return ""
+	}
+
+	for _, kl := range locker.Locks() {
+		for _, w := range kl.Waiters {
+			if w.TxID != txID {
+				continue
+			}
+
+			holders := make([]int, 0)
+			for _, h := range kl.Holders {
+				if h.TxID != txID {
+					holders = append(holders, h.TxID)
+				}
+			}
+			return fmt.Sprintf(", waiting %s for %s lock on %q held by %s", w.Waited.Round(time.Millisecond), w.Mode, kl.Key, s.txs(holders))
+		}
+	}
+
+	return ""
+}
+
+// 開いているセッションのスナップショットから見えるバージョンに印をつける
+func (s *Shell) dot(path ...string) error {
+	dotter, ok := s.engine.(engine.DotEngine)
+	if !ok {
+		return fmt.Errorf("dot is not supported by this engine")
+	}
+
+	txs := make([]engine.Tx, 0)
+	for _, name := range slices.Sorted(maps.Keys(s.sessions)) {
+		if sess := s.sessions[name]; !sess.ended {
+			txs = append(txs, sess.tx)
+		}
+	}
+
+	if len(path) == 0 {
+		return dotter.WriteDot(s.out, txs...)
+	}
+
+	f, err := os.Create(path[0])
+	if err != nil {
+		return err
+	}
+
+	err = dotter.WriteDot(f, txs...)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(s.out, "wrote %s\n", path[0])
+	return nil
+}
+
+func (s *Shell) printSessions() {
+	tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	for _, name := range slices.Sorted(maps.Keys(s.sessions)) {
+		sess := s.sessions[name]
+
+		state := "open"
+		switch {
+		case sess.ended:
+			state = "ended"
+		case sess.pending != "":
+			state = fmt.Sprintf("blocked on %q", sess.pending)
+		}
+		fmt.Fprintf(tw, "  %s\ttx%d\t%s\t%s\n", name, sess.txID, sess.level, state)
+	}
+	tw.Flush()
+}
+
+func (s *Shell) printLocks() {
+	locker, ok := s.engine.(engine.LockEngine)
+	if !ok {
+		fmt.Fprintln(s.out, "  (this engine has no locks)")
+		return
+	}
+
+	tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	for _, kl := range locker.Locks() {
+		held := make([]string, len(kl.Holders))
+		for i, h := range kl.Holders {
+			held[i] = fmt.Sprintf("%s %s", s.tx(h.TxID), h.Mode)
+		}
+		waiting := make([]string, len(kl.Waiters))
+		for i, w := range kl.Waiters {
+			waiting[i] = fmt.Sprintf("%s %s", s.tx(w.TxID), w.Mode)
+		}
+		fmt.Fprintf(tw, "  %q\theld: %s\twaiting: %s\n", kl.Key, strings.Join(held, ", "), strings.Join(waiting, ", "))
+	}
+	tw.Flush()
+}
+
+// 触ったキーのバージョンを古い順に表示する
+func (s *Shell) printVersions() {
+	historian, ok := s.engine.(engine.HistoryEngine)
+	if !ok || len(s.keys) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	for _, key := range slices.Sorted(maps.Keys(s.keys)) {
+		fmt.Fprintf(tw, "  %q\n", key)
+		for _, v := range historian.History(key) {
+			commit := "uncommitted"
+			if v.CommitNo != 0 {
+				commit = fmt.Sprintf("commit #%d", v.CommitNo)
+			}
+			end := ""
+			if v.EndTxID != 0 {
+				end = "ended by " + s.tx(v.EndTxID)
+			}
+			visible := ""
+			if v.Visible {
+				visible = "visible"
+			}
+			fmt.Fprintf(tw, "    %q\tby %s\t%s\t%s\t%s\n", v.Value, s.tx(v.BeginTxID), commit, end, visible)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,188 @@
+package shell_test
+
+import (
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/lock"
+	"mvcc-go/shell"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func run(t *testing.T, name string, script string) string {
+	t.Helper()
+
+	newEngine, err := registry.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	s := shell.New(newEngine, &out, []engine.Option{engine.WithLockTimeout(lock.NoTimeout)})
+	err = s.Run(strings.NewReader(script), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+func contains(t *testing.T, out string, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestBlockedSessionResumes(t *testing.T) {
+	out := run(t, "locking", `
+begin a
+begin b
+a set k v1
+b get k   # aのXロックを待つ
+commit a
+b commit
+`)
+
+	contains(t, out,
+		"b: get k -> blocked\n",
+		`blocked: b on "get k", waiting`,
+		`s lock on "k" held by a(tx1)`,
+		"a: commit -> ok\nb: get k -> \"v1\" (resumed)\n",
+		"b: commit -> ok\n",
+	)
+}
+
+// 解放されたロックを取り直せなかった操作は、再開せずにブロックされたままになる
+func TestBlockedSessionWaitsForEveryHolder(t *testing.T) {
+	out := run(t, "locking", `
+begin a
+begin b
+begin c
+a get k
+c get k
+b append k x   # aとcのSロックを待つ
+commit a
+commit c
+b commit
+`)
+
+	contains(t, out,
+		"b: append k x -> blocked\n",
+		"a: commit -> ok\n  blocked: b on \"append k x\"",
+		`x lock on "k" held by c(tx3)`,
+		"c: commit -> ok\nb: append k x -> \"x\" (resumed)\n",
+	)
+}
+
+func TestVersions(t *testing.T) {
+	out := run(t, "appendonly", `
+begin tx1
+tx1 set k v1
+commit tx1
+begin tx2 read_committed
+begin tx3 repeatable_read
+tx2 set k v2
+tx3 get k
+commit tx2
+tx3 get k
+gc
+commit tx3
+gc
+`)
+
+	contains(t, out,
+		`"v1"  by tx1  commit #1    ended by tx2  visible`,
+		`"v2"  by tx2  uncommitted`,
+		"tx3: get k -> \"v1\"\n",
+		"gc: active=1 removed=0\n",
+		"gc: active=0 removed=1\n",
+	)
+	if strings.Contains(out, "error") {
+		t.Errorf("unexpected error in output:\n%s", out)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	out := run(t, "locking", `
+tx1 get k
+begin tx1 serializable
+begin tx1
+begin tx1
+tx1 frobnicate
+quit
+tx1 get k
+`)
+
+	contains(t, out,
+		"error: no open session tx1 (begin it first)\n",
+		`error: unknown isolation level "serializable"`,
+		"error: session tx1 is still open\n",
+		`error: unknown command "frobnicate" with 0 arguments`,
+	)
+	if strings.Contains(out, "tx1: get k") {
+		t.Errorf("expected quit to stop, but got:\n%s", out)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	newEngine, err := registry.Lookup("locking")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	s := shell.New(newEngine, &out, []engine.Option{engine.WithLockTimeout(lock.NoTimeout)})
+	for _, line := range []string{"begin a", "begin b read_committed", "a append k x", "a append k y", "b get k", "commit a", "gc"} {
+		s.Exec(line)
+	}
+
+	got := make([]string, 0)
+	for _, e := range s.Events() {
+		got = append(got, fmt.Sprintf("%d %s tx%d %s -> %s resumed=%v", e.Seq, e.Session, e.TxID, e.Op, e.Result(), e.Resumed))
+	}
+	want := []string{
+		"1 a tx1 begin repeatable_read -> ok resumed=false",
+		"2 b tx2 begin read_committed -> ok resumed=false",
+		`3 a tx1 append k x -> "x" resumed=false`,
+		`4 a tx1 append k y -> "x,y" resumed=false`,
+		"5 b tx2 get k -> blocked resumed=false",
+		"6 a tx1 commit -> ok resumed=false",
+		`7 b tx2 get k -> "x,y" resumed=true`,
+		"8  tx0 gc -> active=0 removed=0 resumed=false",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected\n%s\nbut got\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	if got := s.Keys(); !slices.Equal(got, []string{"k"}) {
+		t.Errorf("expected [k], but got %v", got)
+	}
+	for _, state := range s.Sessions() {
+		if !(state.Name == "a" && state.Ended) && !(state.Name == "b" && !state.Ended && state.Pending == "") {
+			t.Errorf("unexpected session state %+v", state)
+		}
+	}
+}
+
+func TestAbortResumesBlockedSession(t *testing.T) {
+	out := run(t, "locking", `
+begin a
+begin b
+a set k v1
+b get k   # aのXロックを待つ
+abort a
+b commit
+`)
+
+	contains(t, out,
+		"b: get k -> blocked\n",
+		"a: abort -> ok\nb: get k -> not found (resumed)\n",
+		"b: commit -> ok\n",
+	)
+}
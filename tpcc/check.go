@@ -0,0 +1,249 @@
+package tpcc
+
+import (
+	"errors"
+	"fmt"
+	"mvcc-go/engine"
+)
+
+// 破れた一貫性条件
+type Violation struct {
+	Condition string
+	Detail    string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.Condition, v.Detail)
+}
+
+const (
+	conditionWarehouseYTD = "warehouse ytd = sum of district ytd"
+	conditionDistrictYTD  = "district ytd = initial + sum of customer ytd_payment"
+	conditionNextOrder    = "district next_o_id - 1 = max order id"
+	conditionDelivery     = "orders before next_delivery are delivered and the rest are not"
+	conditionOrderLines   = "order ol_cnt = number of order lines"
+	conditionBalance      = "customer balance = delivered amount - ytd_payment"
+	conditionLastOrder    = "customer last_o_id = latest order of the customer"
+	conditionStock        = "stock ytd and order_cnt = sum over order lines"
+)
+
+// 明細から集計した在庫の値
+type stockTotal struct {
+	ytd      int
+	orderCnt int
+}
+
+type checker struct {
+	config     Config
+	db         *db
+	stocks     map[[2]int]stockTotal // 供給元の倉庫と商品ごと
+	violations []Violation
+}
+
+func (c *checker) violate(condition, format string, args ...any) {
+	c.violations = append(c.violations, Violation{Condition: condition, Detail: fmt.Sprintf(format, args...)})
+}
+
+// 行がなければViolationにしてnilを返す
+func (c *checker) get(condition, key string) (row, error) {
+	r, err := c.db.get(key)
+	if errors.Is(err, engine.ErrNotFound) {
+		c.violate(condition, "%s not found", key)
+		return nil, nil
+	}
+
+	return r, err
+}
+
+func (c *checker) exists(key string) (bool, error) {
+	_, err := c.db.get(key)
+	if errors.Is(err, engine.ErrNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// 実行が終わった後の状態で一貫性条件を調べる。エラーは読み取りに失敗したとき
+func Check(e engine.Engine, config Config) ([]Violation, error) {
+	tx := e.Begin(engine.RepeatableRead)
+	defer tx.Commit()
+
+	c := &checker{
+		config: config.withDefaults(),
+		db:     &db{tx: tx},
+		stocks: make(map[[2]int]stockTotal),
+	}
+
+	for w := 1; w <= c.config.Warehouses; w++ {
+		err := c.warehouse(w)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.stock()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.violations, nil
+}
+
+func (c *checker) warehouse(w int) error {
+	warehouse, err := c.get(conditionWarehouseYTD, warehouseKey(w))
+	if err != nil {
+		return err
+	}
+
+	sum := 0
+	for d := 1; d <= c.config.Districts; d++ {
+		ytd, err := c.district(w, d)
+		if err != nil {
+			return err
+		}
+		sum += ytd
+	}
+
+	if warehouse != nil && warehouse["ytd"] != sum {
+		c.violate(conditionWarehouseYTD, "warehouse %d: ytd %d, sum of district ytd %d", w, warehouse["ytd"], sum)
+	}
+
+	return nil
+}
+
+// 顧客ごとの集計
+type customerTotal struct {
+	delivered int // 配達済みの明細の金額
+	lastOrder int
+}
+
+// 地区のytdを返す
+func (c *checker) district(w, d int) (int, error) {
+	district, err := c.get(conditionDistrictYTD, districtKey(w, d))
+	if err != nil || district == nil {
+		return 0, err
+	}
+
+	next := district["next_o_id"]
+	if next > 1 {
+		_, err := c.get(conditionNextOrder, orderKey(w, d, next-1))
+		if err != nil {
+			return 0, err
+		}
+	}
+	ok, err := c.exists(orderKey(w, d, next))
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		c.violate(conditionNextOrder, "district %d/%d: next_o_id %d already exists", w, d, next)
+	}
+
+	if district["next_delivery"] > next {
+		c.violate(conditionDelivery, "district %d/%d: next_delivery %d > next_o_id %d", w, d, district["next_delivery"], next)
+	}
+
+	customers := make(map[int]customerTotal)
+	for o := 1; o < next; o++ {
+		err := c.order(w, d, o, o < district["next_delivery"], customers)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	payments := 0
+	for id := 1; id <= c.config.Customers; id++ {
+		customer, err := c.get(conditionBalance, customerKey(w, d, id))
+		if err != nil {
+			return 0, err
+		}
+		if customer == nil {
+			continue
+		}
+		payments += customer["ytd_payment"]
+
+		total := customers[id]
+		if customer["balance"] != total.delivered-customer["ytd_payment"] {
+			c.violate(conditionBalance, "customer %d/%d/%d: balance %d, delivered %d, ytd_payment %d",
+				w, d, id, customer["balance"], total.delivered, customer["ytd_payment"])
+		}
+		if customer["last_o_id"] != total.lastOrder {
+			c.violate(conditionLastOrder, "customer %d/%d/%d: last_o_id %d, latest order %d", w, d, id, customer["last_o_id"], total.lastOrder)
+		}
+	}
+
+	if district["ytd"] != initialDistrictYTD+payments {
+		c.violate(conditionDistrictYTD, "district %d/%d: ytd %d, initial %d + ytd_payment %d", w, d, district["ytd"], initialDistrictYTD, payments)
+	}
+
+	return district["ytd"], nil
+}
+
+func (c *checker) order(w, d, o int, delivered bool, customers map[int]customerTotal) error {
+	order, err := c.get(conditionNextOrder, orderKey(w, d, o))
+	if err != nil || order == nil {
+		return err
+	}
+
+	if delivered != (order["carrier_id"] != 0) {
+		c.violate(conditionDelivery, "order %d/%d/%d: carrier_id %d", w, d, o, order["carrier_id"])
+	}
+
+	total := customers[order["c_id"]]
+	total.lastOrder = o
+	for n := 1; n <= order["ol_cnt"]; n++ {
+		line, err := c.get(conditionOrderLines, orderLineKey(w, d, o, n))
+		if err != nil {
+			return err
+		}
+		if line == nil {
+			continue
+		}
+
+		if line["delivered"] == 1 {
+			total.delivered += line["amount"]
+		}
+		if delivered != (line["delivered"] == 1) {
+			c.violate(conditionDelivery, "order line %d/%d/%d/%d: delivered %d", w, d, o, n, line["delivered"])
+		}
+
+		stock := c.stocks[[2]int{line["supply_w"], line["item"]}]
+		stock.ytd += line["quantity"]
+		stock.orderCnt++
+		c.stocks[[2]int{line["supply_w"], line["item"]}] = stock
+	}
+	customers[order["c_id"]] = total
+
+	ok, err := c.exists(orderLineKey(w, d, o, order["ol_cnt"]+1))
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.violate(conditionOrderLines, "order %d/%d/%d: more than ol_cnt %d lines", w, d, o, order["ol_cnt"])
+	}
+
+	return nil
+}
+
+func (c *checker) stock() error {
+	for w := 1; w <= c.config.Warehouses; w++ {
+		for i := 1; i <= c.config.Items; i++ {
+			stock, err := c.get(conditionStock, stockKey(w, i))
+			if err != nil {
+				return err
+			}
+			if stock == nil {
+				continue
+			}
+
+			total := c.stocks[[2]int{w, i}]
+			if stock["ytd"] != total.ytd || stock["order_cnt"] != total.orderCnt {
+				c.violate(conditionStock, "stock %d/%d: ytd %d, order_cnt %d, order lines have quantity %d in %d lines",
+					w, i, stock["ytd"], stock["order_cnt"], total.ytd, total.orderCnt)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,295 @@
+package tpcc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"mvcc-go/engine"
+	"mvcc-go/lock"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+type Config struct {
+	Level engine.IsolationLevel // 空ならRepeatableRead
+
+	Warehouses int // 0なら1
+	Districts  int // 倉庫ごと。0なら10
+	Customers  int // 地区ごと。0なら30
+	Items      int // 0なら100
+
+	Transactions int // 0なら1000
+	Concurrency  int // 0なら1
+
+	// 0ならエンジンの設定
+	LockTimeout time.Duration
+
+	Seed uint64
+}
+
+func (c Config) withDefaults() Config {
+	if c.Level == "" {
+		c.Level = engine.RepeatableRead
+	}
+	for _, v := range []struct {
+		field *int
+		value int
+	}{
+		{&c.Warehouses, 1},
+		{&c.Districts, 10},
+		{&c.Customers, 30},
+		{&c.Items, 100},
+		{&c.Transactions, 1000},
+		{&c.Concurrency, 1},
+	} {
+		if *v.field == 0 {
+			*v.field = v.value
+		}
+	}
+
+	return c
+}
+
+// テーブルごとのロック待ち
+type LockWait struct {
+	Waits    int
+	Timeouts int
+	Waited   time.Duration
+}
+
+type lockObserver struct {
+	engine.NopObserver
+
+	mu    sync.Mutex
+	waits map[string]LockWait
+}
+
+func (o *lockObserver) OnLockWait(txID int, key string, mode lock.LockType) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	w := o.waits[table(key)]
+	w.Waits++
+	o.waits[table(key)] = w
+}
+
+func (o *lockObserver) OnLockGrant(txID int, key string, mode lock.LockType, waited time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	w := o.waits[table(key)]
+	w.Waited += waited
+	o.waits[table(key)] = w
+}
+
+func (o *lockObserver) OnLockTimeout(txID int, key string, mode lock.LockType, waited time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	w := o.waits[table(key)]
+	w.Timeouts++
+	w.Waited += waited
+	o.waits[table(key)] = w
+}
+
+type Result struct {
+	Engine       string
+	Level        engine.IsolationLevel
+	Transactions int
+	Committed    int
+	RolledBack   int // 存在しない商品の注文で取り消したもの
+	Aborts       int // ロック待ちのタイムアウト・更新の競合・読めない行で失敗したもの
+
+	// Abortsのうち、同じトランザクションで書かれたはずの行が見えなかったもの
+	InconsistentReads int
+
+	Elapsed    time.Duration
+	LockWaits  map[string]LockWait // テーブル名ごと
+	Violations []Violation
+}
+
+func (r Result) Throughput() float64 {
+	return float64(r.Transactions) / r.Elapsed.Seconds()
+}
+
+// NewOrder 45%, Payment 43%, OrderStatus・Delivery・StockLevel 各4%
+func Run(name string, newEngine func(opts ...engine.Option) engine.Engine, config Config) (Result, error) {
+	config = config.withDefaults()
+
+	observer := &lockObserver{waits: make(map[string]LockWait)}
+	opts := []engine.Option{engine.WithObserver(observer)}
+	if config.LockTimeout != 0 {
+		opts = append(opts, engine.WithLockTimeout(config.LockTimeout))
+	}
+	e := newEngine(opts...)
+
+	err := load(e, config)
+	if err != nil {
+		return Result{}, fmt.Errorf("load: %w", err)
+	}
+
+	r := &runner{engine: e, config: config}
+	counts := make([]counts, config.Concurrency)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counts[i] = r.work(rand.New(rand.NewPCG(config.Seed, uint64(i+1))))
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	violations, err := Check(e, config)
+	if err != nil {
+		return Result{}, fmt.Errorf("check: %w", err)
+	}
+
+	result := Result{
+		Engine:       name,
+		Level:        config.Level,
+		Transactions: config.Transactions,
+		Elapsed:      elapsed,
+		Violations:   violations,
+	}
+	for _, c := range counts {
+		result.Committed += c.committed
+		result.RolledBack += c.rolledBack
+		result.Aborts += c.aborts
+		result.InconsistentReads += c.inconsistentReads
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	result.LockWaits = maps.Clone(observer.waits)
+
+	return result, nil
+}
+
+type counts struct {
+	committed         int
+	rolledBack        int
+	aborts            int
+	inconsistentReads int
+}
+
+type runner struct {
+	engine engine.Engine
+	config Config
+	next   atomic.Int64 // 実行を始めたトランザクションの数
+}
+
+func (r *runner) work(rng *rand.Rand) counts {
+	var c counts
+	for r.next.Add(1) <= int64(r.config.Transactions) {
+		tx := r.engine.Begin(r.config.Level)
+		db := &db{tx: tx}
+
+		err := r.do(db, rng)
+		if err == nil {
+			if tx.Commit() == nil {
+				c.committed++
+			} else {
+				c.aborts++
+			}
+			continue
+		}
+
+		_ = tx.Abort()
+		switch {
+		case errors.Is(err, errRollback):
+			c.rolledBack++
+		default:
+			c.aborts++
+			if errors.Is(err, errInconsistentRead) {
+				c.inconsistentReads++
+			}
+		}
+	}
+
+	return c
+}
+
+func (r *runner) do(db *db, rng *rand.Rand) error {
+	config := r.config
+	w := 1 + rng.IntN(config.Warehouses)
+	d := 1 + rng.IntN(config.Districts)
+	c := 1 + rng.IntN(config.Customers)
+
+	switch n := rng.IntN(100); {
+	case n < 45:
+		items := rng.Perm(config.Items)[:min(5+rng.IntN(11), config.Items)]
+		lines := make([]orderLine, len(items))
+		for i, item := range items {
+			// 1%は他の倉庫から供給する
+			supplyW := w
+			if config.Warehouses > 1 && rng.IntN(100) == 0 {
+				supplyW = 1 + rng.IntN(config.Warehouses)
+			}
+			lines[i] = orderLine{item: item + 1, supplyW: supplyW, quantity: 1 + rng.IntN(10)}
+		}
+		if rng.IntN(100) == 0 {
+			lines[len(lines)-1].item = config.Items + 1
+		}
+		return newOrder(db, w, d, c, lines)
+	case n < 88:
+		return payment(db, w, d, c, 100+rng.IntN(500000))
+	case n < 92:
+		return orderStatus(db, w, d, c)
+	case n < 96:
+		return delivery(db, w, 1+rng.IntN(10), config.Districts)
+	default:
+		_, err := stockLevel(db, w, d, 10+rng.IntN(11))
+		return err
+	}
+}
+
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "engine\tlevel\ttx/s\tcommitted\taborts\tinconsistent reads\tlock waits\tviolations\t")
+	for _, r := range results {
+		waits := 0
+		for _, w := range r.LockWaits {
+			waits += w.Waits
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%.0f\t%d\t%d\t%d\t%d\t%d\t\n",
+			r.Engine, r.Level, r.Throughput(), r.Committed, r.Aborts, r.InconsistentReads, waits, len(r.Violations))
+	}
+
+	return tw.Flush()
+}
+
+// テーブルごとのロック待ちと、破れた条件ごとの件数
+func WriteDetails(w io.Writer, r Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s %s\n", r.Engine, r.Level)
+	for _, name := range slices.Sorted(maps.Keys(r.LockWaits)) {
+		lw := r.LockWaits[name]
+		fmt.Fprintf(tw, "  lock %s\twaits=%d\ttimeouts=%d\twaited=%s\n", name, lw.Waits, lw.Timeouts, lw.Waited)
+	}
+
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	conditions := make(map[string]int)
+	for _, v := range r.Violations {
+		conditions[v.Condition]++
+	}
+	for _, condition := range slices.Sorted(maps.Keys(conditions)) {
+		fmt.Fprintf(tw, "  violated %s\t%d\n", condition, conditions[condition])
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,135 @@
+// TPC-C (https://www.tpc.org/tpcc/) を単純にしたものをキーバリューのトランザクションで実行し、
+// 業務上の不変条件が分離レベルの異常で壊れるかを調べる
+package tpcc
+
+import (
+	"fmt"
+	"maps"
+	"mvcc-go/engine"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 1行を1キーに入れる。列はすべて整数で、金額はセント
+type row map[string]int
+
+// "balance=-10 payment_cnt=1" の形。列名の順に並べる
+func (r row) String() string {
+	fields := make([]string, 0, len(r))
+	for _, name := range slices.Sorted(maps.Keys(r)) {
+		fields = append(fields, fmt.Sprintf("%s=%d", name, r[name]))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func parseRow(s string) (row, error) {
+	r := make(row)
+	for _, field := range strings.Fields(s) {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q: %w", field, err)
+		}
+		r[name] = n
+	}
+
+	return r, nil
+}
+
+// キーの先頭はテーブル名。ロック待ちはテーブルごとに集計する
+func warehouseKey(w int) string      { return fmt.Sprintf("warehouse/%d", w) }
+func districtKey(w, d int) string    { return fmt.Sprintf("district/%d/%d", w, d) }
+func customerKey(w, d, c int) string { return fmt.Sprintf("customer/%d/%d/%d", w, d, c) }
+func itemKey(i int) string           { return fmt.Sprintf("item/%d", i) }
+func stockKey(w, i int) string       { return fmt.Sprintf("stock/%d/%d", w, i) }
+func orderKey(w, d, o int) string    { return fmt.Sprintf("order/%d/%d/%d", w, d, o) }
+func orderLineKey(w, d, o, n int) string {
+	return fmt.Sprintf("order_line/%d/%d/%d/%d", w, d, o, n)
+}
+
+func table(key string) string {
+	name, _, _ := strings.Cut(key, "/")
+	return name
+}
+
+// 行として読み書きする
+type db struct {
+	tx engine.Tx
+}
+
+func (db *db) get(key string) (row, error) {
+	value, err := db.tx.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+
+	r, err := parseRow(value)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+
+	return r, nil
+}
+
+func (db *db) put(key string, r row) error {
+	err := db.tx.Set(key, r.String())
+	if err != nil {
+		return fmt.Errorf("set %s: %w", key, err)
+	}
+
+	return nil
+}
+
+const (
+	initialDistrictYTD = 30000_00
+	initialStock       = 50
+)
+
+// 注文は空の状態から始める
+func load(e engine.Engine, config Config) error {
+	tx := e.Begin(engine.ReadCommitted)
+	db := &db{tx: tx}
+
+	for i := 1; i <= config.Items; i++ {
+		err := db.put(itemKey(i), row{"price": 100 + (i*7919)%9900})
+		if err != nil {
+			return err
+		}
+	}
+
+	for w := 1; w <= config.Warehouses; w++ {
+		err := db.put(warehouseKey(w), row{"ytd": initialDistrictYTD * config.Districts})
+		if err != nil {
+			return err
+		}
+
+		for i := 1; i <= config.Items; i++ {
+			err := db.put(stockKey(w, i), row{"quantity": initialStock, "ytd": 0, "order_cnt": 0, "remote_cnt": 0})
+			if err != nil {
+				return err
+			}
+		}
+
+		for d := 1; d <= config.Districts; d++ {
+			err := db.put(districtKey(w, d), row{"ytd": initialDistrictYTD, "next_o_id": 1, "next_delivery": 1})
+			if err != nil {
+				return err
+			}
+
+			for c := 1; c <= config.Customers; c++ {
+				err := db.put(customerKey(w, d, c), row{"balance": 0, "ytd_payment": 0, "payment_cnt": 0, "delivery_cnt": 0, "last_o_id": 0})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return tx.Commit()
+}
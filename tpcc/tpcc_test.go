@@ -0,0 +1,118 @@
+package tpcc_test
+
+import (
+	"mvcc-go/engine"
+	"mvcc-go/engine/appendonly"
+	"mvcc-go/engine/registry"
+	"mvcc-go/tpcc"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var levels = []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead}
+
+// 直列に実行すればどのエンジンでも条件は破れない
+func TestSerial(t *testing.T) {
+	for _, name := range registry.Names() {
+		newEngine, err := registry.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, level := range levels {
+			result, err := tpcc.Run(name, newEngine, tpcc.Config{Level: level, Transactions: 300})
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, level, err)
+			}
+
+			if result.Committed+result.RolledBack != 300 {
+				t.Errorf("%s %s: expected all transactions to finish, but committed %d, rolled back %d, aborted %d",
+					name, level, result.Committed, result.RolledBack, result.Aborts)
+			}
+			for _, v := range result.Violations {
+				t.Errorf("%s %s: %s", name, level, v)
+			}
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	results := make([]tpcc.Result, 0)
+	for _, name := range registry.Names() {
+		newEngine, err := registry.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, level := range levels {
+			result, err := tpcc.Run(name, newEngine, tpcc.Config{
+				Level:        level,
+				Warehouses:   2,
+				Districts:    2,
+				Transactions: 500,
+				Concurrency:  8,
+				LockTimeout:  5 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, level, err)
+			}
+			results = append(results, result)
+
+			// ロックはコミットまで持つので直列化可能。
+			// TPC-Cはスナップショット分離でも異常を起こさない (Fekete et al. 2005)
+			serializable := name == "locking" || (name != "naive" && level == engine.RepeatableRead)
+			if serializable {
+				for _, v := range result.Violations {
+					t.Errorf("%s %s: %s", name, level, v)
+				}
+			}
+		}
+	}
+
+	if testing.Verbose() {
+		_ = tpcc.WriteTable(os.Stdout, results)
+		for _, r := range results {
+			_ = tpcc.WriteDetails(os.Stdout, r)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	e := appendonly.NewAppendOnlyEngine()
+	config := tpcc.Config{Transactions: 100}
+
+	_, err := tpcc.Run("appendonly", func(opts ...engine.Option) engine.Engine { return e }, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := e.Begin(engine.ReadCommitted)
+	value, err := tx.Get("district/1/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Set("district/1/1", strings.Replace(value, "ytd=", "ytd=1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violations, err := tpcc.Check(e, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	for _, v := range violations {
+		got = append(got, v.Condition)
+	}
+	want := []string{"district ytd = initial + sum of customer ytd_payment", "warehouse ytd = sum of district ytd"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %q, but got %q", want, got)
+	}
+}
@@ -0,0 +1,266 @@
+package tpcc
+
+import (
+	"errors"
+	"fmt"
+	"mvcc-go/engine"
+)
+
+// 存在しない商品を注文した（TPC-Cでは新規注文の1%）。書き込む前に気づくので何も残らない
+var errRollback = errors.New("rollback")
+
+// 同じトランザクションで書かれたはずの行が見えない
+var errInconsistentRead = errors.New("inconsistent read")
+
+// 読めるはずの行がなければerrInconsistentReadにする
+func mustGet(db *db, key string) (row, error) {
+	r, err := db.get(key)
+	if errors.Is(err, engine.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %w", errInconsistentRead, err)
+	}
+
+	return r, err
+}
+
+type orderLine struct {
+	item     int
+	supplyW  int
+	quantity int
+}
+
+// 全部読んでから書く
+func newOrder(db *db, w, d, c int, lines []orderLine) error {
+	prices := make([]int, len(lines))
+	for n, line := range lines {
+		item, err := db.get(itemKey(line.item))
+		if errors.Is(err, engine.ErrNotFound) {
+			return errRollback
+		}
+		if err != nil {
+			return err
+		}
+		prices[n] = item["price"]
+	}
+
+	district, err := db.get(districtKey(w, d))
+	if err != nil {
+		return err
+	}
+	customer, err := db.get(customerKey(w, d, c))
+	if err != nil {
+		return err
+	}
+	stocks := make([]row, len(lines))
+	for n, line := range lines {
+		stocks[n], err = db.get(stockKey(line.supplyW, line.item))
+		if err != nil {
+			return err
+		}
+	}
+
+	o := district["next_o_id"]
+	district["next_o_id"]++
+	err = db.put(districtKey(w, d), district)
+	if err != nil {
+		return err
+	}
+
+	customer["last_o_id"] = o
+	err = db.put(customerKey(w, d, c), customer)
+	if err != nil {
+		return err
+	}
+
+	allLocal := 1
+	for n, line := range lines {
+		stock := stocks[n]
+		if stock["quantity"] >= line.quantity+10 {
+			stock["quantity"] -= line.quantity
+		} else {
+			stock["quantity"] += 91 - line.quantity
+		}
+		stock["ytd"] += line.quantity
+		stock["order_cnt"]++
+		if line.supplyW != w {
+			stock["remote_cnt"]++
+			allLocal = 0
+		}
+
+		err := db.put(stockKey(line.supplyW, line.item), stock)
+		if err != nil {
+			return err
+		}
+
+		err = db.put(orderLineKey(w, d, o, n+1), row{
+			"item":      line.item,
+			"supply_w":  line.supplyW,
+			"quantity":  line.quantity,
+			"amount":    line.quantity * prices[n],
+			"delivered": 0,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.put(orderKey(w, d, o), row{"c_id": c, "ol_cnt": len(lines), "carrier_id": 0, "all_local": allLocal})
+}
+
+func payment(db *db, w, d, c, amount int) error {
+	warehouse, err := db.get(warehouseKey(w))
+	if err != nil {
+		return err
+	}
+	district, err := db.get(districtKey(w, d))
+	if err != nil {
+		return err
+	}
+	customer, err := db.get(customerKey(w, d, c))
+	if err != nil {
+		return err
+	}
+
+	warehouse["ytd"] += amount
+	err = db.put(warehouseKey(w), warehouse)
+	if err != nil {
+		return err
+	}
+
+	district["ytd"] += amount
+	err = db.put(districtKey(w, d), district)
+	if err != nil {
+		return err
+	}
+
+	customer["balance"] -= amount
+	customer["ytd_payment"] += amount
+	customer["payment_cnt"]++
+
+	return db.put(customerKey(w, d, c), customer)
+}
+
+// 読み取りのみ。顧客の最後の注文とその明細を読む
+func orderStatus(db *db, w, d, c int) error {
+	customer, err := db.get(customerKey(w, d, c))
+	if err != nil {
+		return err
+	}
+
+	o := customer["last_o_id"]
+	if o == 0 {
+		return nil
+	}
+
+	order, err := mustGet(db, orderKey(w, d, o))
+	if err != nil {
+		return err
+	}
+	for n := 1; n <= order["ol_cnt"]; n++ {
+		_, err := mustGet(db, orderLineKey(w, d, o, n))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 地区ごとに最も古い未配達の注文を配達する
+func delivery(db *db, w, carrier, districts int) error {
+	for d := 1; d <= districts; d++ {
+		district, err := db.get(districtKey(w, d))
+		if err != nil {
+			return err
+		}
+
+		o := district["next_delivery"]
+		if o >= district["next_o_id"] {
+			continue
+		}
+
+		order, err := mustGet(db, orderKey(w, d, o))
+		if err != nil {
+			return err
+		}
+		lines := make([]row, order["ol_cnt"])
+		for n := range lines {
+			lines[n], err = mustGet(db, orderLineKey(w, d, o, n+1))
+			if err != nil {
+				return err
+			}
+		}
+		customer, err := db.get(customerKey(w, d, order["c_id"]))
+		if err != nil {
+			return err
+		}
+
+		district["next_delivery"]++
+		err = db.put(districtKey(w, d), district)
+		if err != nil {
+			return err
+		}
+
+		order["carrier_id"] = carrier
+		err = db.put(orderKey(w, d, o), order)
+		if err != nil {
+			return err
+		}
+
+		total := 0
+		for n, line := range lines {
+			line["delivered"] = 1
+			total += line["amount"]
+
+			err := db.put(orderLineKey(w, d, o, n+1), line)
+			if err != nil {
+				return err
+			}
+		}
+
+		customer["balance"] += total
+		customer["delivery_cnt"]++
+		err = db.put(customerKey(w, d, order["c_id"]), customer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 読み取りのみ。直近20件の注文の商品のうち在庫がthreshold未満のものを数える
+func stockLevel(db *db, w, d, threshold int) (int, error) {
+	district, err := db.get(districtKey(w, d))
+	if err != nil {
+		return 0, err
+	}
+
+	items := make(map[int]struct{})
+	for o := max(1, district["next_o_id"]-20); o < district["next_o_id"]; o++ {
+		order, err := mustGet(db, orderKey(w, d, o))
+		if err != nil {
+			return 0, err
+		}
+
+		for n := 1; n <= order["ol_cnt"]; n++ {
+			line, err := mustGet(db, orderLineKey(w, d, o, n))
+			if err != nil {
+				return 0, err
+			}
+			items[line["item"]] = struct{}{}
+		}
+	}
+
+	low := 0
+	for item := range items {
+		stock, err := db.get(stockKey(w, item))
+		if err != nil {
+			return 0, err
+		}
+		if stock["quantity"] < threshold {
+			low++
+		}
+	}
+
+	return low, nil
+}
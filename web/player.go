@@ -0,0 +1,265 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"mvcc-go/engine"
+	"mvcc-go/scenario"
+	"mvcc-go/schedule"
+	"mvcc-go/shell"
+	"strconv"
+	"strings"
+)
+
+type stepStatus string
+
+const (
+	stepQueued  stepStatus = "queued"
+	stepRunning stepStatus = "running" // シェルで実行して結果を待っている
+	stepBlocked stepStatus = "blocked"
+	stepDone    stepStatus = "done"
+)
+
+type playerStep struct {
+	scenario.Step
+	status  stepStatus
+	blocked bool
+	got     string
+	ok      bool
+}
+
+// シナリオの行をシェルのコマンドにして1行ずつ実行し、結果を期待と比べる。
+// schedule.Scenario.Followと同じく、ロック待ちのトランザクションの後の行は待ちが解けるまで後回しにする。
+// ただしエンジンは実時間で動くので、解放されたロックを複数のトランザクションが待っていると
+// どれが先に取るかはFollowと異なることがある
+type player struct {
+	scenario scenario.Scenario
+	level    engine.IsolationLevel
+	steps    []*playerStep
+	running  map[string]*playerStep // セッション名 -> 結果を待っている行。gcは""
+	seen     int                    // 突き合わせ終わったシェルのイベントの数
+}
+
+func newPlayer(sc scenario.Scenario, level engine.IsolationLevel) (*player, error) {
+	p := &player{
+		scenario: sc,
+		level:    level,
+		steps:    make([]*playerStep, len(sc.Steps)),
+		running:  make(map[string]*playerStep),
+	}
+
+	for i, step := range sc.Steps {
+		// シェルのコマンドは空白で区切るので、空白を含む値や空の値は渡せない
+		for _, arg := range []string{step.Op.Key, step.Op.Value} {
+			if strings.ContainsAny(arg, " \t") {
+				return nil, fmt.Errorf("%s:%d: %q contains spaces, which the shell cannot take", sc.Name, step.Line, arg)
+			}
+		}
+		if (step.Op.Kind == schedule.OpSet || step.Op.Kind == schedule.OpAppend) && step.Op.Value == "" {
+			return nil, fmt.Errorf("%s:%d: the shell cannot set an empty value", sc.Name, step.Line)
+		}
+
+		p.steps[i] = &playerStep{Step: step, status: stepQueued}
+	}
+
+	return p, nil
+}
+
+// 次に実行できる行。ロック待ちのトランザクションの行は飛ばす。なければ-1
+func (p *player) next() int {
+	for i, ps := range p.steps {
+		if ps.status != stepQueued {
+			continue
+		}
+		if _, ok := p.running[ps.Tx]; ok {
+			continue
+		}
+		return i
+	}
+
+	return -1
+}
+
+func (p *player) finished() bool {
+	for _, ps := range p.steps {
+		if ps.status != stepDone {
+			return false
+		}
+	}
+
+	return true
+}
+
+// 次の行を実行する。トランザクションを開いていなければ先にBeginする
+func (p *player) step(sh *shell.Shell, console io.Writer) {
+	p.sync(sh)
+
+	i := p.next()
+	if i < 0 {
+		if p.finished() {
+			fmt.Fprintln(console, "# scenario finished")
+		} else {
+			fmt.Fprintln(console, "# every remaining step waits for a blocked session")
+		}
+		return
+	}
+
+	ps := p.steps[i]
+	fmt.Fprintf(console, "# line %d: %s\n", ps.Line, ps.Step)
+
+	level := ps.Level
+	if level == "" {
+		level = p.level
+	}
+
+	if ps.Op.Kind == schedule.OpBegin {
+		err := p.do(sh, console, "begin "+ps.Tx+" "+string(level))
+		p.finish(ps, "", err, "")
+		return
+	}
+
+	if !open(sh, ps.Tx) {
+		err := p.do(sh, console, "begin "+ps.Tx+" "+string(level))
+		if err != nil {
+			p.finish(ps, "", err, "")
+			return
+		}
+	}
+
+	key := ps.Tx
+	if ps.Op.Kind == schedule.OpGC {
+		key = ""
+	}
+	p.running[key] = ps
+	ps.status = stepRunning
+
+	err := p.do(sh, console, command(ps.Tx, ps.Op))
+	if err != nil {
+		delete(p.running, key)
+		p.finish(ps, "", err, "")
+		return
+	}
+
+	p.sync(sh)
+}
+
+// シェルのエラーもコンソールに出す
+func (p *player) do(sh *shell.Shell, console io.Writer, line string) error {
+	fmt.Fprintf(console, "> %s\n", line)
+
+	err := sh.Do(line)
+	if err != nil {
+		fmt.Fprintf(console, "error: %v\n", err)
+	}
+
+	return err
+}
+
+func command(tx string, op schedule.Op) string {
+	switch op.Kind {
+	case schedule.OpGet:
+		return fmt.Sprintf("%s get %s", tx, op.Key)
+	case schedule.OpSet, schedule.OpAppend:
+		return fmt.Sprintf("%s %s %s %s", tx, op.Kind, op.Key, op.Value)
+	case schedule.OpCommit, schedule.OpAbort:
+		return fmt.Sprintf("%s %s", op.Kind, tx)
+	}
+
+	return string(op.Kind)
+}
+
+func open(sh *shell.Shell, name string) bool {
+	for _, sess := range sh.Sessions() {
+		if sess.Name == name {
+			return !sess.Ended
+		}
+	}
+
+	return false
+}
+
+// シェルに増えたイベントを、結果を待っている行に突き合わせる
+func (p *player) sync(sh *shell.Shell) {
+	events := sh.Events()
+	for _, e := range events[p.seen:] {
+		if strings.HasPrefix(e.Op, "begin ") {
+			continue
+		}
+
+		// コンソールから打ったコマンドは対応する行がない
+		ps, ok := p.running[e.Session]
+		if !ok {
+			continue
+		}
+
+		if e.Blocked {
+			ps.blocked = true
+			ps.status = stepBlocked
+			continue
+		}
+
+		delete(p.running, e.Session)
+		result := e.Result()
+		if ps.Op.Kind == schedule.OpGC {
+			result = strconv.Quote(e.Value)
+		}
+		p.finish(ps, e.Value, e.Err, result)
+	}
+	p.seen = len(events)
+}
+
+// resultが空ならエラーか"ok"を表示する
+func (p *player) finish(ps *playerStep, value string, err error, result string) {
+	switch {
+	case result != "":
+	case err != nil:
+		result = fmt.Sprintf("error: %v", err)
+	default:
+		result = "ok"
+	}
+	if ps.blocked {
+		result = "blocked -> " + result
+	}
+
+	ps.status = stepDone
+	ps.got = result
+	ps.ok = ps.Expect.Match(ps.blocked, value, err)
+}
+
+type stepState struct {
+	Line   int        `json:"line"`
+	Text   string     `json:"text"`
+	Expect string     `json:"expect"`
+	Status stepStatus `json:"status"`
+	Got    string     `json:"got"`
+	OK     bool       `json:"ok"`
+}
+
+type scenarioState struct {
+	Name     string                `json:"name"`
+	Level    engine.IsolationLevel `json:"level"`
+	Steps    []stepState           `json:"steps"`
+	Next     int                   `json:"next"` // 次に実行する行の添字。なければ-1
+	Finished bool                  `json:"finished"`
+	Passed   bool                  `json:"passed"` // 全ての行が期待どおりに終わった
+}
+
+func (p *player) state() *scenarioState {
+	st := &scenarioState{
+		Name:     p.scenario.Name,
+		Level:    p.level,
+		Steps:    make([]stepState, len(p.steps)),
+		Next:     p.next(),
+		Finished: p.finished(),
+		Passed:   p.finished(),
+	}
+
+	for i, ps := range p.steps {
+		st.Steps[i] = stepState{Line: ps.Line, Text: ps.Step.String(), Expect: ps.Expect.String(), Status: ps.status, Got: ps.got, OK: ps.ok}
+		if ps.status == stepDone && !ps.ok {
+			st.Passed = false
+		}
+	}
+
+	return st
+}
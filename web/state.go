@@ -0,0 +1,146 @@
+package web
+
+import (
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"time"
+)
+
+// 画面を描くのに必要なものを全て返す。ブラウザはこれを定期的に取り直す
+type state struct {
+	Engine    string         `json:"engine"`
+	Engines   []string       `json:"engines"`
+	Sessions  []sessionState `json:"sessions"`
+	Events    []event        `json:"events"`
+	Locks     []keyLocks     `json:"locks"`
+	Versions  []keyVersions  `json:"versions"`
+	HasLocks  bool           `json:"hasLocks"`
+	HasChains bool           `json:"hasChains"` // HistoryEngineならtrue
+	Console   string         `json:"console"`
+	Scenario  *scenarioState `json:"scenario"`
+}
+
+type sessionState struct {
+	Name    string                `json:"name"`
+	TxID    int                   `json:"txID"`
+	Level   engine.IsolationLevel `json:"level"`
+	Ended   bool                  `json:"ended"`
+	Pending string                `json:"pending"`
+	Waiting string                `json:"waiting"`
+}
+
+type event struct {
+	Seq     int       `json:"seq"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	TxID    int       `json:"txID"`
+	Op      string    `json:"op"`
+	Result  string    `json:"result"`
+	Failed  bool      `json:"failed"` // not found以外のエラー
+	Blocked bool      `json:"blocked"`
+	Resumed bool      `json:"resumed"`
+}
+
+type lockEntry struct {
+	TxID    int    `json:"txID"`
+	Session string `json:"session"`
+	Mode    string `json:"mode"`
+	Waited  string `json:"waited,omitempty"`
+}
+
+type keyLocks struct {
+	Key     string      `json:"key"`
+	Holders []lockEntry `json:"holders"`
+	Waiters []lockEntry `json:"waiters"`
+}
+
+type version struct {
+	Value        string `json:"value"`
+	BeginTxID    int    `json:"beginTxID"`
+	BeginSession string `json:"beginSession"`
+	EndTxID      int    `json:"endTxID"`
+	EndSession   string `json:"endSession"`
+	CommitNo     int    `json:"commitNo"`
+	Visible      bool   `json:"visible"`
+}
+
+type keyVersions struct {
+	Key      string    `json:"key"`
+	Versions []version `json:"versions"`
+}
+
+// must be called with s.mu locked.
+func (s *Server) state() state {
+	st := state{
+		Engine:   s.engineName,
+		Engines:  registry.Names(),
+		Sessions: make([]sessionState, 0),
+		Events:   make([]event, 0),
+		Locks:    make([]keyLocks, 0),
+		Versions: make([]keyVersions, 0),
+	}
+
+	for _, sess := range s.shell.Sessions() {
+		st.Sessions = append(st.Sessions, sessionState(sess))
+	}
+
+	// 使い終わった名前を後のトランザクションが使うこともあるので、txIDごとに覚えておく
+	names := make(map[int]string)
+	for _, e := range s.shell.Events() {
+		if e.Session != "" {
+			names[e.TxID] = e.Session
+		}
+		st.Events = append(st.Events, event{
+			Seq:     e.Seq,
+			Time:    e.Time,
+			Session: e.Session,
+			TxID:    e.TxID,
+			Op:      e.Op,
+			Result:  e.Result(),
+			Failed:  e.Err != nil && e.Result() != "not found",
+			Blocked: e.Blocked,
+			Resumed: e.Resumed,
+		})
+	}
+
+	if locker, ok := s.shell.Engine().(engine.LockEngine); ok {
+		st.HasLocks = true
+		for _, kl := range locker.Locks() {
+			entry := keyLocks{Key: kl.Key, Holders: make([]lockEntry, 0), Waiters: make([]lockEntry, 0)}
+			for _, h := range kl.Holders {
+				entry.Holders = append(entry.Holders, lockEntry{TxID: h.TxID, Session: names[h.TxID], Mode: string(h.Mode)})
+			}
+			for _, w := range kl.Waiters {
+				entry.Waiters = append(entry.Waiters, lockEntry{TxID: w.TxID, Session: names[w.TxID], Mode: string(w.Mode), Waited: w.Waited.Round(time.Millisecond).String()})
+			}
+			st.Locks = append(st.Locks, entry)
+		}
+	}
+
+	if historian, ok := s.shell.Engine().(engine.HistoryEngine); ok {
+		st.HasChains = true
+		for _, key := range s.shell.Keys() {
+			kv := keyVersions{Key: key, Versions: make([]version, 0)}
+			for _, v := range historian.History(key) {
+				kv.Versions = append(kv.Versions, version{
+					Value:        v.Value,
+					BeginTxID:    v.BeginTxID,
+					BeginSession: names[v.BeginTxID],
+					EndTxID:      v.EndTxID,
+					EndSession:   names[v.EndTxID],
+					CommitNo:     v.CommitNo,
+					Visible:      v.Visible,
+				})
+			}
+			st.Versions = append(st.Versions, kv)
+		}
+	}
+
+	st.Console = s.console.String()
+
+	if s.player != nil {
+		st.Scenario = s.player.state()
+	}
+
+	return st
+}
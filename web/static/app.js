@@ -0,0 +1,283 @@
+'use strict';
+
+// サーバーの状態を定期的に取り直して描き直す。描画はtextContentだけを使う
+
+const $ = (id) => document.getElementById(id);
+
+let scenarios = [];
+let playing = null;
+let shownEngine = null;
+
+async function api(method, path, body) {
+  const res = await fetch(path, {
+    method,
+    headers: body ? { 'Content-Type': 'application/json' } : {},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(data.error || res.statusText);
+  }
+  return data;
+}
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (className) e.className = className;
+  return e;
+}
+
+function tx(txID, session) {
+  if (!txID) return '-';
+  return session ? `${session}(tx${txID})` : `tx${txID}`;
+}
+
+function renderTimeline(events) {
+  // 最初に現れた順のセッションの列と、gcの列
+  const columns = [];
+  for (const e of events) {
+    if (!columns.includes(e.session)) columns.push(e.session);
+  }
+
+  const table = $('timeline');
+  table.replaceChildren();
+
+  const head = el('tr');
+  head.append(el('th', '#'));
+  for (const c of columns) head.append(el('th', c === '' ? 'engine' : c));
+  table.append(head);
+
+  const waiting = new Set();
+  for (const e of events) {
+    const row = el('tr');
+    row.append(el('td', String(e.seq), 'seq'));
+
+    for (const c of columns) {
+      if (c !== e.session) {
+        row.append(el('td', '', waiting.has(c) ? 'waiting' : ''));
+        continue;
+      }
+
+      const kind = e.op.split(' ')[0];
+      let className = 'op';
+      if (c === '') className = 'engine';
+      else if (kind === 'begin' || kind === 'commit' || kind === 'abort') className = kind;
+      if (e.failed) className = 'failed';
+      if (e.blocked) className = 'blocked';
+      if (e.resumed) className += ' resumed';
+
+      const cell = el('td', '', className);
+      cell.append(el('span', kind === 'begin' ? `${e.op} (tx${e.txID})` : e.op));
+      if (kind !== 'begin') {
+        let result = e.result.trim();
+        if (e.resumed) result += ' (resumed)';
+        cell.append(el('span', ` -> ${result}`, 'result'));
+      }
+      row.append(cell);
+
+      if (e.blocked) waiting.add(c);
+      else waiting.delete(c);
+    }
+
+    table.append(row);
+  }
+
+  const panel = $('timeline-panel');
+  panel.scrollTop = panel.scrollHeight;
+}
+
+function renderSessions(sessions) {
+  const table = $('sessions');
+  table.replaceChildren();
+  for (const s of sessions) {
+    let state = 'open';
+    if (s.ended) state = 'ended';
+    if (s.pending) state = `blocked on "${s.pending}"` + (s.waiting ? `\n${s.waiting}` : '');
+
+    const row = el('tr');
+    row.append(el('td', s.name), el('td', `tx${s.txID}`), el('td', s.level), el('td', state));
+    table.append(row);
+  }
+}
+
+function renderLocks(state) {
+  const table = $('locks');
+  table.replaceChildren();
+  if (!state.hasLocks) {
+    table.append(el('tr')).append(el('td', 'this engine has no locks'));
+    return;
+  }
+
+  for (const kl of state.locks) {
+    const held = kl.holders.map((h) => `${tx(h.txID, h.session)} ${h.mode}`).join(', ');
+    const waiting = kl.waiters.map((w) => `${tx(w.txID, w.session)} ${w.mode} ${w.waited}`).join(', ');
+
+    const row = el('tr');
+    row.append(el('td', JSON.stringify(kl.key)), el('td', `held: ${held}`), el('td', `waiting: ${waiting}`));
+    table.append(row);
+  }
+}
+
+function renderVersions(state) {
+  const div = $('versions');
+  div.replaceChildren();
+  if (!state.hasChains) {
+    div.append(el('p', 'this engine keeps no versions'));
+    return;
+  }
+
+  for (const kv of state.versions) {
+    const chain = el('div', undefined, 'chain');
+    chain.append(el('span', JSON.stringify(kv.key), 'key'));
+
+    kv.versions.forEach((v, i) => {
+      if (i > 0) chain.append(el('span', '→'));
+
+      const classes = ['version'];
+      if (!v.commitNo) classes.push('uncommitted');
+      // 上書きしたトランザクションがコミットしていれば、もう新しいスナップショットからは見えない
+      if (v.endTxID && kv.versions.some((w) => w.beginTxID === v.endTxID && w.commitNo)) classes.push('dead');
+      if (v.visible) classes.push('visible');
+
+      const box = el('div', JSON.stringify(v.value), classes.join(' '));
+      box.append(el('small', `by ${tx(v.beginTxID, v.beginSession)}`));
+      box.append(el('small', v.commitNo ? `commit #${v.commitNo}` : 'uncommitted'));
+      if (v.endTxID) box.append(el('small', `ended by ${tx(v.endTxID, v.endSession)}`));
+      chain.append(box);
+    });
+
+    div.append(chain);
+  }
+}
+
+function renderScenario(sc) {
+  $('scenario-panel').hidden = !sc;
+  $('step').disabled = !sc || sc.finished;
+  $('play').disabled = !sc || sc.finished;
+
+  const status = $('status');
+  status.className = '';
+  status.textContent = '';
+  if (!sc) return;
+
+  $('scenario-name').textContent = `${sc.name} (${sc.level})`;
+  if (sc.finished) {
+    status.textContent = sc.passed ? 'PASS' : 'FAIL';
+    status.className = sc.passed ? 'pass' : 'fail';
+  }
+
+  const list = $('steps');
+  list.replaceChildren();
+  sc.steps.forEach((s, i) => {
+    let text = s.text;
+    if (s.expect) text += ` -> ${s.expect}`;
+
+    const item = el('li', text, s.status);
+    item.value = s.line;
+    if (i === sc.next) item.classList.add('next');
+    if (s.status === 'done' && s.expect) item.classList.add(s.ok ? 'ok' : 'mismatch');
+    if (s.status === 'done') item.append(el('span', `  got ${s.got}`, 'got'));
+    list.append(item);
+  });
+}
+
+function render(state) {
+  const engine = $('engine');
+  if (engine.options.length === 0) {
+    for (const name of state.engines) engine.append(new Option(name, name));
+  }
+  // ポーリングで選びかけのエンジンを戻さないように、サーバー側で変わったときだけ合わせる
+  if (state.engine !== shownEngine) {
+    engine.value = shownEngine = state.engine;
+  }
+
+  renderTimeline(state.events);
+  renderSessions(state.sessions);
+  renderLocks(state);
+  renderVersions(state);
+  renderScenario(state.scenario);
+
+  const out = $('console');
+  const atBottom = out.scrollTop + out.clientHeight >= out.scrollHeight - 4;
+  out.textContent = state.console;
+  if (atBottom) out.scrollTop = out.scrollHeight;
+
+  if (playing && (!state.scenario || state.scenario.finished)) stop();
+}
+
+function fail(err) {
+  const status = $('status');
+  status.textContent = err.message;
+  status.className = 'fail';
+}
+
+async function refresh() {
+  try {
+    render(await api('GET', '/api/state'));
+  } catch (err) {
+    fail(err);
+  }
+}
+
+async function post(path, body) {
+  try {
+    render(await api('POST', path, body));
+  } catch (err) {
+    fail(err);
+  }
+}
+
+function stop() {
+  clearInterval(playing);
+  playing = null;
+  $('play').textContent = 'play';
+}
+
+function updateLevels() {
+  const sc = scenarios.find((s) => s.name === $('scenario').value);
+  const level = $('level');
+  level.replaceChildren();
+  for (const l of sc ? sc.levels : []) level.append(new Option(l, l));
+}
+
+async function init() {
+  scenarios = await api('GET', '/api/scenarios');
+  for (const sc of scenarios) $('scenario').append(new Option(sc.name, sc.name));
+  $('scenario').disabled = $('load').disabled = scenarios.length === 0;
+  updateLevels();
+
+  $('scenario').addEventListener('change', updateLevels);
+  $('reset').addEventListener('click', () => {
+    stop();
+    post('/api/reset', { engine: $('engine').value });
+  });
+  $('load').addEventListener('click', () => {
+    stop();
+    const sc = scenarios.find((s) => s.name === $('scenario').value);
+    // シナリオが対応していないエンジンなら、シナリオの最初のエンジンで動かす
+    let engine = $('engine').value;
+    if (sc && !sc.engines.includes(engine)) engine = sc.engines[0];
+    post('/api/scenario', { name: $('scenario').value, level: $('level').value, engine });
+  });
+  $('step').addEventListener('click', () => post('/api/scenario/step'));
+  $('play').addEventListener('click', () => {
+    if (playing) {
+      stop();
+      return;
+    }
+    $('play').textContent = 'pause';
+    playing = setInterval(() => post('/api/scenario/step'), 800);
+  });
+  $('exec').addEventListener('submit', (ev) => {
+    ev.preventDefault();
+    const line = $('line').value;
+    $('line').value = '';
+    post('/api/exec', { line });
+  });
+
+  await refresh();
+  setInterval(refresh, 500);
+}
+
+init().catch(fail);
@@ -0,0 +1,325 @@
+// ブラウザでトランザクションのタイムライン・ロック待ち・キーごとのバージョンチェーンを見ながら、
+// シェルのコマンドやシナリオを1ステップずつ動かすHTTPサーバー。
+// 画面は埋め込みの静的ファイルだけで、外部のネットワークは使わない
+package web
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/scenario"
+	"mvcc-go/shell"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//go:embed static
+var static embed.FS
+
+// ブラウザで見ている間に待ちが解けるのを観察できる長さにしてある
+const DefaultLockTimeout = 3 * time.Second
+
+// コンソールに残す出力の上限
+const consoleLimit = 64 << 10
+
+// 出力の末尾consoleLimitバイトまでを残す。上限の2倍まではためてから詰める
+type console struct {
+	buf []byte
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	if len(c.buf) > 2*consoleLimit {
+		c.buf = append(c.buf[:0], c.tail()...)
+	}
+
+	return len(p), nil
+}
+
+// 文字の途中からにならないよう、切り口がUTF-8の先頭バイトになるまで進める
+func (c *console) tail() []byte {
+	if len(c.buf) <= consoleLimit {
+		return c.buf
+	}
+
+	cut := len(c.buf) - consoleLimit
+	for cut < len(c.buf) && !utf8.RuneStart(c.buf[cut]) {
+		cut++
+	}
+
+	return c.buf[cut:]
+}
+
+func (c *console) String() string {
+	return string(c.tail())
+}
+
+type Option func(*Server)
+
+// シナリオとして選べるようにする
+func WithScenarios(scenarios ...scenario.Scenario) Option {
+	return func(s *Server) {
+		s.scenarios = append(s.scenarios, scenarios...)
+	}
+}
+
+func WithLockTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.lockTimeout = d
+	}
+}
+
+// 1つのエンジンを1つのシェルで動かす。リクエストは順に処理する
+type Server struct {
+	mux         *http.ServeMux
+	lockTimeout time.Duration
+	scenarios   []scenario.Scenario
+
+	mu         sync.Mutex // 以下を守る
+	engineName string
+	shell      *shell.Shell
+	console    *console
+	player     *player
+}
+
+func New(engineName string, opts ...Option) (*Server, error) {
+	s := &Server{
+		mux:         http.NewServeMux(),
+		lockTimeout: DefaultLockTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := s.reset(engineName)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.Handle("GET /", http.FileServerFS(files))
+	s.mux.HandleFunc("GET /api/state", s.handleState)
+	s.mux.HandleFunc("POST /api/exec", s.handleExec)
+	s.mux.HandleFunc("POST /api/reset", s.handleReset)
+	s.mux.HandleFunc("GET /api/scenarios", s.handleScenarios)
+	s.mux.HandleFunc("POST /api/scenario", s.handleLoad)
+	s.mux.HandleFunc("POST /api/scenario/step", s.handleStep)
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// 新しいエンジンとシェルで始め直す。must be called with s.mu locked.
+func (s *Server) reset(engineName string) error {
+	newEngine, err := registry.Lookup(engineName)
+	if err != nil {
+		return err
+	}
+
+	s.engineName = engineName
+	s.console = &console{}
+	s.shell = shell.New(newEngine, s.console, []engine.Option{engine.WithLockTimeout(s.lockTimeout)},
+		shell.WithVersions(false))
+	s.player = nil
+
+	return nil
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeState(w)
+}
+
+func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Line string `json:"line"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(s.console, "> %s\n", req.Line)
+	s.shell.Exec(req.Line)
+	s.writeState(w)
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Engine string `json:"engine"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Engine == "" {
+		req.Engine = s.engineName
+	}
+	err := s.reset(req.Engine)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.writeState(w)
+}
+
+type scenarioInfo struct {
+	Name    string                  `json:"name"`
+	Engines []string                `json:"engines"`
+	Levels  []engine.IsolationLevel `json:"levels"`
+}
+
+func (s *Server) handleScenarios(w http.ResponseWriter, r *http.Request) {
+	infos := make([]scenarioInfo, len(s.scenarios))
+	for i, sc := range s.scenarios {
+		infos[i] = scenarioInfo{Name: sc.Name, Engines: sc.Engines, Levels: sc.Levels}
+		if len(sc.Engines) == 0 {
+			infos[i].Engines = registry.Names()
+		}
+		if len(sc.Levels) == 0 {
+			infos[i].Levels = []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead}
+		}
+	}
+
+	writeJSON(w, infos)
+}
+
+// 名前で選んだシナリオか、textに書いたシナリオを新しいエンジンで始める
+func (s *Server) handleLoad(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string `json:"name"`
+		Text   string `json:"text"`
+		Engine string `json:"engine"`
+		Level  string `json:"level"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	sc, err := s.lookupScenario(req.Name, req.Text)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	level := engine.RepeatableRead
+	switch {
+	case req.Level != "":
+		level, err = registry.ParseLevel(req.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	case len(sc.Levels) > 0:
+		level = sc.Levels[0]
+	}
+
+	p, err := newPlayer(sc, level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	engineName := req.Engine
+	if engineName == "" {
+		engineName = s.engineName
+	}
+	err = s.reset(engineName)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.player = p
+	fmt.Fprintf(s.console, "# scenario %s on %s, %s\n", sc.Name, engineName, level)
+	s.writeState(w)
+}
+
+func (s *Server) lookupScenario(name, text string) (scenario.Scenario, error) {
+	if text != "" {
+		if name == "" {
+			name = "scenario"
+		}
+		return scenario.Parse(name, strings.NewReader(text))
+	}
+
+	for _, sc := range s.scenarios {
+		if sc.Name == name {
+			return sc, nil
+		}
+	}
+
+	return scenario.Scenario{}, fmt.Errorf("scenario %q not found", name)
+}
+
+func (s *Server) handleStep(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.player == nil {
+		writeError(w, http.StatusConflict, errNoScenario)
+		return
+	}
+
+	s.player.step(s.shell, s.console)
+	s.writeState(w)
+}
+
+var errNoScenario = errors.New("no scenario is loaded")
+
+// must be called with s.mu locked.
+func (s *Server) writeState(w http.ResponseWriter) {
+	s.shell.Poll()
+	if s.player != nil {
+		s.player.sync(s.shell)
+	}
+
+	writeJSON(w, s.state())
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,266 @@
+package web_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mvcc-go/lock"
+	"mvcc-go/scenario"
+	"mvcc-go/web"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// テストで見るところだけ
+type state struct {
+	Engine   string
+	Console  string
+	Sessions []struct {
+		Name    string
+		Pending string
+		Waiting string
+	}
+	Events []struct {
+		Session string
+		Op      string
+		Result  string
+		Blocked bool
+		Resumed bool
+	}
+	Locks []struct {
+		Key     string
+		Holders []struct{ Session, Mode string }
+		Waiters []struct{ Session, Mode string }
+	}
+	Versions []struct {
+		Key      string
+		Versions []struct {
+			Value    string
+			CommitNo int
+		}
+	}
+	Scenario *struct {
+		Steps []struct {
+			Line   int
+			Text   string
+			Expect string
+			Status string
+			Got    string
+			OK     bool
+		}
+		Next     int
+		Finished bool
+		Passed   bool
+	}
+}
+
+func request(t *testing.T, srv *httptest.Server, method, path string, body any) state {
+	t.Helper()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, srv.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		t.Fatalf("%s %s: %s %s", method, path, res.Status, b)
+	}
+
+	var st state
+	err = json.NewDecoder(res.Body).Decode(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return st
+}
+
+func newServer(t *testing.T, engineName string, opts ...web.Option) *httptest.Server {
+	t.Helper()
+
+	s, err := web.New(engineName, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestStatic(t *testing.T) {
+	srv := newServer(t, "appendonly")
+
+	for path, want := range map[string]string{
+		"/":          "<title>mvcc-go</title>",
+		"/app.js":    "/api/state",
+		"/style.css": "#timeline",
+	} {
+		res, err := srv.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK || !strings.Contains(string(b), want) {
+			t.Errorf("%s: expected %q, but got %s\n%s", path, want, res.Status, b)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	srv := newServer(t, "locking", web.WithLockTimeout(lock.NoTimeout))
+
+	var st state
+	for _, line := range []string{"begin a", "begin b", "a set k v", "b get k"} {
+		st = request(t, srv, "POST", "/api/exec", map[string]string{"line": line})
+	}
+
+	if len(st.Sessions) != 2 || st.Sessions[1].Pending != "get k" || !strings.Contains(st.Sessions[1].Waiting, `s lock on "k" held by a(tx1)`) {
+		t.Errorf("expected b to wait for a, but got %+v", st.Sessions)
+	}
+	if len(st.Locks) != 1 || len(st.Locks[0].Waiters) != 1 || st.Locks[0].Waiters[0].Session != "b" || st.Locks[0].Holders[0].Session != "a" {
+		t.Errorf("expected b waiting for a lock held by a, but got %+v", st.Locks)
+	}
+
+	st = request(t, srv, "POST", "/api/exec", map[string]string{"line": "commit a"})
+	last := st.Events[len(st.Events)-1]
+	if last.Session != "b" || last.Op != "get k" || last.Result != `"v"` || !last.Resumed {
+		t.Errorf("expected b to resume and read \"v\", but got %+v", last)
+	}
+
+	st = request(t, srv, "POST", "/api/reset", map[string]string{"engine": "appendonly"})
+	if st.Engine != "appendonly" || len(st.Events) != 0 {
+		t.Fatalf("expected a fresh appendonly engine, but got %+v", st)
+	}
+
+	for _, line := range []string{"begin a", "a set k v1", "commit a", "begin b", "b set k v2"} {
+		st = request(t, srv, "POST", "/api/exec", map[string]string{"line": line})
+	}
+	if len(st.Versions) != 1 || len(st.Versions[0].Versions) != 2 || st.Versions[0].Versions[0].CommitNo != 1 || st.Versions[0].Versions[1].CommitNo != 0 {
+		t.Errorf("expected a committed and an uncommitted version of k, but got %+v", st.Versions)
+	}
+}
+
+// testdataのシナリオを最初のエンジンと分離レベルで最後まで進める
+func TestScenario(t *testing.T) {
+	// 解放されたロックを複数のトランザクションが待っているとき、どれが取るかは実行時に決まる
+	racy := map[string]bool{"deadlock.scenario": true}
+
+	paths, err := filepath.Glob("../scenario/testdata/*.scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		sc, err := scenario.ParseFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			if racy[filepath.Base(path)] {
+				t.Skip("the order of lock grants is not deterministic")
+			}
+			t.Parallel()
+
+			engineName, level := "appendonly", "repeatable_read"
+			if len(sc.Engines) > 0 {
+				engineName = sc.Engines[0]
+			}
+			if len(sc.Levels) > 0 {
+				level = string(sc.Levels[0])
+			}
+
+			srv := newServer(t, engineName, web.WithScenarios(sc), web.WithLockTimeout(time.Second))
+			st := request(t, srv, "POST", "/api/scenario", map[string]string{"name": path, "level": level})
+
+			for !st.Scenario.Finished {
+				// ブロックされた行は、ロックを解放した行のステップで終わっている
+				if st.Scenario.Next < 0 {
+					t.Fatalf("every remaining step is blocked: %+v", st.Scenario)
+				}
+				st = request(t, srv, "POST", "/api/scenario/step", nil)
+			}
+
+			if !st.Scenario.Passed {
+				for _, step := range st.Scenario.Steps {
+					if !step.OK && step.Expect != "" {
+						t.Errorf("line %d: %s: expected %s, but got %s", step.Line, step.Text, step.Expect, step.Got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestScenarioText(t *testing.T) {
+	srv := newServer(t, "delta")
+
+	st := request(t, srv, "POST", "/api/scenario", map[string]string{"text": `
+tx1: set k=v1
+tx2: get k -> "v1"
+tx1: commit
+tx2: get k -> "v2"
+`})
+
+	for !st.Scenario.Finished {
+		st = request(t, srv, "POST", "/api/scenario/step", nil)
+	}
+
+	if st.Scenario.Passed {
+		t.Fatalf("expected a mismatch, but got %+v", st.Scenario)
+	}
+
+	got := make([]string, 0)
+	for _, step := range st.Scenario.Steps {
+		got = append(got, step.Got)
+	}
+	want := []string{"ok", "not found", "ok", "not found"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %v, but got %v", want, got)
+	}
+}
+
+// 古い出力から捨て、文字の途中では切らない
+func TestConsoleLimit(t *testing.T) {
+	srv := newServer(t, "naive")
+
+	line := "# " + strings.Repeat("あ", 1000)
+	var st state
+	for i := range 50 {
+		st = request(t, srv, "POST", "/api/exec", map[string]string{"line": fmt.Sprintf("%s %d", line, i)})
+	}
+
+	if len(st.Console) > 64<<10 {
+		t.Errorf("expected at most 64KiB of console, but got %d bytes", len(st.Console))
+	}
+	if !utf8.ValidString(st.Console) {
+		t.Error("expected the console to start at a character boundary")
+	}
+	if !strings.HasSuffix(st.Console, line+" 49\n") {
+		t.Errorf("expected the latest line to be kept, but got ...%q", st.Console[max(len(st.Console)-20, 0):])
+	}
+}
@@ -0,0 +1,86 @@
+package ycsb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+)
+
+type Distribution string
+
+const (
+	Uniform Distribution = "uniform"
+	Zipfian Distribution = "zipfian" // よく使われるキーを散らしたもの（YCSBのscrambled zipfian）
+	Latest  Distribution = "latest"  // 最近挿入したキーほど選ばれやすい
+)
+
+// YCSBの既定と同じ偏り
+const zipfianTheta = 0.99
+
+// Gray et al. "Quickly Generating Billion-Record Synthetic Databases" の方法で[0, n)を選ぶ
+type zipfian struct {
+	n     int
+	theta float64
+	zetan float64
+	alpha float64
+	eta   float64
+}
+
+func newZipfian(n int, theta float64) *zipfian {
+	zeta := func(n int) float64 {
+		sum := 0.0
+		for i := 1; i <= n; i++ {
+			sum += 1 / math.Pow(float64(i), theta)
+		}
+		return sum
+	}
+
+	z := &zipfian{
+		n:     n,
+		theta: theta,
+		zetan: zeta(n),
+		alpha: 1 / (1 - theta),
+	}
+	z.eta = (1 - math.Pow(2/float64(n), 1-theta)) / (1 - zeta(2)/z.zetan)
+
+	return z
+}
+
+// 0が最も選ばれやすい
+func (z *zipfian) next(rng *rand.Rand) int {
+	u := rng.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+
+	return min(int(float64(z.n)*math.Pow(z.eta*u-z.eta+1, z.alpha)), z.n-1)
+}
+
+// 既存のキーの番号を選ぶ。insertedは挿入済みのキーの数
+type chooser func(rng *rand.Rand, inserted int) int
+
+func newChooser(d Distribution, records int) chooser {
+	switch d {
+	case Zipfian:
+		z := newZipfian(records, zipfianTheta)
+		return func(rng *rand.Rand, inserted int) int {
+			h := fnv.New64a()
+			_, _ = h.Write(binary.LittleEndian.AppendUint64(nil, uint64(z.next(rng))))
+			return int(h.Sum64() % uint64(inserted))
+		}
+	case Latest:
+		z := newZipfian(records, zipfianTheta)
+		return func(rng *rand.Rand, inserted int) int {
+			return max(inserted-1-z.next(rng), 0)
+		}
+	default:
+		return func(rng *rand.Rand, inserted int) int {
+			return rng.IntN(inserted)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package ycsb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mvcc-go/engine"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+type Config struct {
+	Workload Workload
+	Level    engine.IsolationLevel
+
+	// 空ならWorkloadの分布
+	Distribution Distribution
+
+	Records     int // 最初に読み込むキーの数。0なら1000
+	Operations  int // 0なら1000
+	ValueSize   int // 0なら100バイト
+	Concurrency int // 0なら1
+	ScanLength  int // scanで読む最大のキー数。0なら10
+
+	// 0ならGCを呼ばない。実行中に呼ぶとバージョンが増えすぎない
+	GCInterval time.Duration
+
+	// 0ならエンジンの設定
+	LockTimeout time.Duration
+
+	Seed uint64
+}
+
+func (c Config) withDefaults() Config {
+	if c.Distribution == "" {
+		c.Distribution = c.Workload.Distribution
+	}
+	if c.Level == "" {
+		c.Level = engine.RepeatableRead
+	}
+	for _, v := range []*int{&c.Records, &c.Operations} {
+		if *v == 0 {
+			*v = 1000
+		}
+	}
+	if c.ValueSize == 0 {
+		c.ValueSize = 100
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 1
+	}
+	if c.ScanLength == 0 {
+		c.ScanLength = 10
+	}
+
+	return c
+}
+
+type Result struct {
+	Engine     string
+	Workload   string
+	Level      engine.IsolationLevel
+	Operations int
+	Aborts     int // ロック待ちのタイムアウトや更新の競合で失敗したトランザクション
+	Elapsed    time.Duration
+	P50        time.Duration
+	P99        time.Duration
+
+	// 実行直後にエンジンが保持していたバージョン数とその大きさ。engine.StatsEngineでなければ0
+	Versions     int
+	VersionBytes int
+}
+
+func (r Result) Throughput() float64 {
+	return float64(r.Operations) / r.Elapsed.Seconds()
+}
+
+func (r Result) AbortRate() float64 {
+	return float64(r.Aborts) / float64(r.Operations)
+}
+
+func key(i int) string {
+	return fmt.Sprintf("user%010d", i)
+}
+
+// LoadしてからRunLoadedする
+func Run(name string, newEngine func(opts ...engine.Option) engine.Engine, config Config) (Result, error) {
+	e, err := Load(newEngine, config)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return RunLoaded(name, e, config)
+}
+
+// エンジンを作ってconfig.Records件を書き込む。ベンチマークではロードを計測から外すのに使う
+func Load(newEngine func(opts ...engine.Option) engine.Engine, config Config) (engine.Engine, error) {
+	config = config.withDefaults()
+
+	opts := make([]engine.Option, 0)
+	if config.LockTimeout != 0 {
+		opts = append(opts, engine.WithLockTimeout(config.LockTimeout))
+	}
+	e := newEngine(opts...)
+
+	rng := rand.New(rand.NewPCG(config.Seed, 0))
+	err := load(e, config, rng)
+	if err != nil {
+		return nil, fmt.Errorf("load: %w", err)
+	}
+
+	return e, nil
+}
+
+// Loadしたエンジンで、1操作を1トランザクションとして実行する。エンジンは複数のgoroutineから同時に使えること
+func RunLoaded(name string, e engine.Engine, config Config) (Result, error) {
+	config = config.withDefaults()
+
+	r := &runner{
+		engine: e,
+		config: config,
+		choose: newChooser(config.Distribution, config.Records),
+	}
+	r.inserted.Store(int64(config.Records))
+
+	stop := make(chan struct{})
+	var gcDone sync.WaitGroup
+	if config.GCInterval > 0 {
+		gcDone.Add(1)
+		go func() {
+			defer gcDone.Done()
+			r.gc(stop)
+		}()
+	}
+
+	start := time.Now()
+	latencies := make([][]time.Duration, config.Concurrency)
+	var aborts atomic.Int64
+	var wg sync.WaitGroup
+	for i := range config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latencies[i] = r.work(rand.New(rand.NewPCG(config.Seed, uint64(i+1))), &aborts)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	close(stop)
+	gcDone.Wait()
+
+	all := slices.Concat(latencies...)
+	slices.Sort(all)
+
+	result := Result{
+		Engine:     name,
+		Workload:   config.Workload.Name,
+		Level:      config.Level,
+		Operations: len(all),
+		Aborts:     int(aborts.Load()),
+		Elapsed:    elapsed,
+		P50:        percentile(all, 0.5),
+		P99:        percentile(all, 0.99),
+	}
+
+	if s, ok := e.(engine.StatsEngine); ok {
+		for _, n := range s.Stats().ChainLengths {
+			result.Versions += n
+		}
+		result.VersionBytes = result.Versions * (len(key(0)) + config.ValueSize)
+	}
+
+	return result, nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	return sorted[min(int(float64(len(sorted))*p), len(sorted)-1)]
+}
+
+func value(rng *rand.Rand, size int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = letters[rng.IntN(len(letters))]
+	}
+
+	return string(b)
+}
+
+// 1000件ずつコミットする
+func load(e engine.Engine, config Config, rng *rand.Rand) error {
+	const batch = 1000
+
+	for i := 0; i < config.Records; i += batch {
+		tx := e.Begin(engine.ReadCommitted)
+		for j := i; j < min(i+batch, config.Records); j++ {
+			err := tx.Set(key(j), value(rng, config.ValueSize))
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type runner struct {
+	engine   engine.Engine
+	config   Config
+	choose   chooser
+	next     atomic.Int64 // 実行を始めた操作の数
+	inserted atomic.Int64 // 挿入を始めたキーの数
+}
+
+func (r *runner) gc(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.config.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.engine.GC()
+		}
+	}
+}
+
+func (r *runner) work(rng *rand.Rand, aborts *atomic.Int64) []time.Duration {
+	latencies := make([]time.Duration, 0, r.config.Operations/r.config.Concurrency+1)
+	for r.next.Add(1) <= int64(r.config.Operations) {
+		start := time.Now()
+		err := r.transaction(rng)
+		latencies = append(latencies, time.Since(start))
+
+		if err != nil {
+			aborts.Add(1)
+		}
+	}
+
+	return latencies
+}
+
+// 失敗したらAbortする
+func (r *runner) transaction(rng *rand.Rand) error {
+	tx := r.engine.Begin(r.config.Level)
+
+	err := r.do(tx, rng)
+	if err != nil {
+		return errors.Join(err, tx.Abort())
+	}
+
+	return tx.Commit()
+}
+
+func (r *runner) do(tx engine.Tx, rng *rand.Rand) error {
+	inserted := int(r.inserted.Load())
+
+	switch r.config.Workload.choose(rng.Float64()) {
+	case opRead:
+		return get(tx, key(r.choose(rng, inserted)))
+	case opUpdate:
+		return tx.Set(key(r.choose(rng, inserted)), value(rng, r.config.ValueSize))
+	case opInsert:
+		i := int(r.inserted.Add(1)) - 1
+		return tx.Set(key(i), value(rng, r.config.ValueSize))
+	case opScan:
+		start := r.choose(rng, inserted)
+		for i := range 1 + rng.IntN(r.config.ScanLength) {
+			err := get(tx, key(start+i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		k := key(r.choose(rng, inserted))
+		err := get(tx, k)
+		if err != nil {
+			return err
+		}
+		return tx.Set(k, value(rng, r.config.ValueSize))
+	}
+}
+
+// 挿入中でまだ見えないキーもあるのでErrNotFoundは失敗にしない
+func get(tx engine.Tx, key string) error {
+	_, err := tx.Get(key)
+	if errors.Is(err, engine.ErrNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "engine\tworkload\tlevel\tops/s\tp50\tp99\tabort rate\tversions\tversion bytes\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f\t%s\t%s\t%.2f%%\t%d\t%d\t\n",
+			r.Engine, r.Workload, r.Level, r.Throughput(), r.P50, r.P99, r.AbortRate()*100, r.Versions, r.VersionBytes)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,70 @@
+// YCSB (https://github.com/brianfrankcooper/YCSB) のワークロードでエンジンを比べる
+package ycsb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 各操作の割合。合計は1
+type Workload struct {
+	Name         string
+	Description  string
+	Read         float64
+	Update       float64
+	Insert       float64
+	Scan         float64
+	ReadModWrite float64
+	Distribution Distribution
+}
+
+var Workloads = []Workload{
+	{Name: "A", Description: "update heavy", Read: 0.5, Update: 0.5, Distribution: Zipfian},
+	{Name: "B", Description: "read mostly", Read: 0.95, Update: 0.05, Distribution: Zipfian},
+	{Name: "C", Description: "read only", Read: 1, Distribution: Zipfian},
+	{Name: "D", Description: "read latest", Read: 0.95, Insert: 0.05, Distribution: Latest},
+	// エンジンに範囲読み取りがないので、scanは連続するキーのGetで代用する
+	{Name: "E", Description: "short ranges", Scan: 0.95, Insert: 0.05, Distribution: Zipfian},
+	{Name: "F", Description: "read-modify-write", Read: 0.5, ReadModWrite: 0.5, Distribution: Zipfian},
+}
+
+// 名前は大文字小文字を区別しない
+func Lookup(name string) (Workload, error) {
+	for _, w := range Workloads {
+		if strings.EqualFold(w.Name, name) {
+			return w, nil
+		}
+	}
+
+	return Workload{}, fmt.Errorf("unknown workload %q", name)
+}
+
+type opKind int
+
+const (
+	opRead opKind = iota
+	opUpdate
+	opInsert
+	opScan
+	opReadModWrite
+)
+
+// [0, 1)の乱数から操作を選ぶ
+func (w Workload) choose(u float64) opKind {
+	for _, c := range []struct {
+		kind       opKind
+		proportion float64
+	}{
+		{opRead, w.Read},
+		{opUpdate, w.Update},
+		{opInsert, w.Insert},
+		{opScan, w.Scan},
+	} {
+		if u < c.proportion {
+			return c.kind
+		}
+		u -= c.proportion
+	}
+
+	return opReadModWrite
+}
@@ -0,0 +1,100 @@
+package ycsb_test
+
+import (
+	"fmt"
+	"mvcc-go/engine"
+	"mvcc-go/engine/registry"
+	"mvcc-go/ycsb"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	results := make([]ycsb.Result, 0)
+	for _, name := range registry.Names() {
+		newEngine, err := registry.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, workload := range ycsb.Workloads {
+			result, err := ycsb.Run(name, newEngine, ycsb.Config{
+				Workload:    workload,
+				Level:       engine.RepeatableRead,
+				Records:     100,
+				Operations:  200,
+				ValueSize:   10,
+				Concurrency: 4,
+				GCInterval:  time.Millisecond,
+				LockTimeout: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, workload.Name, err)
+			}
+
+			if result.Operations != 200 {
+				t.Errorf("%s %s: expected 200 operations, but got %d", name, workload.Name, result.Operations)
+			}
+			if result.P50 > result.P99 {
+				t.Errorf("%s %s: p50 %s > p99 %s", name, workload.Name, result.P50, result.P99)
+			}
+			// 読むだけなら失敗しない
+			if workload.Name == "C" && result.Aborts != 0 {
+				t.Errorf("%s C: expected no aborts, but got %d", name, result.Aborts)
+			}
+			if _, ok := newEngine().(engine.StatsEngine); ok && result.Versions < 100 {
+				t.Errorf("%s %s: expected at least 100 versions, but got %d", name, workload.Name, result.Versions)
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	if testing.Verbose() {
+		_ = ycsb.WriteTable(os.Stdout, results)
+	}
+}
+
+// go test -bench . ./ycsb
+func BenchmarkYCSB(b *testing.B) {
+	for _, name := range registry.Names() {
+		newEngine, err := registry.Lookup(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, level := range []engine.IsolationLevel{engine.ReadCommitted, engine.RepeatableRead} {
+			for _, workload := range ycsb.Workloads {
+				b.Run(fmt.Sprintf("%s/%s/%s", name, level, workload.Name), func(b *testing.B) {
+					config := ycsb.Config{
+						Workload:    workload,
+						Level:       level,
+						Records:     10000,
+						Operations:  b.N,
+						Concurrency: 8,
+						GCInterval:  10 * time.Millisecond,
+						LockTimeout: 10 * time.Millisecond,
+					}
+					e, err := ycsb.Load(newEngine, config)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					b.ResetTimer()
+					result, err := ycsb.RunLoaded(name, e, config)
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.StopTimer()
+
+					b.ReportMetric(result.Throughput(), "ops/s")
+					b.ReportMetric(float64(result.P50.Nanoseconds()), "p50-ns")
+					b.ReportMetric(float64(result.P99.Nanoseconds()), "p99-ns")
+					b.ReportMetric(result.AbortRate(), "abort-rate")
+					b.ReportMetric(float64(result.VersionBytes), "version-bytes")
+				})
+			}
+		}
+	}
+}